@@ -0,0 +1,924 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aclCategories are the command categories, in the order ACL CAT lists them.
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// commandCategories gives the categories of every command. A subcommand
+// listed as "command|subcommand" has categories of its own.
+var commandCategories = map[string][]string{
+	"get":            {"read", "string", "fast"},
+	"set":            {"write", "string", "slow"},
+	"del":            {"keyspace", "write", "slow"},
+	"keys":           {"keyspace", "read", "slow", "dangerous"},
+	"dump":           {"keyspace", "read", "slow"},
+	"restore":        {"keyspace", "write", "slow", "dangerous"},
+	"restore-asking": {"keyspace", "write", "slow", "dangerous"},
+	"migrate":        {"keyspace", "write", "slow", "dangerous"},
+	"ping":           {"fast", "connection"},
+	"echo":           {"fast", "connection"},
+	"hello":          {"fast", "connection"},
+	"auth":           {"fast", "connection"},
+	"quit":           {"fast", "connection"},
+	"client":         {"slow", "connection"},
+	"asking":         {"fast", "connection"},
+	"wait":           {"slow", "connection"},
+	"info":           {"slow", "dangerous"},
+	"config":         {"admin", "slow", "dangerous"},
+	"replconf":       {"admin", "slow", "dangerous"},
+	"psync":          {"admin", "slow", "dangerous"},
+	"replicaof":      {"admin", "slow", "dangerous"},
+	"slaveof":        {"admin", "slow", "dangerous"},
+	"failover":       {"admin", "slow", "dangerous"},
+	"cluster":        {"slow"},
+	"subscribe":      {"pubsub", "slow"},
+	"unsubscribe":    {"pubsub", "slow"},
+	"psubscribe":     {"pubsub", "slow"},
+	"punsubscribe":   {"pubsub", "slow"},
+	"ssubscribe":     {"pubsub", "slow"},
+	"sunsubscribe":   {"pubsub", "slow"},
+	"publish":        {"pubsub", "fast"},
+	"spublish":       {"pubsub", "fast"},
+	"pubsub":         {"pubsub", "slow"},
+	"multi":          {"transaction", "fast"},
+	"exec":           {"transaction", "slow"},
+	"discard":        {"transaction", "fast"},
+	"watch":          {"transaction", "fast"},
+	"unwatch":        {"transaction", "fast"},
+	"eval":           {"scripting", "slow"},
+	"evalsha":        {"scripting", "slow"},
+	"script":         {"scripting", "slow"},
+	"function":       {"scripting", "slow"},
+	"fcall":          {"scripting", "slow"},
+	"fcall_ro":       {"scripting", "slow"},
+	"acl":            {"admin", "slow", "dangerous"},
+	"acl|whoami":     {"slow"},
+	"acl|cat":        {"slow"},
+}
+
+// containerCommands take a subcommand, which denials name along with them.
+var containerCommands = map[string]bool{
+	"acl":      true,
+	"client":   true,
+	"cluster":  true,
+	"config":   true,
+	"function": true,
+	"pubsub":   true,
+	"script":   true,
+}
+
+// noAuthCommands may run before a client has authenticated.
+var noAuthCommands = map[string]bool{
+	"auth":  true,
+	"hello": true,
+	"quit":  true,
+}
+
+// keyPattern is a ~, %R~, %W~ or %RW~ rule: which keys a user may read,
+// write or both.
+type keyPattern struct {
+	pattern     string
+	read, write bool
+}
+
+func (p keyPattern) String() string {
+	switch {
+	case p.read && p.write:
+		return "~" + p.pattern
+	case p.read:
+		return "%R~" + p.pattern
+	default:
+		return "%W~" + p.pattern
+	}
+}
+
+// aclUser is a user as defined by ACL SETUSER. commands holds the command
+// rules in the order they were given, starting with +@all or -@all; the last
+// one that matches a command decides.
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string
+	commands  []string
+	keys      []keyPattern
+	channels  []string
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, commands: []string{"-@all"}}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = slices.Clone(u.passwords)
+	c.commands = slices.Clone(u.commands)
+	c.keys = slices.Clone(u.keys)
+	c.channels = slices.Clone(u.channels)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkPassword compares against every password hash in constant time.
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(password))
+	ok := false
+	for _, stored := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// applyRule applies one ACL SETUSER rule to u.
+func (u *aclUser) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allkeys":
+		u.keys = []keyPattern{{pattern: "*", read: true, write: true}}
+	case lower == "resetkeys":
+		u.keys = nil
+	case lower == "allchannels":
+		u.channels = []string{"*"}
+	case lower == "resetchannels":
+		u.channels = nil
+	case lower == "allcommands":
+		u.commands = []string{"+@all"}
+	case lower == "nocommands":
+		u.commands = []string{"-@all"}
+	case lower == "reset":
+		*u = *newACLUser(u.name)
+	case strings.HasPrefix(rule, ">"):
+		if hash := hashPassword(rule[1:]); !slices.Contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case strings.HasPrefix(rule, "<"):
+		u.passwords = slices.DeleteFunc(u.passwords, func(h string) bool { return h == hashPassword(rule[1:]) })
+	case strings.HasPrefix(rule, "#"):
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 64 {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if !slices.Contains(u.passwords, hash) {
+			u.passwords = append(u.passwords, hash)
+		}
+		u.nopass = false
+	case strings.HasPrefix(rule, "!"):
+		hash := strings.ToLower(rule[1:])
+		if !slices.Contains(u.passwords, hash) {
+			return errors.New("The password you are trying to remove from the user does not exist")
+		}
+		u.passwords = slices.DeleteFunc(u.passwords, func(h string) bool { return h == hash })
+	case strings.HasPrefix(rule, "~"):
+		u.keys = append(u.keys, keyPattern{pattern: rule[1:], read: true, write: true})
+	case strings.HasPrefix(rule, "%"):
+		flags, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || flags == "" {
+			return errors.New("Syntax error")
+		}
+		p := keyPattern{pattern: pattern}
+		for _, flag := range strings.ToUpper(flags) {
+			switch flag {
+			case 'R':
+				p.read = true
+			case 'W':
+				p.write = true
+			default:
+				return errors.New("Syntax error")
+			}
+		}
+		u.keys = append(u.keys, p)
+	case strings.HasPrefix(rule, "&"):
+		u.channels = append(u.channels, rule[1:])
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		return u.applyCommandRule(rule[:1], lower[1:])
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+// applyCommandRule adds a +/- rule for a command, a command|subcommand or a
+// @category.
+func (u *aclUser) applyCommandRule(sign, target string) error {
+	if category, ok := strings.CutPrefix(target, "@"); ok {
+		if category == "all" {
+			u.commands = []string{sign + "@all"}
+			return nil
+		}
+		if !slices.Contains(aclCategories, category) {
+			return errors.New("Unknown command category")
+		}
+	} else {
+		command, _, _ := strings.Cut(target, "|")
+		if _, ok := commandArity[command]; !ok {
+			return errors.New("Unknown command")
+		}
+	}
+	// A later rule for the same target replaces the earlier one.
+	u.commands = slices.DeleteFunc(u.commands, func(r string) bool { return r[1:] == target && r[1:] != "@all" })
+	u.commands = append(u.commands, sign+target)
+	return nil
+}
+
+// inCategory reports whether command, called with args, belongs to category.
+func inCategory(command string, args []string, category string) bool {
+	if category == "all" {
+		return true
+	}
+	if len(args) > 0 {
+		if categories, ok := commandCategories[command+"|"+strings.ToLower(args[0])]; ok {
+			return slices.Contains(categories, category)
+		}
+	}
+	return slices.Contains(commandCategories[command], category)
+}
+
+// canRun reports whether u may run command with args.
+func (u *aclUser) canRun(command string, args []string) bool {
+	allowed := false
+	for _, rule := range u.commands {
+		target := rule[1:]
+		var matches bool
+		if category, ok := strings.CutPrefix(target, "@"); ok {
+			matches = inCategory(command, args, category)
+		} else if name, sub, ok := strings.Cut(target, "|"); ok {
+			matches = name == command && len(args) > 0 && strings.EqualFold(args[0], sub)
+		} else {
+			matches = target == command
+		}
+		if matches {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+func (u *aclUser) canAccessKey(key string, read, write bool) bool {
+	for _, p := range u.keys {
+		if (p.read || !read) && (p.write || !write) && globMatch(p.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessChannel checks a channel, or for PSUBSCRIBE a pattern, which must
+// be one the user was given literally.
+func (u *aclUser) canAccessChannel(channel string, isPattern bool) bool {
+	for _, allowed := range u.channels {
+		if allowed == "*" || !isPattern && globMatch(allowed, channel) || isPattern && allowed == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// flags are the user's flags as ACL GETUSER lists them.
+func (u *aclUser) flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) keysDescription() string {
+	patterns := make([]string, len(u.keys))
+	for i, p := range u.keys {
+		patterns[i] = p.String()
+	}
+	return strings.Join(patterns, " ")
+}
+
+func (u *aclUser) channelsDescription() string {
+	patterns := make([]string, len(u.channels))
+	for i, c := range u.channels {
+		patterns[i] = "&" + c
+	}
+	return strings.Join(patterns, " ")
+}
+
+// description is the user as ACL LIST shows it, which is also how ACL SAVE
+// writes it and ACL SETUSER reads it back.
+func (u *aclUser) description() string {
+	parts := []string{"user", u.name}
+	parts = append(parts, u.flags()...)
+	for _, hash := range u.passwords {
+		parts = append(parts, "#"+hash)
+	}
+	if keys := u.keysDescription(); keys != "" {
+		parts = append(parts, keys)
+	}
+	if channels := u.channelsDescription(); channels != "" {
+		parts = append(parts, channels)
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.commands...)
+	return strings.Join(parts, " ")
+}
+
+// aclLogEntry is an ACL LOG entry. Denials that only differ in time are
+// folded into one entry and counted.
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// aclLogGrouping is how recent an entry must be for a like denial to be
+// counted in it rather than logged on its own.
+const aclLogGrouping = 60 * time.Second
+
+// aclState holds the users and the log of denied commands.
+type aclState struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+	file  string
+	// requirepass is what CONFIG GET requirepass reports.
+	requirepass string
+	log         []*aclLogEntry
+	logMax      int
+	nextID      int64
+}
+
+// newACLState creates the default user: enabled, able to run anything, and
+// protected by requirepass when it is set.
+func newACLState(requirepass, file string, logMax int) *aclState {
+	a := &aclState{users: map[string]*aclUser{}, file: file, requirepass: requirepass, logMax: logMax}
+	a.users["default"] = defaultACLUser(requirepass)
+	return a
+}
+
+func defaultACLUser(requirepass string) *aclUser {
+	u := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "allkeys", "allchannels", "+@all"} {
+		u.applyRule(rule)
+	}
+	if requirepass != "" {
+		u.applyRule(">" + requirepass)
+	}
+	return u
+}
+
+// setRequirepass implements CONFIG SET requirepass, which replaces the
+// default user's passwords.
+func (a *aclState) setRequirepass(password string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requirepass = password
+	u := a.users["default"].clone()
+	if password == "" {
+		u.applyRule("nopass")
+	} else {
+		u.applyRule("resetpass")
+		u.applyRule(">" + password)
+	}
+	a.users["default"] = u
+}
+
+// defaultAuthenticates reports whether connections are logged in as the
+// default user without AUTH, which is the case while it needs no password.
+func (a *aclState) defaultAuthenticates() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u := a.users["default"]
+	return u.enabled && u.nopass
+}
+
+// authenticate checks a username and password.
+func (a *aclState) authenticate(username, password string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[username]
+	return ok && u.enabled && u.checkPassword(password)
+}
+
+// authRequired reports whether cl must AUTH before running commands.
+func authRequired(cl *client, config *config) bool {
+	return !cl.isMaster && !cl.authenticated && !config.acl.defaultAuthenticates()
+}
+
+// aclCommandKeys returns the keys a command accesses. MIGRATE names them in
+// its own way, and isn't routed by cluster slot like the others.
+func aclCommandKeys(command string, args []string) []string {
+	if command == "migrate" && len(args) >= 5 {
+		if args[2] != "" {
+			return []string{args[2]}
+		}
+		for i, arg := range args {
+			if strings.EqualFold(arg, "keys") {
+				return args[i+1:]
+			}
+		}
+		return nil
+	}
+	if shardChannelCommands[command] {
+		return nil
+	}
+	return commandKeys(command, args)
+}
+
+// commandChannels returns the channels a command subscribes or publishes to,
+// and whether they are patterns.
+func commandChannels(command string, args []string) ([]string, bool) {
+	switch command {
+	case "subscribe", "ssubscribe":
+		return args, false
+	case "psubscribe":
+		return args, true
+	case "publish", "spublish":
+		if len(args) > 0 {
+			return args[:1], false
+		}
+	}
+	return nil, false
+}
+
+// check decides whether cl's user may run command with args, and returns
+// the reason and object of a denial for ACL LOG.
+func (a *aclState) check(cl *client, command string, args []string) (reason, object string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	u, ok := a.users[cl.user]
+	if !ok {
+		return "command", command
+	}
+	if !u.canRun(command, args) {
+		object = command
+		if len(args) > 0 && containerCommands[command] {
+			object += "|" + strings.ToLower(args[0])
+		}
+		return "command", object
+	}
+	write := isWriteCommand(command, args) || command == "eval" || command == "evalsha" || command == "fcall"
+	read := !isWriteCommand(command, args) || command == "migrate"
+	for _, key := range aclCommandKeys(command, args) {
+		if !u.canAccessKey(key, read, write) {
+			return "key", key
+		}
+	}
+	channels, isPattern := commandChannels(command, args)
+	for _, channel := range channels {
+		if !u.canAccessChannel(channel, isPattern) {
+			return "channel", channel
+		}
+	}
+	return "", ""
+}
+
+// checkACL returns the NOPERM error for a command cl's user may not run,
+// and logs the denial.
+func checkACL(cl *client, command string, args []string, config *config) error {
+	if cl.isMaster {
+		return nil
+	}
+	// Unknown commands are reported as such rather than as denied.
+	if _, ok := commandArity[command]; !ok {
+		return nil
+	}
+	reason, object := config.acl.check(cl, command, args)
+	if reason == "" {
+		return nil
+	}
+	context := "toplevel"
+	if cl.fromScript {
+		context = "lua"
+	} else if cl.inMulti {
+		context = "multi"
+	}
+	config.acl.logDenial(reason, context, object, cl.user, cl)
+	switch reason {
+	case "key":
+		return errors.New("NOPERM No permissions to access a key")
+	case "channel":
+		return errors.New("NOPERM No permissions to access a channel")
+	}
+	return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", cl.user, object)
+}
+
+func (a *aclState) logDenial(reason, context, object, username string, cl *client) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for _, entry := range a.log {
+		if entry.reason == reason && entry.context == context && entry.object == object && entry.username == username && now.Sub(entry.updated) < aclLogGrouping {
+			entry.count++
+			entry.updated = now
+			entry.clientInfo = clientInfo(cl)
+			return
+		}
+	}
+	a.nextID++
+	entry := &aclLogEntry{id: a.nextID - 1, count: 1, reason: reason, context: context, object: object, username: username,
+		clientInfo: clientInfo(cl), created: now, updated: now}
+	a.log = append([]*aclLogEntry{entry}, a.log...)
+	if len(a.log) > a.logMax {
+		a.log = a.log[:a.logMax]
+	}
+}
+
+// clientInfo describes a client the way ACL LOG entries do.
+func clientInfo(cl *client) string {
+	addr, laddr := "", ""
+	if cl.conn != nil {
+		addr, laddr = cl.conn.RemoteAddr().String(), cl.conn.LocalAddr().String()
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s user=%s resp=%d", cl.id, addr, laddr, cl.name, cl.user, cl.protocol)
+}
+
+// auth implements AUTH [username] password.
+func auth(cl *client, args []string, config *config, cm *connectionManager) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("ERR wrong number of arguments for 'auth' command")
+	}
+	username, password := "default", args[0]
+	if len(args) == 2 {
+		username, password = args[0], args[1]
+	} else if config.acl.defaultAuthenticates() {
+		return errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	if err := login(cl, username, password, config, cm); err != nil {
+		return err
+	}
+	cl.out.simpleString("OK")
+	return nil
+}
+
+// login authenticates cl as username, for AUTH and HELLO ... AUTH.
+func login(cl *client, username, password string, config *config, cm *connectionManager) error {
+	if !config.acl.authenticate(username, password) {
+		config.acl.logDenial("auth", "toplevel", "AUTH", username, cl)
+		return errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	cm.setUser(cl, username)
+	return nil
+}
+
+// setUser records who cl is logged in as. Only cl's own connection changes
+// it, under cm.mu so that other connections can read it.
+func (cm *connectionManager) setUser(cl *client, username string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cl.user = username
+	cl.authenticated = true
+}
+
+// disconnectUsers closes the connections logged in as one of usernames.
+func (cm *connectionManager) disconnectUsers(usernames []string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, cl := range cm.clients {
+		if slices.Contains(usernames, cl.user) {
+			cl.conn.Close()
+		}
+	}
+}
+
+// disconnectRevokedSubscribers closes the connections subscribed to a
+// channel or pattern their user may no longer access.
+func (cm *connectionManager) disconnectRevokedSubscribers(a *aclState) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, cl := range cm.clients {
+		u, ok := a.users[cl.user]
+		if !ok {
+			continue
+		}
+		revoked := false
+		for kind, names := range cl.subscriptions {
+			for name := range names {
+				if !u.canAccessChannel(name, subscriptionKind(kind) == patternSubscription) {
+					revoked = true
+				}
+			}
+		}
+		if revoked {
+			cl.conn.Close()
+		}
+	}
+}
+
+// setUser implements ACL SETUSER. The rules apply to a copy, so that the
+// user is left alone if one of them is invalid.
+func (a *aclState) setUser(name string, rules []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, ok := a.users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = newACLUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return fmt.Errorf("ERR Error in ACL SETUSER modifier '%s': %v", rule, err)
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+func (a *aclState) deleteUsers(names []string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if slices.Contains(names, "default") {
+		return 0, errors.New("ERR The 'default' user cannot be removed")
+	}
+	deleted := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (a *aclState) sortedUsers() []*aclUser {
+	users := make([]*aclUser, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users
+}
+
+// parseACLFile reads users from an aclfile: one "user <name> <rules...>"
+// line each.
+func parseACLFile(path string) (map[string]*aclUser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := map[string]*aclUser{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: should start with user keyword", path, line)
+		}
+		if _, ok := users[fields[1]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s' found", path, line, fields[1])
+		}
+		u := newACLUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.applyRule(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v. Error in user declaration '%s'", path, line, err, fields[1])
+			}
+		}
+		users[u.name] = u
+	}
+	return users, scanner.Err()
+}
+
+// loadFile replaces the users with those of the aclfile. The default user
+// keeps its settings unless the file defines it.
+func (a *aclState) loadFile() error {
+	if a.file == "" {
+		return errors.New("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+	}
+	users, err := parseACLFile(a.file)
+	if err != nil {
+		return fmt.Errorf("ERR %v", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := users["default"]; !ok {
+		users["default"] = a.users["default"]
+	}
+	a.users = users
+	return nil
+}
+
+// saveFile writes the users to the aclfile, through a temporary file so that
+// a failed write leaves the old one in place.
+func (a *aclState) saveFile() error {
+	if a.file == "" {
+		return errors.New("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+	}
+	a.mu.RLock()
+	var b strings.Builder
+	for _, u := range a.sortedUsers() {
+		b.WriteString(u.description() + "\n")
+	}
+	a.mu.RUnlock()
+	tmp := a.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.file)
+}
+
+// aclCommand implements ACL SETUSER, GETUSER, DELUSER, USERS, LIST, WHOAMI,
+// CAT, LOG, GENPASS, LOAD and SAVE.
+func aclCommand(cl *client, args []string, config *config, cm *connectionManager) error {
+	a := config.acl
+	w := cl.out
+	subcommand := strings.ToLower(args[0])
+	arity := map[string]int{"setuser": -2, "getuser": 2, "deluser": -2, "users": 1, "list": 1, "whoami": 1,
+		"cat": -1, "log": -1, "genpass": -1, "load": 1, "save": 1}
+	n, ok := arity[subcommand]
+	if !ok {
+		return fmt.Errorf("ERR unknown subcommand '%s'. Try ACL HELP.", args[0])
+	}
+	if n > 0 && len(args) != n || n < 0 && len(args) < -n {
+		return fmt.Errorf("ERR wrong number of arguments for 'acl|%s' command", subcommand)
+	}
+	switch subcommand {
+	case "setuser":
+		if err := a.setUser(args[1], args[2:]); err != nil {
+			return err
+		}
+		cm.disconnectRevokedSubscribers(a)
+		w.simpleString("OK")
+	case "getuser":
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		u, ok := a.users[args[1]]
+		if !ok {
+			w.null()
+			return nil
+		}
+		w.mapHeader(6)
+		w.bulk("flags")
+		w.bulkArray(u.flags())
+		w.bulk("passwords")
+		w.bulkArray(u.passwords)
+		w.bulk("commands")
+		w.bulk(strings.Join(u.commands, " "))
+		w.bulk("keys")
+		w.bulk(u.keysDescription())
+		w.bulk("channels")
+		w.bulk(u.channelsDescription())
+		w.bulk("selectors")
+		w.arrayHeader(0)
+	case "deluser":
+		deleted, err := a.deleteUsers(args[1:])
+		if err != nil {
+			return err
+		}
+		cm.disconnectUsers(args[1:])
+		w.integer(int64(deleted))
+	case "users", "list":
+		a.mu.RLock()
+		users := a.sortedUsers()
+		lines := make([]string, len(users))
+		for i, u := range users {
+			if subcommand == "users" {
+				lines[i] = u.name
+			} else {
+				lines[i] = u.description()
+			}
+		}
+		a.mu.RUnlock()
+		w.bulkArray(lines)
+	case "whoami":
+		w.bulk(cl.user)
+	case "cat":
+		if len(args) == 1 {
+			w.bulkArray(aclCategories)
+			return nil
+		}
+		category := strings.ToLower(args[1])
+		if !slices.Contains(aclCategories, category) {
+			return fmt.Errorf("ERR Unknown category '%s'", args[1])
+		}
+		var commands []string
+		for command, categories := range commandCategories {
+			if slices.Contains(categories, category) {
+				commands = append(commands, command)
+			}
+		}
+		sort.Strings(commands)
+		w.bulkArray(commands)
+	case "log":
+		return aclLog(w, args[1:], a)
+	case "genpass":
+		bits := 256
+		if len(args) > 1 {
+			var err error
+			if bits, err = strconv.Atoi(args[1]); err != nil || bits <= 0 || bits > 4096 {
+				return errors.New("ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+			}
+		}
+		buf := make([]byte, (bits+7)/8)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		w.bulk(hex.EncodeToString(buf)[:(bits+3)/4])
+	case "load":
+		if err := a.loadFile(); err != nil {
+			return err
+		}
+		cm.disconnectRevokedSubscribers(a)
+		w.simpleString("OK")
+	case "save":
+		if err := a.saveFile(); err != nil {
+			fmt.Println("Error saving ACL file:", err)
+			return errors.New("ERR There was an error trying to save the ACLs. Please check the server logs for more information")
+		}
+		w.simpleString("OK")
+	}
+	return nil
+}
+
+// aclLog implements ACL LOG [count | RESET].
+func aclLog(w *replyWriter, args []string, a *aclState) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	count := len(a.log)
+	if len(args) > 0 {
+		if strings.EqualFold(args[0], "reset") {
+			a.log = nil
+			w.simpleString("OK")
+			return nil
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return errors.New("ERR value is out of range, must be positive")
+		}
+		count = min(n, count)
+	}
+	now := time.Now()
+	w.arrayHeader(count)
+	for _, entry := range a.log[:count] {
+		w.mapHeader(10)
+		w.bulk("count")
+		w.integer(int64(entry.count))
+		w.bulk("reason")
+		w.bulk(entry.reason)
+		w.bulk("context")
+		w.bulk(entry.context)
+		w.bulk("object")
+		w.bulk(entry.object)
+		w.bulk("username")
+		w.bulk(entry.username)
+		w.bulk("age-seconds")
+		w.double(now.Sub(entry.created).Seconds())
+		w.bulk("client-info")
+		w.bulk(entry.clientInfo)
+		w.bulk("entry-id")
+		w.integer(entry.id)
+		w.bulk("timestamp-created")
+		w.integer(entry.created.UnixMilli())
+		w.bulk("timestamp-last-updated")
+		w.integer(entry.updated.UnixMilli())
+	}
+	return nil
+}
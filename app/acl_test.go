@@ -0,0 +1,234 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequirepassNeedsAuth(t *testing.T) {
+	server := startTestServer(t, "", func(config *config) { config.acl.setRequirepass("secret") })
+	client := dialTestClient(t, server.addr)
+
+	if reply := client.do("GET", "k"); reply != replyError("NOAUTH Authentication required.") {
+		t.Fatalf("GET before AUTH replied %v", reply)
+	}
+	if reply := client.do("AUTH", "wrong"); reply != replyError("WRONGPASS invalid username-password pair or user is disabled.") {
+		t.Fatalf("AUTH with the wrong password replied %v", reply)
+	}
+	if reply := client.do("AUTH", "secret"); reply != "OK" {
+		t.Fatalf("AUTH replied %v", reply)
+	}
+	if reply := client.do("ACL", "WHOAMI"); reply != "default" {
+		t.Fatalf("ACL WHOAMI replied %v", reply)
+	}
+	if reply := client.do("CONFIG", "GET", "requirepass"); !reflect.DeepEqual(reply, []any{"requirepass", "secret"}) {
+		t.Fatalf("CONFIG GET requirepass replied %v", reply)
+	}
+
+	resp3 := dialTestClient(t, server.addr)
+	if _, ok := resp3.do("HELLO", "3").(replyError); !ok {
+		t.Fatal("HELLO without AUTH succeeded")
+	}
+	if _, ok := resp3.do("HELLO", "3", "AUTH", "default", "secret").(map[string]any); !ok {
+		t.Fatal("HELLO 3 AUTH did not log in")
+	}
+
+	client.do("CONFIG", "SET", "requirepass", "")
+	if reply := dialTestClient(t, server.addr).do("GET", "k"); reply != nil {
+		t.Fatalf("GET without a requirepass replied %v", reply)
+	}
+}
+
+// aclLogEntries reads ACL LOG as maps, from the flat arrays RESP2 sends.
+func aclLogEntries(t *testing.T, client *testClient) []map[string]any {
+	t.Helper()
+	reply, ok := client.do("ACL", "LOG").([]any)
+	if !ok {
+		t.Fatalf("ACL LOG replied %v", reply)
+	}
+	entries := make([]map[string]any, len(reply))
+	for i, item := range reply {
+		fields := item.([]any)
+		entries[i] = map[string]any{}
+		for j := 0; j < len(fields); j += 2 {
+			entries[i][fields[j].(string)] = fields[j+1]
+		}
+	}
+	return entries
+}
+
+func TestAclUsersAreLimitedToTheirRules(t *testing.T) {
+	server := startTestServer(t, "")
+	admin := dialTestClient(t, server.addr)
+	client := dialTestClient(t, server.addr)
+
+	if reply := admin.do("ACL", "SETUSER", "alice", "on", ">pw", "~cache:*", "%R~ro:*", "+get", "+set", "+eval", "+acl|whoami"); reply != "OK" {
+		t.Fatalf("ACL SETUSER replied %v", reply)
+	}
+	if _, ok := admin.do("ACL", "SETUSER", "alice", "+nosuchcommand").(replyError); !ok {
+		t.Fatal("ACL SETUSER accepted an unknown command")
+	}
+	if reply := client.do("AUTH", "alice", "pw"); reply != "OK" {
+		t.Fatalf("AUTH alice replied %v", reply)
+	}
+	if reply := client.do("ACL", "WHOAMI"); reply != "alice" {
+		t.Fatalf("ACL WHOAMI replied %v", reply)
+	}
+
+	for _, c := range []struct {
+		args []string
+		want any
+	}{
+		{[]string{"SET", "cache:1", "v"}, "OK"},
+		{[]string{"GET", "cache:1"}, "v"},
+		{[]string{"GET", "ro:1"}, nil},
+		{[]string{"SET", "ro:1", "v"}, replyError("NOPERM No permissions to access a key")},
+		{[]string{"GET", "other"}, replyError("NOPERM No permissions to access a key")},
+		{[]string{"DEL", "cache:1"}, replyError("NOPERM User alice has no permissions to run the 'del' command")},
+		{[]string{"ACL", "LIST"}, replyError("NOPERM User alice has no permissions to run the 'acl|list' command")},
+	} {
+		if reply := client.do(c.args...); reply != c.want {
+			t.Errorf("%v replied %v, want %v", c.args, reply, c.want)
+		}
+	}
+	client.do("DEL", "cache:1")
+
+	entries := aclLogEntries(t, admin)
+	if len(entries) != 4 {
+		t.Fatalf("ACL LOG holds %d entries, want 4", len(entries))
+	}
+	latest := entries[1]
+	if latest["reason"] != "command" || latest["object"] != "del" || latest["username"] != "alice" || latest["context"] != "toplevel" || latest["count"] != 2 {
+		t.Fatalf("ACL LOG entry for the DELs is %v", latest)
+	}
+
+	// Scripts run as the calling user.
+	if _, ok := client.do("EVAL", "return redis.call('DEL', 'cache:1')", "0").(replyError); !ok {
+		t.Fatal("a script ran a command its user may not")
+	}
+	if entry := aclLogEntries(t, admin)[0]; entry["context"] != "lua" || entry["object"] != "del" {
+		t.Fatalf("ACL LOG entry for the script is %v", entry)
+	}
+	if reply := admin.do("ACL", "LOG", "RESET"); reply != "OK" {
+		t.Fatalf("ACL LOG RESET replied %v", reply)
+	}
+	if entries := aclLogEntries(t, admin); len(entries) != 0 {
+		t.Fatalf("ACL LOG holds %d entries after RESET", len(entries))
+	}
+}
+
+func TestAclGetuserAndDeluser(t *testing.T) {
+	server := startTestServer(t, "")
+	admin := dialTestClient(t, server.addr)
+	client := dialTestClient(t, server.addr)
+
+	admin.do("ACL", "SETUSER", "bob", "on", "nopass", "~*", "&news:*", "+@read", "-keys")
+	reply, ok := admin.do("ACL", "GETUSER", "bob").([]any)
+	if !ok || len(reply) != 12 {
+		t.Fatalf("ACL GETUSER replied %v", reply)
+	}
+	if !reflect.DeepEqual(reply[1], []any{"on", "nopass"}) || reply[5] != "-@all +@read -keys" || reply[7] != "~*" || reply[9] != "&news:*" {
+		t.Fatalf("ACL GETUSER replied %v", reply)
+	}
+	if reply := admin.do("ACL", "GETUSER", "nobody"); reply != nil {
+		t.Fatalf("ACL GETUSER of a missing user replied %v", reply)
+	}
+	if reply := admin.do("ACL", "USERS"); !reflect.DeepEqual(reply, []any{"bob", "default"}) {
+		t.Fatalf("ACL USERS replied %v", reply)
+	}
+
+	client.do("AUTH", "bob", "anything")
+	if reply := admin.do("ACL", "DELUSER", "default"); reply != replyError("ERR The 'default' user cannot be removed") {
+		t.Fatalf("ACL DELUSER default replied %v", reply)
+	}
+	if reply := admin.do("ACL", "DELUSER", "bob", "nobody"); reply != 1 {
+		t.Fatalf("ACL DELUSER replied %v", reply)
+	}
+	// Bob's connection is closed along with the user.
+	client.send("PING")
+	if reply, err := readTestReply(client.reader); err == nil {
+		t.Fatalf("deleted user's connection replied %v", reply)
+	}
+}
+
+func TestRevokedChannelsDisconnectSubscribers(t *testing.T) {
+	server := startTestServer(t, "")
+	admin := dialTestClient(t, server.addr)
+	subscriber := dialTestClient(t, server.addr)
+
+	admin.do("ACL", "SETUSER", "carol", "on", "nopass", "&news:*", "+subscribe", "+publish")
+	subscriber.do("AUTH", "carol", "x")
+	if reply := subscriber.do("SUBSCRIBE", "other"); reply != replyError("NOPERM No permissions to access a channel") {
+		t.Fatalf("SUBSCRIBE to a forbidden channel replied %v", reply)
+	}
+	if reply := subscriber.do("SUBSCRIBE", "news:1"); !reflect.DeepEqual(reply, []any{"subscribe", "news:1", 1}) {
+		t.Fatalf("SUBSCRIBE replied %v", reply)
+	}
+	admin.do("ACL", "SETUSER", "carol", "resetchannels")
+	if reply, err := readTestReply(subscriber.reader); err == nil {
+		t.Fatalf("subscriber to a revoked channel got %v", reply)
+	}
+}
+
+func TestAclFileIsLoadedAndSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(path, []byte("user dave on >pw ~* +@all\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server := startTestServer(t, "", func(config *config) {
+		config.acl = newACLState("", path, config.server.aclLogMaxLen)
+		if err := config.acl.loadFile(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	client := dialTestClient(t, server.addr)
+
+	if reply := client.do("AUTH", "dave", "pw"); reply != "OK" {
+		t.Fatalf("AUTH as a user from the file replied %v", reply)
+	}
+	client.do("ACL", "SETUSER", "erin", "on", "nopass", "+get")
+	if reply := client.do("ACL", "SAVE"); reply != "OK" {
+		t.Fatalf("ACL SAVE replied %v", reply)
+	}
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(saved), "user erin on nopass") || !strings.Contains(string(saved), "user dave on #") {
+		t.Fatalf("ACL SAVE wrote %q", saved)
+	}
+
+	if err := os.WriteFile(path, []byte("user dave on >pw ~* +@all\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if reply := client.do("ACL", "LOAD"); reply != "OK" {
+		t.Fatalf("ACL LOAD replied %v", reply)
+	}
+	if reply := client.do("ACL", "USERS"); !reflect.DeepEqual(reply, []any{"dave", "default"}) {
+		t.Fatalf("ACL USERS after ACL LOAD replied %v", reply)
+	}
+	if err := os.WriteFile(path, []byte("dave on\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.do("ACL", "LOAD").(replyError); !ok {
+		t.Fatal("ACL LOAD accepted a malformed file")
+	}
+}
+
+func TestReplicaAuthenticatesToItsMaster(t *testing.T) {
+	master := startTestServer(t, "", func(config *config) { config.acl.setRequirepass("secret") })
+	replica := startTestServer(t, masterDetailsOf(master.addr), func(config *config) { config.server.masterAuth = "secret" })
+	waitFor(t, "the replica link", replica.config.server.link.isUp)
+
+	client := dialTestClient(t, master.addr)
+	client.do("AUTH", "secret")
+	client.do("SET", "k", "v")
+	waitFor(t, "the write to reach the replica", func() bool {
+		replica.store.mu.RLock()
+		defer replica.store.mu.RUnlock()
+		return replica.store.store["k"].content == "v"
+	})
+}
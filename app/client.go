@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// serverVersion is the Redis version this server reports to clients.
+const serverVersion = "7.2.0"
+
+var nextClientID atomic.Int64
+
+// client is the per-connection state handed to handleCommand.
+type client struct {
+	id   int64
+	conn net.Conn
+	// isMaster marks the replication link to our master, whose commands
+	// must always be applied and never answered.
+	isMaster bool
+	// listeningPort is announced by replicas with REPLCONF listening-port.
+	listeningPort int
+	// subscriptions holds the pub/sub channels, patterns and shard channels
+	// of this connection, indexed by subscriptionKind and guarded by the
+	// connection manager's lock. subscribed is their total, for readers
+	// that don't hold it. Messages wait in messages until they are written
+	// out.
+	subscriptions [subscriptionKinds]map[string]bool
+	subscribed    atomic.Int32
+	messages      *subscriberBuffer
+	// asking is set by ASKING and lets the next command reach a slot this
+	// node is importing.
+	asking bool
+	// protocol is the RESP version negotiated with HELLO.
+	protocol int
+	name     string
+	// user is the ACL user this client runs commands as, and authenticated
+	// records that it logged in with AUTH or HELLO. Both are guarded by the
+	// connection manager's lock. fromScript marks the client a script's
+	// redis.call runs as, for ACL LOG.
+	user          string
+	authenticated bool
+	fromScript    bool
+	// out buffers the replies to this client until they are flushed.
+	// writeMu guards it, as pub/sub messages are written from elsewhere.
+	out     *replyWriter
+	writeMu sync.Mutex
+	// closing is set by QUIT, closing the connection once its reply is out.
+	closing bool
+	// inMulti is set between MULTI and EXEC or DISCARD, while commands are
+	// queued in multiQueue. multiAborted records that one of them was
+	// refused, which makes EXEC fail.
+	inMulti      bool
+	multiQueue   []queuedCommand
+	multiAborted bool
+	// cancel, when closed, abandons a command still waiting for the
+	// store's exec lock. Only the master link sets it.
+	cancel <-chan struct{}
+	// watched are the keys this client WATCHes for its next EXEC.
+	watched []watchedKey
+	// tracking holds the CLIENT TRACKING options, nil while tracking is
+	// off, and caching the CLIENT CACHING answer for the next command.
+	tracking *trackingOptions
+	caching  string
+}
+
+func newClient(conn net.Conn) *client {
+	return &client{id: nextClientID.Add(1), conn: conn, user: "default", protocol: 2, out: newReplyWriter(conn, 2)}
+}
+
+// newMasterClient is the client for the link to our master. Its replies go
+// to replies, from which the link sends back only what the master expects.
+func newMasterClient(conn net.Conn, replies io.Writer) *client {
+	return &client{id: nextClientID.Add(1), conn: conn, isMaster: true, user: "default", protocol: 2, out: newReplyWriter(replies, 2)}
+}
+
+func (cl *client) setProtocol(protocol int) {
+	cl.protocol = protocol
+	cl.out.proto = protocol
+}
+
+func (cl *client) resetMulti() {
+	cl.inMulti = false
+	cl.multiQueue = nil
+	cl.multiAborted = false
+}
+
+// validClientName rejects names that would break CLIENT LIST output.
+func validClientName(name string) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// hello implements HELLO [protover [AUTH username password] [SETNAME name]].
+// Nothing changes unless every option is valid.
+func hello(cl *client, args []string, config *config, cm *connectionManager) error {
+	protocol := cl.protocol
+	name := cl.name
+	var username, password string
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return errors.New("ERR Protocol version is not an integer or out of range")
+		}
+		if version != 2 && version != 3 {
+			return errors.New("NOPROTO unsupported protocol version")
+		}
+		protocol = version
+	}
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			if i+2 >= len(args) {
+				return errors.New("ERR Syntax error in HELLO option 'auth'")
+			}
+			username, password = args[i+1], args[i+2]
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				return errors.New("ERR Syntax error in HELLO option 'setname'")
+			}
+			if !validClientName(args[i+1]) {
+				return errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			name = args[i+1]
+			i++
+		default:
+			return errors.New("ERR Syntax error in HELLO option '" + args[i] + "'")
+		}
+	}
+	if username != "" {
+		if err := login(cl, username, password, config, cm); err != nil {
+			return err
+		}
+	} else if authRequired(cl, config) {
+		return errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+	cl.setProtocol(protocol)
+	cl.name = name
+
+	mode, role := "standalone", "master"
+	if config.cluster != nil {
+		mode = "cluster"
+	}
+	if config.isReplica() {
+		role = "replica"
+	}
+	w := cl.out
+	w.mapHeader(7)
+	w.bulk("server")
+	w.bulk("redis")
+	w.bulk("version")
+	w.bulk(serverVersion)
+	w.bulk("proto")
+	w.integer(int64(cl.protocol))
+	w.bulk("id")
+	w.integer(cl.id)
+	w.bulk("mode")
+	w.bulk(mode)
+	w.bulk("role")
+	w.bulk(role)
+	w.bulk("modules")
+	w.arrayHeader(0)
+	return nil
+}
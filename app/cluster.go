@@ -0,0 +1,716 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSlots       = 16384
+	clusterBusPortDiff = 10000
+)
+
+// keySpec locates the keys of a command among its arguments: from index first
+// to last (negative counts from the end) moving step at a time.
+type keySpec struct {
+	first int
+	last  int
+	step  int
+}
+
+var commandKeySpecs = map[string]keySpec{
+	"get":            {0, 0, 1},
+	"set":            {0, 0, 1},
+	"del":            {0, -1, 1},
+	"dump":           {0, 0, 1},
+	"restore":        {0, 0, 1},
+	"restore-asking": {0, 0, 1},
+	"ssubscribe":     {0, -1, 1},
+	"spublish":       {0, 0, 1},
+}
+
+// shardChannelCommands take shard channels where other commands take keys.
+// They hash to slots the same way but ignore migrations: a shard channel
+// lives on the owner of its slot, and subscribers may also use the owner's
+// replicas.
+var shardChannelCommands = map[string]bool{
+	"ssubscribe": true,
+	"spublish":   true,
+}
+
+type clusterNode struct {
+	id           string
+	host         string
+	port         int
+	replica      bool
+	masterID     string
+	configEpoch  int
+	replOffset   int
+	handshake    bool
+	pfail        bool
+	fail         bool
+	failTime     time.Time
+	pingSent     time.Time
+	pongReceived time.Time
+	// failReports maps the IDs of masters that flagged this node as failing
+	// to when they last did.
+	failReports map[string]time.Time
+	link        *clusterLink
+	connecting  bool
+	ctime       time.Time
+}
+
+func newClusterNode(id, host string, port int) *clusterNode {
+	return &clusterNode{id: id, host: host, port: port, failReports: make(map[string]time.Time), ctime: time.Now()}
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port))
+}
+
+func (n *clusterNode) busAddr() string {
+	return net.JoinHostPort(n.host, strconv.Itoa(n.port+clusterBusPortDiff))
+}
+
+// clusterState maps every hash slot to the node serving it and tracks what
+// this node knows about the rest of the cluster.
+type clusterState struct {
+	mu     sync.RWMutex
+	myself *clusterNode
+	nodes  map[string]*clusterNode
+	slots  [clusterSlots]*clusterNode
+	// migrating and importing hold the other end of slots being resharded.
+	migrating     [clusterSlots]*clusterNode
+	importing     [clusterSlots]*clusterNode
+	currentEpoch  int
+	lastVoteEpoch int
+	configFile    string
+	nodeTimeout   time.Duration
+	// votedFor remembers when we last voted for a replica of each master.
+	votedFor  map[string]time.Time
+	forgotten map[string]time.Time
+	failover  replicaFailover
+	dirty     bool
+	config    *config
+	cm        *connectionManager
+	store     *redisStore
+}
+
+func newClusterState(host string, port int, configFile string, nodeTimeout time.Duration) *clusterState {
+	myself := newClusterNode(newReplID(), host, port)
+	return &clusterState{
+		myself:      myself,
+		nodes:       map[string]*clusterNode{myself.id: myself},
+		configFile:  configFile,
+		nodeTimeout: nodeTimeout,
+		votedFor:    make(map[string]time.Time),
+		forgotten:   make(map[string]time.Time),
+	}
+}
+
+var crc16Table = func() [256]uint16 {
+	var table [256]uint16
+	for i := range table {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum Redis Cluster hashes keys with.
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// keyHashSlot returns the slot of key. Only the part between the first { and
+// the following } is hashed when it is non-empty, so related keys can be
+// forced into the same slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+func commandKeys(command string, args []string) []string {
+	if command == "eval" || command == "evalsha" || command == "fcall" || command == "fcall_ro" {
+		return scriptKeys(args)
+	}
+	spec, ok := commandKeySpecs[command]
+	if !ok {
+		return nil
+	}
+	last := spec.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	var keys []string
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// redirect checks that this node serves the keys of a command and returns
+// the redirection error to reply with otherwise. While a slot is being
+// migrated, keys already moved are redirected with -ASK, and the importing
+// node serves them to clients that sent ASKING.
+func (cs *clusterState) redirect(command string, args []string, asking bool, store *redisStore) error {
+	keys := commandKeys(command, args)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	owner := cs.slots[slot]
+	if owner == nil {
+		return errors.New("CLUSTERDOWN Hash slot not served")
+	}
+	if owner.fail {
+		return errors.New("CLUSTERDOWN The cluster is down")
+	}
+	if shardChannelCommands[command] {
+		if owner == cs.myself || command == "ssubscribe" && cs.servesSlot(slot) {
+			return nil
+		}
+		return fmt.Errorf("MOVED %d %s:%d", slot, owner.host, owner.port)
+	}
+
+	missing := 0
+	if cs.migrating[slot] != nil || cs.importing[slot] != nil {
+		for _, key := range keys {
+			if !store.exists(key) {
+				missing++
+			}
+		}
+	}
+	if owner == cs.myself {
+		if target := cs.migrating[slot]; target != nil && missing > 0 {
+			if missing < len(keys) {
+				return errors.New("TRYAGAIN Multiple keys request during rehashing of slot")
+			}
+			return fmt.Errorf("ASK %d %s:%d", slot, target.host, target.port)
+		}
+		return nil
+	}
+	if cs.importing[slot] != nil && asking {
+		if len(keys) > 1 && missing > 0 {
+			return errors.New("TRYAGAIN Multiple keys request during rehashing of slot")
+		}
+		return nil
+	}
+	return fmt.Errorf("MOVED %d %s:%d", slot, owner.host, owner.port)
+}
+
+// servesSlot reports whether this node owns slot or replicates its owner.
+// The caller holds cs.mu.
+func (cs *clusterState) servesSlot(slot int) bool {
+	owner := cs.slots[slot]
+	if owner == nil {
+		return false
+	}
+	return owner == cs.myself || cs.myself.replica && owner.id == cs.myself.masterID
+}
+
+// dropShardChannels unsubscribes the clients of shard channels in slots this
+// node stopped serving. It runs after every change to the slot map, with
+// cs.mu held.
+func (cs *clusterState) dropShardChannels() {
+	if cs.cm != nil {
+		cs.cm.dropShardChannels(cs.servesSlot)
+	}
+}
+
+// slotRanges returns the contiguous slot ranges owned by each node.
+func (cs *clusterState) slotRanges() map[*clusterNode][][2]int {
+	ranges := make(map[*clusterNode][][2]int)
+	for slot := 0; slot < clusterSlots; slot++ {
+		owner := cs.slots[slot]
+		if owner == nil {
+			continue
+		}
+		nodeRanges := ranges[owner]
+		if n := len(nodeRanges); n > 0 && nodeRanges[n-1][1] == slot-1 {
+			nodeRanges[n-1][1] = slot
+		} else {
+			nodeRanges = append(nodeRanges, [2]int{slot, slot})
+		}
+		ranges[owner] = nodeRanges
+	}
+	return ranges
+}
+
+func (cs *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cs.nodes))
+	for _, node := range cs.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// replicasOf returns the known replicas of the master with the given ID.
+func (cs *clusterState) replicasOf(masterID string) []*clusterNode {
+	var replicas []*clusterNode
+	for _, node := range cs.sortedNodes() {
+		if node.replica && node.masterID == masterID {
+			replicas = append(replicas, node)
+		}
+	}
+	return replicas
+}
+
+func (cs *clusterState) slotCount(node *clusterNode) int {
+	count := 0
+	for _, owner := range cs.slots {
+		if owner == node {
+			count++
+		}
+	}
+	return count
+}
+
+func parseSlot(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, errors.New("ERR Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// clusterCommand implements the CLUSTER subcommands.
+func clusterCommand(args []string, config *config, store *redisStore, w *replyWriter) error {
+	cs := config.cluster
+	if cs == nil {
+		return errors.New("ERR This instance has cluster support disabled")
+	}
+	if len(args) == 0 {
+		return errors.New("ERR wrong number of arguments for 'cluster' command")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "keyslot":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'cluster|keyslot' command")
+		}
+		w.integer(int64(keyHashSlot(args[1])))
+	case "myid":
+		w.bulk(cs.myself.id)
+	case "addslots", "delslots":
+		if len(args) < 2 {
+			return fmt.Errorf("ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(args[0]))
+		}
+		var slots []int
+		for _, arg := range args[1:] {
+			slot, err := parseSlot(arg)
+			if err != nil {
+				return err
+			}
+			slots = append(slots, slot)
+		}
+		if err := cs.assignSlots(slots, strings.ToLower(args[0]) == "addslots"); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+	case "addslotsrange", "delslotsrange":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return fmt.Errorf("ERR wrong number of arguments for 'cluster|%s' command", strings.ToLower(args[0]))
+		}
+		var slots []int
+		for i := 1; i < len(args); i += 2 {
+			start, err := parseSlot(args[i])
+			if err != nil {
+				return err
+			}
+			end, err := parseSlot(args[i+1])
+			if err != nil {
+				return err
+			}
+			if start > end {
+				return fmt.Errorf("ERR start slot number %d is greater than end slot number %d", start, end)
+			}
+			for slot := start; slot <= end; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		if err := cs.assignSlots(slots, strings.ToLower(args[0]) == "addslotsrange"); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+	case "countkeysinslot":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'cluster|countkeysinslot' command")
+		}
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return err
+		}
+		w.integer(int64(len(store.keysInSlot(slot, -1))))
+	case "getkeysinslot":
+		if len(args) != 3 {
+			return errors.New("ERR wrong number of arguments for 'cluster|getkeysinslot' command")
+		}
+		slot, err := parseSlot(args[1])
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil || count < 0 {
+			return errors.New("ERR Invalid number of keys")
+		}
+		w.bulkArray(store.keysInSlot(slot, count))
+	case "info":
+		w.verbatim("txt", cs.info())
+	case "slots":
+		cs.slotsReply(w)
+	case "shards":
+		cs.shardsReply(w)
+	case "nodes":
+		w.verbatim("txt", cs.nodesDescription())
+	case "setslot":
+		if err := cs.setSlot(args[1:], store); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+	case "meet":
+		if len(args) < 3 {
+			return errors.New("ERR wrong number of arguments for 'cluster|meet' command")
+		}
+		port, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errors.New("ERR Invalid base port specified: " + args[2])
+		}
+		cs.meet(args[1], port)
+		w.simpleString("OK")
+	case "replicate":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'cluster|replicate' command")
+		}
+		if err := cs.replicate(args[1]); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+	case "replicas", "slaves":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'cluster|replicas' command")
+		}
+		return cs.replicasReply(args[1], w)
+	case "forget":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'cluster|forget' command")
+		}
+		if err := cs.forget(args[1]); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+	case "count-failure-reports":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'cluster|count-failure-reports' command")
+		}
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		node, ok := cs.nodes[args[1]]
+		if !ok {
+			return fmt.Errorf("ERR Unknown node %s", args[1])
+		}
+		w.integer(int64(len(node.failReports)))
+	case "saveconfig":
+		cs.mu.RLock()
+		defer cs.mu.RUnlock()
+		if err := cs.saveConfig(); err != nil {
+			return fmt.Errorf("ERR error saving the cluster node config: %v", err)
+		}
+		w.simpleString("OK")
+	default:
+		return fmt.Errorf("ERR unknown subcommand '%s'", args[0])
+	}
+	return nil
+}
+
+func (cs *clusterState) assignSlots(slots []int, add bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.myself.replica {
+		return errors.New("ERR Please use SETSLOT only with masters.")
+	}
+	for _, slot := range slots {
+		if add && cs.slots[slot] != nil {
+			return fmt.Errorf("ERR Slot %d is already busy", slot)
+		}
+		if !add && cs.slots[slot] == nil {
+			return fmt.Errorf("ERR Slot %d is already unassigned", slot)
+		}
+	}
+	for _, slot := range slots {
+		if add {
+			cs.slots[slot] = cs.myself
+		} else {
+			cs.slots[slot] = nil
+		}
+	}
+	cs.dropShardChannels()
+	cs.saveConfig()
+	return nil
+}
+
+func (cs *clusterState) healthy() bool {
+	for _, owner := range cs.slots {
+		if owner == nil || owner.fail {
+			return false
+		}
+	}
+	return true
+}
+
+// info renders CLUSTER INFO.
+func (cs *clusterState) info() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	assigned, pfail, fail := 0, 0, 0
+	for _, owner := range cs.slots {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		if owner.fail {
+			fail++
+		} else if owner.pfail {
+			pfail++
+		}
+	}
+	state := "fail"
+	if cs.healthy() {
+		state = "ok"
+	}
+	output := fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_slots_ok:%d\r\ncluster_slots_pfail:%d\r\ncluster_slots_fail:%d\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\ncluster_current_epoch:%d\r\ncluster_my_epoch:%d\r\n",
+		state, assigned, assigned-pfail-fail, pfail, fail, len(cs.nodes), len(cs.slotRanges()), cs.currentEpoch, cs.myEpoch())
+	return output
+}
+
+// myEpoch is the config epoch of this node, or of its master for a replica.
+func (cs *clusterState) myEpoch() int {
+	if cs.myself.replica {
+		if master, ok := cs.nodes[cs.myself.masterID]; ok {
+			return master.configEpoch
+		}
+	}
+	return cs.myself.configEpoch
+}
+
+func (cs *clusterState) slotsReply(w *replyWriter) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	type slotRange struct {
+		start, end int
+		node       *clusterNode
+	}
+	var ranges []slotRange
+	for node, nodeRanges := range cs.slotRanges() {
+		for _, r := range nodeRanges {
+			ranges = append(ranges, slotRange{r[0], r[1], node})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	w.arrayHeader(len(ranges))
+	for _, r := range ranges {
+		servers := []*clusterNode{r.node}
+		for _, replica := range cs.replicasOf(r.node.id) {
+			if !replica.fail {
+				servers = append(servers, replica)
+			}
+		}
+		w.arrayHeader(2 + len(servers))
+		w.integer(int64(r.start))
+		w.integer(int64(r.end))
+		for _, server := range servers {
+			w.arrayHeader(3)
+			w.bulk(server.host)
+			w.integer(int64(server.port))
+			w.bulk(server.id)
+		}
+	}
+}
+
+func (cs *clusterState) shardsReply(w *replyWriter) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	ranges := cs.slotRanges()
+
+	var masters []*clusterNode
+	for _, node := range cs.sortedNodes() {
+		if !node.replica && !node.handshake {
+			masters = append(masters, node)
+		}
+	}
+
+	w.arrayHeader(len(masters))
+	for _, master := range masters {
+		w.mapHeader(2)
+		w.bulk("slots")
+		w.arrayHeader(2 * len(ranges[master]))
+		for _, r := range ranges[master] {
+			w.integer(int64(r[0]))
+			w.integer(int64(r[1]))
+		}
+		shard := append([]*clusterNode{master}, cs.replicasOf(master.id)...)
+		w.bulk("nodes")
+		w.arrayHeader(len(shard))
+		for _, node := range shard {
+			role, health := "master", "online"
+			if node.replica {
+				role = "replica"
+			}
+			if node.fail || node.pfail {
+				health = "fail"
+			}
+			w.mapHeader(7)
+			w.bulk("id")
+			w.bulk(node.id)
+			w.bulk("port")
+			w.integer(int64(node.port))
+			w.bulk("ip")
+			w.bulk(node.host)
+			w.bulk("endpoint")
+			w.bulk(node.host)
+			w.bulk("role")
+			w.bulk(role)
+			w.bulk("replication-offset")
+			w.integer(int64(node.replOffset))
+			w.bulk("health")
+			w.bulk(health)
+		}
+	}
+}
+
+func (cs *clusterState) nodeFlags(node *clusterNode) string {
+	var flags []string
+	if node == cs.myself {
+		flags = append(flags, "myself")
+	}
+	if node.replica {
+		flags = append(flags, "slave")
+	} else {
+		flags = append(flags, "master")
+	}
+	if node.fail {
+		flags = append(flags, "fail")
+	} else if node.pfail {
+		flags = append(flags, "fail?")
+	}
+	if node.handshake {
+		flags = append(flags, "handshake")
+	}
+	return strings.Join(flags, ",")
+}
+
+// nodeLine renders one node in CLUSTER NODES (and nodes.conf) format.
+func (cs *clusterState) nodeLine(node *clusterNode, ranges [][2]int) string {
+	masterID := "-"
+	if node.replica {
+		masterID = node.masterID
+	}
+	linkState := "disconnected"
+	if node == cs.myself || node.link != nil {
+		linkState = "connected"
+	}
+	line := fmt.Sprintf("%s %s:%d@%d %s %s %d %d %d %s", node.id, node.host, node.port, node.port+clusterBusPortDiff,
+		cs.nodeFlags(node), masterID, unixMilli(node.pingSent), unixMilli(node.pongReceived), node.configEpoch, linkState)
+	for _, r := range ranges {
+		if r[0] == r[1] {
+			line += fmt.Sprintf(" %d", r[0])
+		} else {
+			line += fmt.Sprintf(" %d-%d", r[0], r[1])
+		}
+	}
+	if node == cs.myself {
+		for _, label := range cs.migrationLabels() {
+			line += " " + label
+		}
+	}
+	return line
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// nodesDescription renders CLUSTER NODES, one line per known node.
+func (cs *clusterState) nodesDescription() string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	ranges := cs.slotRanges()
+	output := ""
+	for _, node := range cs.sortedNodes() {
+		output += cs.nodeLine(node, ranges[node]) + "\n"
+	}
+	return output
+}
+
+func (cs *clusterState) replicasReply(masterID string, w *replyWriter) error {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	master, ok := cs.nodes[masterID]
+	if !ok {
+		return fmt.Errorf("ERR Unknown node %s", masterID)
+	}
+	if master.replica {
+		return errors.New("ERR The specified node is not a master")
+	}
+	var lines []string
+	for _, replica := range cs.replicasOf(masterID) {
+		lines = append(lines, cs.nodeLine(replica, nil))
+	}
+	w.bulkArray(lines)
+	return nil
+}
+
+// keysInSlot returns up to count keys hashing to slot; a negative count
+// returns all of them.
+func (r *redisStore) keysInSlot(slot int, count int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := []string{}
+	for key, val := range r.store {
+		if count >= 0 && len(keys) >= count {
+			break
+		}
+		if val.expiry != 0 && expired(val.expiry) {
+			continue
+		}
+		if keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,877 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	clusterCronInterval    = 100 * time.Millisecond
+	clusterMaxPingInterval = time.Second
+	clusterDialTimeout     = time.Second
+	clusterWriteTimeout    = time.Second
+	clusterRedialDelay     = 500 * time.Millisecond
+	clusterForgetTTL       = time.Minute
+	// clusterHeaderFields is the number of fields after the message type up
+	// to and including the gossip count.
+	clusterHeaderFields = 10
+)
+
+// clusterLink is an outgoing bus connection to another node.
+type clusterLink struct {
+	conn net.Conn
+}
+
+func (l *clusterLink) send(msg []string) error {
+	l.conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+	_, err := l.conn.Write([]byte(respGenerator(msg)))
+	return err
+}
+
+// replicaFailover is the state of an election this replica runs to replace
+// its failed master.
+type replicaFailover struct {
+	authTime  time.Time
+	authSent  bool
+	authEpoch int
+	votes     map[string]bool
+}
+
+type gossipEntry struct {
+	id    string
+	host  string
+	port  int
+	flags string
+}
+
+// clusterMessage is a decoded bus message. Every message is a RESP array of
+// the message type, the sender's header and its gossip section, followed by
+// any type specific fields (the failing node ID for FAIL).
+type clusterMessage struct {
+	kind         string
+	sender       string
+	host         string
+	port         int
+	replica      bool
+	masterID     string
+	currentEpoch int
+	configEpoch  int
+	replOffset   int
+	slots        [][2]int
+	gossip       []gossipEntry
+	extra        []string
+}
+
+func parseClusterMessage(kind string, args []string) (*clusterMessage, error) {
+	if len(args) < clusterHeaderFields {
+		return nil, errors.New("short cluster message")
+	}
+	msg := &clusterMessage{kind: kind, sender: args[0], host: args[1], replica: args[3] == "slave", masterID: args[4]}
+	ints := []*int{&msg.port, &msg.currentEpoch, &msg.configEpoch, &msg.replOffset}
+	for i, field := range []string{args[2], args[5], args[6], args[7]} {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster message field %q", field)
+		}
+		*ints[i] = n
+	}
+	if args[8] != "-" {
+		for _, part := range strings.Split(args[8], ",") {
+			start, end, isRange := strings.Cut(part, "-")
+			if !isRange {
+				end = start
+			}
+			first, err := parseSlot(start)
+			if err != nil {
+				return nil, err
+			}
+			last, err := parseSlot(end)
+			if err != nil {
+				return nil, err
+			}
+			msg.slots = append(msg.slots, [2]int{first, last})
+		}
+	}
+
+	count, err := strconv.Atoi(args[9])
+	if err != nil || count < 0 || len(args) < clusterHeaderFields+4*count {
+		return nil, errors.New("invalid cluster gossip section")
+	}
+	rest := args[clusterHeaderFields:]
+	for i := 0; i < count; i++ {
+		port, err := strconv.Atoi(rest[4*i+2])
+		if err != nil {
+			return nil, errors.New("invalid cluster gossip port")
+		}
+		msg.gossip = append(msg.gossip, gossipEntry{id: rest[4*i], host: rest[4*i+1], port: port, flags: rest[4*i+3]})
+	}
+	msg.extra = rest[4*count:]
+	return msg, nil
+}
+
+// header builds a message of the given kind describing this node. A replica
+// advertises its master's slots and config epoch, which is what its failover
+// election is about.
+func (cs *clusterState) header(kind string, skip *clusterNode) []string {
+	myself := cs.myself
+	flags, masterID := "master", "-"
+	owner := myself
+	if myself.replica {
+		flags, masterID = "slave", myself.masterID
+		if master, ok := cs.nodes[myself.masterID]; ok {
+			owner = master
+		}
+	}
+	slots := "-"
+	if ranges := cs.slotRanges()[owner]; len(ranges) > 0 && (owner == myself || myself.replica) {
+		var parts []string
+		for _, r := range ranges {
+			parts = append(parts, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+		slots = strings.Join(parts, ",")
+	}
+
+	msg := []string{kind, myself.id, myself.host, strconv.Itoa(myself.port), flags, masterID,
+		strconv.Itoa(cs.currentEpoch), strconv.Itoa(owner.configEpoch), strconv.Itoa(cs.myReplOffset()), slots}
+
+	var gossip []string
+	count := 0
+	for _, node := range cs.sortedNodes() {
+		if node == myself || node == skip || node.handshake {
+			continue
+		}
+		gossip = append(gossip, node.id, node.host, strconv.Itoa(node.port), cs.nodeFlags(node))
+		count++
+	}
+	msg = append(msg, strconv.Itoa(count))
+	return append(msg, gossip...)
+}
+
+func (cs *clusterState) myReplOffset() int {
+	if cs.myself.replica {
+		return int(cs.config.server.bytesReadAsReplica.Load())
+	}
+	_, offset := cs.config.server.repl.ids()
+	return offset
+}
+
+// start opens the cluster bus on port+10000 and runs the gossip cron.
+func (cs *clusterState) start(ctx context.Context, config *config, cm *connectionManager, store *redisStore) error {
+	cs.config, cs.cm, cs.store = config, cm, store
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", cs.myself.port+clusterBusPortDiff))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			go cs.handleBusConnection(conn)
+		}
+	}()
+
+	cs.mu.RLock()
+	masterAddr := ""
+	if master, ok := cs.nodes[cs.myself.masterID]; ok && cs.myself.replica {
+		masterAddr = master.host + " " + strconv.Itoa(master.port)
+	}
+	cs.mu.RUnlock()
+	if masterAddr != "" {
+		setMaster(config, cm, store, masterAddr)
+	}
+
+	go cs.cron(ctx)
+	return nil
+}
+
+// handleBusConnection serves a connection another node opened to us,
+// answering PING/MEET with PONG and vote requests with acks.
+func (cs *clusterState) handleBusConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * cs.nodeTimeout))
+		kind, args, err := parseRESPString(reader)
+		if err != nil {
+			return
+		}
+		reply := cs.process(kind, args, nil)
+		if reply != nil {
+			conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+			if _, err := conn.Write([]byte(respGenerator(reply))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLink reads the replies coming back on our link to node.
+func (cs *clusterState) readLink(node *clusterNode, link *clusterLink) {
+	reader := bufio.NewReader(link.conn)
+	for {
+		kind, args, err := parseRESPString(reader)
+		if err != nil {
+			break
+		}
+		cs.process(kind, args, node)
+	}
+	cs.mu.Lock()
+	if node.link == link {
+		node.link = nil
+	}
+	cs.mu.Unlock()
+	link.conn.Close()
+}
+
+func (cs *clusterState) connect(node *clusterNode) {
+	conn, err := net.DialTimeout("tcp", node.busAddr(), clusterDialTimeout)
+	if err != nil {
+		time.Sleep(clusterRedialDelay)
+		cs.mu.Lock()
+		node.connecting = false
+		cs.mu.Unlock()
+		return
+	}
+
+	cs.mu.Lock()
+	node.connecting = false
+	if cs.nodes[node.id] != node {
+		cs.mu.Unlock()
+		conn.Close()
+		return
+	}
+	link := &clusterLink{conn: conn}
+	node.link = link
+	kind := "ping"
+	if node.handshake {
+		kind = "meet"
+	}
+	if node.pingSent.IsZero() {
+		node.pingSent = time.Now()
+	}
+	link.send(cs.header(kind, node))
+	cs.mu.Unlock()
+
+	go cs.readLink(node, link)
+}
+
+func (cs *clusterState) broadcast(msg []string) {
+	for _, node := range cs.nodes {
+		if node.link != nil && !node.handshake {
+			node.link.send(msg)
+		}
+	}
+}
+
+// process applies a bus message. node is set when the message arrived on our
+// own link to that node. It returns the reply to send back, if any.
+func (cs *clusterState) process(kind string, args []string, node *clusterNode) []string {
+	msg, err := parseClusterMessage(kind, args)
+	if err != nil {
+		fmt.Println("Invalid cluster bus message:", err)
+		return nil
+	}
+
+	cs.mu.Lock()
+	reply, action := cs.processLocked(msg, node)
+	if cs.dirty {
+		cs.dropShardChannels()
+		cs.saveConfig()
+		cs.dirty = false
+	}
+	cs.mu.Unlock()
+
+	if action != nil {
+		action()
+	}
+	return reply
+}
+
+func (cs *clusterState) processLocked(msg *clusterMessage, link *clusterNode) ([]string, func()) {
+	sender, known := cs.nodes[msg.sender]
+	if _, forgotten := cs.forgotten[msg.sender]; forgotten {
+		return nil, nil
+	}
+
+	if link != nil && link.handshake && msg.kind == "pong" {
+		// The node we met told us its real ID.
+		delete(cs.nodes, link.id)
+		if known {
+			if link.link != nil {
+				link.link.conn.Close()
+			}
+		} else {
+			link.id, link.handshake = msg.sender, false
+			cs.nodes[link.id] = link
+			sender, known = link, true
+		}
+		cs.dirty = true
+	}
+	if !known && msg.kind == "meet" {
+		sender = newClusterNode(msg.sender, msg.host, msg.port)
+		cs.nodes[sender.id] = sender
+		known = true
+		cs.dirty = true
+	}
+	if !known || sender == cs.myself {
+		return nil, nil
+	}
+
+	if msg.currentEpoch > cs.currentEpoch {
+		cs.currentEpoch = msg.currentEpoch
+		cs.dirty = true
+	}
+	if msg.kind == "pong" {
+		now := time.Now()
+		sender.pongReceived = now
+		sender.pingSent = time.Time{}
+		sender.pfail = false
+		if sender.fail && (sender.replica || cs.slotCount(sender) == 0 || now.Sub(sender.failTime) > 2*cs.nodeTimeout) {
+			fmt.Println("Clearing FAIL state for node", sender.id)
+			sender.fail = false
+			cs.dirty = true
+		}
+	}
+	if sender.replica != msg.replica || (msg.replica && sender.masterID != msg.masterID) {
+		sender.replica = msg.replica
+		sender.masterID = ""
+		if msg.replica {
+			sender.masterID = msg.masterID
+		}
+		cs.dirty = true
+	}
+	sender.replOffset = msg.replOffset
+
+	action := cs.updateSlots(sender, msg)
+	cs.processGossip(sender, msg)
+
+	var reply []string
+	switch msg.kind {
+	case "meet", "ping":
+		reply = cs.header("pong", sender)
+	case "fail":
+		if len(msg.extra) == 1 {
+			if failing, ok := cs.nodes[msg.extra[0]]; ok && failing != cs.myself && !failing.fail {
+				fmt.Println("Node", failing.id, "reported as failing by", sender.id)
+				failing.fail, failing.pfail, failing.failTime = true, false, time.Now()
+				cs.dirty = true
+			}
+		}
+	case "auth-request":
+		if cs.grantVote(sender, msg) {
+			reply = cs.header("auth-ack", sender)
+		}
+	case "auth-ack":
+		f := &cs.failover
+		if f.authSent && !sender.replica && cs.slotCount(sender) > 0 && msg.currentEpoch >= f.authEpoch {
+			f.votes[sender.id] = true
+			if len(f.votes) >= cs.quorum() {
+				action = cs.promote()
+			}
+		}
+	}
+	return reply, action
+}
+
+// updateSlots applies the slots a master claims: a claim wins over the
+// current owner when the claimant's config epoch is greater. It returns the
+// role change to perform if this node (or its master) lost all its slots.
+func (cs *clusterState) updateSlots(sender *clusterNode, msg *clusterMessage) func() {
+	if msg.replica {
+		return nil
+	}
+	if sender.configEpoch != msg.configEpoch {
+		sender.configEpoch = msg.configEpoch
+		cs.dirty = true
+	}
+
+	myself := cs.myself
+	mine := myself
+	if myself.replica {
+		mine = cs.nodes[myself.masterID]
+	}
+	before := cs.slotCount(mine)
+
+	claimed := make(map[int]bool)
+	for _, r := range msg.slots {
+		for slot := r[0]; slot <= r[1]; slot++ {
+			claimed[slot] = true
+			owner := cs.slots[slot]
+			if owner == sender {
+				continue
+			}
+			if owner == nil || owner.configEpoch < msg.configEpoch {
+				if owner == myself {
+					cs.migrating[slot] = nil
+				}
+				cs.slots[slot] = sender
+				cs.dirty = true
+			}
+		}
+	}
+	for slot, owner := range cs.slots {
+		if owner == sender && !claimed[slot] {
+			cs.slots[slot] = nil
+			cs.dirty = true
+		}
+	}
+
+	// Two masters with the same config epoch: the one with the smaller ID
+	// takes a new epoch so that slot conflicts always have a winner.
+	if !myself.replica && msg.configEpoch == myself.configEpoch && myself.id < sender.id {
+		cs.currentEpoch++
+		myself.configEpoch = cs.currentEpoch
+		cs.dirty = true
+		fmt.Println("Config epoch collision with", sender.id, "- moved to epoch", myself.configEpoch)
+	}
+
+	if mine == nil || before == 0 || cs.slotCount(mine) > 0 {
+		return nil
+	}
+	fmt.Println("Slots taken over by", sender.id, "- replicating it")
+	myself.replica, myself.masterID = true, sender.id
+	cs.failover = replicaFailover{}
+	cs.dirty = true
+	masterAddr := sender.host + " " + strconv.Itoa(sender.port)
+	return func() { setMaster(cs.config, cs.cm, cs.store, masterAddr) }
+}
+
+// processGossip records what the sender thinks of the nodes it knows about:
+// new nodes are added, and a master's view of failing nodes counts as a
+// failure report.
+func (cs *clusterState) processGossip(sender *clusterNode, msg *clusterMessage) {
+	for _, entry := range msg.gossip {
+		node, ok := cs.nodes[entry.id]
+		if !ok {
+			if _, forgotten := cs.forgotten[entry.id]; forgotten {
+				continue
+			}
+			node = newClusterNode(entry.id, entry.host, entry.port)
+			cs.nodes[node.id] = node
+			cs.dirty = true
+			continue
+		}
+		if node == cs.myself || sender.replica {
+			continue
+		}
+		failing := false
+		for _, flag := range strings.Split(entry.flags, ",") {
+			failing = failing || flag == "fail" || flag == "fail?"
+		}
+		if failing {
+			node.failReports[sender.id] = time.Now()
+		} else {
+			delete(node.failReports, sender.id)
+		}
+	}
+}
+
+// quorum is the majority of the masters serving slots.
+func (cs *clusterState) quorum() int {
+	return len(cs.slotRanges())/2 + 1
+}
+
+// grantVote decides whether to vote for the replica asking to replace its
+// master in the epoch it sent.
+func (cs *clusterState) grantVote(sender *clusterNode, msg *clusterMessage) bool {
+	myself := cs.myself
+	if myself.replica || cs.slotCount(myself) == 0 {
+		return false
+	}
+	if msg.currentEpoch < cs.currentEpoch || cs.lastVoteEpoch >= msg.currentEpoch {
+		return false
+	}
+	master, ok := cs.nodes[msg.masterID]
+	if !msg.replica || !ok || !master.fail {
+		return false
+	}
+	if time.Since(cs.votedFor[master.id]) < 2*cs.nodeTimeout {
+		return false
+	}
+	for _, r := range msg.slots {
+		for slot := r[0]; slot <= r[1]; slot++ {
+			if owner := cs.slots[slot]; owner != nil && owner.configEpoch > msg.configEpoch {
+				return false
+			}
+		}
+	}
+	cs.lastVoteEpoch = msg.currentEpoch
+	cs.votedFor[master.id] = time.Now()
+	cs.dirty = true
+	fmt.Println("Voted for", sender.id, "to replace", master.id, "in epoch", msg.currentEpoch)
+	return true
+}
+
+// promote turns this replica into the master of its failed master's slots.
+func (cs *clusterState) promote() func() {
+	myself := cs.myself
+	old := cs.nodes[myself.masterID]
+	for slot, owner := range cs.slots {
+		if owner == old {
+			cs.slots[slot] = myself
+		}
+	}
+	myself.replica, myself.masterID = false, ""
+	myself.configEpoch = cs.failover.authEpoch
+	cs.failover = replicaFailover{}
+	cs.dirty = true
+	fmt.Println("Failover won, now serving the slots of", old.id, "with config epoch", myself.configEpoch)
+	cs.broadcast(cs.header("pong", nil))
+	return func() { unsetMaster(cs.config, cs.cm) }
+}
+
+func (cs *clusterState) cron(ctx context.Context) {
+	ticker := time.NewTicker(clusterCronInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cs.mu.Lock()
+			cs.cronLocked()
+			if cs.dirty {
+				cs.dropShardChannels()
+				cs.saveConfig()
+				cs.dirty = false
+			}
+			cs.mu.Unlock()
+		}
+	}
+}
+
+func (cs *clusterState) cronLocked() {
+	now := time.Now()
+	pingInterval := cs.nodeTimeout / 2
+	if pingInterval > clusterMaxPingInterval {
+		pingInterval = clusterMaxPingInterval
+	}
+
+	for id, forgotAt := range cs.forgotten {
+		if now.Sub(forgotAt) > clusterForgetTTL {
+			delete(cs.forgotten, id)
+		}
+	}
+
+	for id, node := range cs.nodes {
+		if node == cs.myself {
+			continue
+		}
+		if node.handshake && now.Sub(node.ctime) > cs.nodeTimeout {
+			fmt.Println("Handshake with", node.addr(), "timed out")
+			if node.link != nil {
+				node.link.conn.Close()
+			}
+			delete(cs.nodes, id)
+			continue
+		}
+		if node.link == nil {
+			if !node.connecting {
+				node.connecting = true
+				if node.pingSent.IsZero() {
+					node.pingSent = now
+				}
+				go cs.connect(node)
+			}
+		} else if !node.pingSent.IsZero() && now.Sub(node.pingSent) > cs.nodeTimeout/2 {
+			// The link looks stuck; a fresh connection may get through.
+			node.link.conn.Close()
+			node.link = nil
+		} else if node.pingSent.IsZero() && now.Sub(node.pongReceived) > pingInterval {
+			node.pingSent = now
+			node.link.send(cs.header("ping", node))
+		}
+
+		if !node.handshake && !node.pfail && !node.fail && !node.pingSent.IsZero() && now.Sub(node.pingSent) > cs.nodeTimeout {
+			fmt.Println("Node", node.id, "is possibly failing")
+			node.pfail = true
+		}
+		cs.markFailing(node)
+	}
+
+	cs.replicaFailoverCron()
+}
+
+// markFailing promotes PFAIL to FAIL once a majority of the masters agree,
+// and tells every other node.
+func (cs *clusterState) markFailing(node *clusterNode) {
+	for id, reportedAt := range node.failReports {
+		if time.Since(reportedAt) > 2*cs.nodeTimeout {
+			delete(node.failReports, id)
+		}
+	}
+	if !node.pfail || node.fail {
+		return
+	}
+	reports := len(node.failReports)
+	if !cs.myself.replica {
+		reports++
+	}
+	if reports < cs.quorum() {
+		return
+	}
+	fmt.Println("Marking node", node.id, "as failing (quorum reached)")
+	node.pfail, node.fail, node.failTime = false, true, time.Now()
+	cs.dirty = true
+	cs.broadcast(append(cs.header("fail", nil), node.id))
+}
+
+// replicaFailoverCron runs the election of a replica whose master failed.
+// Replicas with more data wait less, so the best one usually wins.
+func (cs *clusterState) replicaFailoverCron() {
+	myself := cs.myself
+	if !myself.replica {
+		return
+	}
+	master, ok := cs.nodes[myself.masterID]
+	if !ok || !master.fail || cs.slotCount(master) == 0 {
+		cs.failover = replicaFailover{}
+		return
+	}
+
+	f := &cs.failover
+	now := time.Now()
+	if f.authTime.IsZero() || now.Sub(f.authTime) > 2*cs.nodeTimeout {
+		rank := 0
+		myOffset := cs.myReplOffset()
+		for _, replica := range cs.replicasOf(master.id) {
+			if replica != myself && replica.replOffset > myOffset {
+				rank++
+			}
+		}
+		delay := 500*time.Millisecond + time.Duration(rand.Intn(500))*time.Millisecond + time.Duration(rank)*time.Second
+		*f = replicaFailover{authTime: now.Add(delay), votes: make(map[string]bool)}
+		fmt.Println("Starting failover election for", master.id, "in", delay)
+		return
+	}
+	if now.Before(f.authTime) || f.authSent {
+		return
+	}
+
+	cs.currentEpoch++
+	f.authEpoch = cs.currentEpoch
+	f.authSent = true
+	cs.dirty = true
+	fmt.Println("Requesting failover votes for epoch", f.authEpoch)
+	cs.broadcast(cs.header("auth-request", nil))
+}
+
+// meet starts a handshake with the node at host:port.
+func (cs *clusterState) meet(host string, port int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, node := range cs.nodes {
+		if node.host == host && node.port == port {
+			return
+		}
+	}
+	node := newClusterNode(newReplID(), host, port)
+	node.handshake = true
+	cs.nodes[node.id] = node
+}
+
+// replicate implements CLUSTER REPLICATE.
+func (cs *clusterState) replicate(id string) error {
+	cs.mu.Lock()
+	master, ok := cs.nodes[id]
+	switch {
+	case !ok:
+		cs.mu.Unlock()
+		return fmt.Errorf("ERR Unknown node %s", id)
+	case master == cs.myself:
+		cs.mu.Unlock()
+		return errors.New("ERR Can't replicate myself")
+	case master.replica:
+		cs.mu.Unlock()
+		return errors.New("ERR I can only replicate a master, not a replica.")
+	case !cs.myself.replica && cs.slotCount(cs.myself) > 0:
+		cs.mu.Unlock()
+		return errors.New("ERR To set a master the node must be empty and without assigned slots.")
+	}
+	cs.myself.replica, cs.myself.masterID = true, master.id
+	cs.dropShardChannels()
+	cs.saveConfig()
+	masterAddr := master.host + " " + strconv.Itoa(master.port)
+	cs.mu.Unlock()
+
+	setMaster(cs.config, cs.cm, cs.store, masterAddr)
+	return nil
+}
+
+// forget implements CLUSTER FORGET. The node is ignored for a minute so that
+// gossip from nodes that still know it does not add it back right away.
+func (cs *clusterState) forget(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	node, ok := cs.nodes[id]
+	switch {
+	case !ok:
+		return fmt.Errorf("ERR Unknown node %s", id)
+	case node == cs.myself:
+		return errors.New("ERR I tried hard but I can't forget myself...")
+	case cs.myself.replica && cs.myself.masterID == id:
+		return errors.New("ERR Can't forget my master!")
+	}
+	if node.link != nil {
+		node.link.conn.Close()
+	}
+	for slot, owner := range cs.slots {
+		if owner == node {
+			cs.slots[slot] = nil
+		}
+	}
+	delete(cs.nodes, id)
+	cs.forgotten[id] = time.Now()
+	cs.dropShardChannels()
+	cs.saveConfig()
+	return nil
+}
+
+// saveConfig writes nodes.conf: the CLUSTER NODES view of the cluster plus
+// the epochs. The caller holds cs.mu.
+func (cs *clusterState) saveConfig() error {
+	ranges := cs.slotRanges()
+	output := ""
+	for _, node := range cs.sortedNodes() {
+		if !node.handshake {
+			output += cs.nodeLine(node, ranges[node]) + "\n"
+		}
+	}
+	output += fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d\n", cs.currentEpoch, cs.lastVoteEpoch)
+
+	tmp := cs.configFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(output), 0644); err != nil {
+		fmt.Println("Error saving cluster config:", err)
+		return err
+	}
+	return os.Rename(tmp, cs.configFile)
+}
+
+// loadConfig restores the node ID, known nodes, slots and epochs saved in
+// nodes.conf. A missing file means a brand new node.
+func (cs *clusterState) loadConfig() error {
+	data, err := os.ReadFile(cs.configFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return cs.saveConfig()
+	}
+	if err != nil {
+		return err
+	}
+
+	nodes := make(map[string]*clusterNode)
+	var migrations []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				n, err := strconv.Atoi(fields[i+1])
+				if err != nil {
+					return fmt.Errorf("invalid %s in %s", fields[i], cs.configFile)
+				}
+				switch fields[i] {
+				case "currentEpoch":
+					cs.currentEpoch = n
+				case "lastVoteEpoch":
+					cs.lastVoteEpoch = n
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("invalid line in %s: %q", cs.configFile, line)
+		}
+
+		hostPort, _, _ := strings.Cut(fields[1], "@")
+		host, portStr, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return fmt.Errorf("invalid address in %s: %q", cs.configFile, fields[1])
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return fmt.Errorf("invalid address in %s: %q", cs.configFile, fields[1])
+		}
+		configEpoch, err := strconv.Atoi(fields[6])
+		if err != nil {
+			return fmt.Errorf("invalid config epoch in %s: %q", cs.configFile, line)
+		}
+
+		node := newClusterNode(fields[0], host, port)
+		flags := "," + fields[2] + ","
+		if strings.Contains(flags, ",myself,") {
+			node = cs.myself
+			node.id = fields[0]
+		}
+		node.replica = strings.Contains(flags, ",slave,")
+		if node.replica {
+			node.masterID = fields[3]
+		}
+		node.configEpoch = configEpoch
+		nodes[node.id] = node
+
+		for _, r := range fields[8:] {
+			if strings.HasPrefix(r, "[") {
+				migrations = append(migrations, r)
+				continue
+			}
+			start, end, isRange := strings.Cut(r, "-")
+			if !isRange {
+				end = start
+			}
+			first, err := parseSlot(start)
+			if err != nil {
+				return err
+			}
+			last, err := parseSlot(end)
+			if err != nil {
+				return err
+			}
+			for slot := first; slot <= last; slot++ {
+				cs.slots[slot] = node
+			}
+		}
+	}
+	if nodes[cs.myself.id] != cs.myself {
+		return fmt.Errorf("%s has no myself line", cs.configFile)
+	}
+
+	// Open migrations are saved as [slot->-target] and [slot-<-source].
+	for _, label := range migrations {
+		label = strings.Trim(label, "[]")
+		slotStr, peer, importing := strings.Cut(label, "-<-")
+		if !importing {
+			slotStr, peer, _ = strings.Cut(label, "->-")
+		}
+		slot, err := parseSlot(slotStr)
+		if err != nil {
+			return err
+		}
+		if node, ok := nodes[peer]; ok && importing {
+			cs.importing[slot] = node
+		} else if ok {
+			cs.migrating[slot] = node
+		}
+	}
+	cs.nodes = nodes
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// startTestClusterNode starts a cluster-enabled server with a short node
+// timeout.
+func startTestClusterNode(tb testing.TB) *testServer {
+	tb.Helper()
+	return startTestServer(tb, "", func(c *config) {
+		c.server.clusterEnabled = true
+		c.server.clusterNodeTimeout = 500
+	})
+}
+
+// startTestCluster starts three masters splitting the slots evenly and
+// introduces them to each other.
+func startTestCluster(tb testing.TB) []*testServer {
+	tb.Helper()
+	ranges := [][2]string{{"0", "5460"}, {"5461", "10922"}, {"10923", "16383"}}
+	nodes := make([]*testServer, len(ranges))
+	for i, r := range ranges {
+		nodes[i] = startTestClusterNode(tb)
+		client := dialTestClient(tb, nodes[i].addr)
+		client.do("CLUSTER", "ADDSLOTSRANGE", r[0], r[1])
+		if i > 0 {
+			host, port, _ := net.SplitHostPort(nodes[i].addr)
+			dialTestClient(tb, nodes[0].addr).do("CLUSTER", "MEET", host, port)
+		}
+	}
+	for _, node := range nodes {
+		client := dialTestClient(tb, node.addr)
+		waitFor(tb, "the cluster to converge", func() bool {
+			info, _ := client.do("CLUSTER", "INFO").(string)
+			return strings.Contains(info, "cluster_state:ok") && strings.Contains(info, "cluster_known_nodes:3")
+		})
+	}
+	return nodes
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	for key, want := range map[string]int{"foo": 12182, "bar": 5061, "hello": 866} {
+		if got := keyHashSlot(key); got != want {
+			t.Errorf("keyHashSlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+
+	// Only the first non-empty {tag} is hashed.
+	for key, tag := range map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+		"foo{}{bar}":           "foo{}{bar}",
+	} {
+		if got, want := keyHashSlot(key), keyHashSlot(tag); got != want {
+			t.Errorf("keyHashSlot(%q) = %d, want the slot of %q, %d", key, got, tag, want)
+		}
+	}
+}
+
+func TestClusterRedirects(t *testing.T) {
+	node := startTestClusterNode(t)
+	client := dialTestClient(t, node.addr)
+
+	if reply := client.do("GET", "foo"); reply != replyError("CLUSTERDOWN Hash slot not served") {
+		t.Fatalf("GET on an unassigned slot replied %v", reply)
+	}
+	if reply := client.do("CLUSTER", "ADDSLOTSRANGE", "0", "16383"); reply != "OK" {
+		t.Fatalf("CLUSTER ADDSLOTSRANGE replied %v", reply)
+	}
+	if reply := client.do("SET", "foo", "bar"); reply != "OK" {
+		t.Fatalf("SET on an owned slot replied %v", reply)
+	}
+	if reply := client.do("CLUSTER", "COUNTKEYSINSLOT", "12182"); reply != 1 {
+		t.Fatalf("CLUSTER COUNTKEYSINSLOT replied %v, want 1", reply)
+	}
+	if reply := client.do("CLUSTER", "GETKEYSINSLOT", "12182", "10"); !reflect.DeepEqual(reply, []any{"foo"}) {
+		t.Fatalf("CLUSTER GETKEYSINSLOT replied %v, want [foo]", reply)
+	}
+
+	// Hand slot 5061, which "bar" hashes to, to another node.
+	cs := node.config.cluster
+	other := &clusterNode{id: newReplID(), host: "127.0.0.1", port: 7000}
+	cs.mu.Lock()
+	cs.nodes[other.id] = other
+	cs.slots[keyHashSlot("bar")] = other
+	cs.mu.Unlock()
+
+	if reply := client.do("GET", "bar"); reply != replyError("MOVED 5061 127.0.0.1:7000") {
+		t.Fatalf("GET on another node's slot replied %v", reply)
+	}
+	if reply := client.do("GET", "foo"); reply != "bar" {
+		t.Fatalf("GET on an owned slot replied %v", reply)
+	}
+}
+
+func TestClusterGossipSpreadsNodesAndSlots(t *testing.T) {
+	nodes := startTestCluster(t)
+
+	// The third node only met the first, but learnt the second's slots
+	// through gossip.
+	client := dialTestClient(t, nodes[2].addr)
+	if reply := client.do("GET", "hello"); reply != replyError("MOVED 866 "+nodes[0].addr) {
+		t.Fatalf("GET on the first node's slot replied %v", reply)
+	}
+	if reply := client.do("GET", "foo"); reply != replyError("MOVED 12182 "+nodes[2].addr) && reply != nil {
+		t.Fatalf("GET on an owned slot replied %v", reply)
+	}
+	if reply := client.do("GET", "{user}1"); reply != replyError("MOVED 5474 "+nodes[1].addr) {
+		t.Fatalf("GET on the second node's slot replied %v", reply)
+	}
+}
+
+func TestClusterReplicaTakesOverAFailedMaster(t *testing.T) {
+	nodes := startTestCluster(t)
+	replica := startTestClusterNode(t)
+	client := dialTestClient(t, replica.addr)
+	host, port, _ := net.SplitHostPort(nodes[0].addr)
+	client.do("CLUSTER", "MEET", host, port)
+	for _, node := range append(nodes, replica) {
+		nodeClient := dialTestClient(t, node.addr)
+		waitFor(t, "every node to know the replica", func() bool {
+			info, _ := nodeClient.do("CLUSTER", "INFO").(string)
+			return strings.Contains(info, "cluster_known_nodes:4")
+		})
+	}
+	masterID := nodes[0].config.cluster.myself.id
+	if reply := client.do("CLUSTER", "REPLICATE", masterID); reply != "OK" {
+		t.Fatalf("CLUSTER REPLICATE replied %v", reply)
+	}
+	waitFor(t, "the replica to sync", replica.config.server.link.isUp)
+
+	// Holding the state lock stops the master from answering on the bus,
+	// as a hung process would.
+	frozen := nodes[0].config.cluster
+	frozen.mu.Lock()
+	t.Cleanup(frozen.mu.Unlock)
+
+	other := dialTestClient(t, nodes[1].addr)
+	waitFor(t, "the replica to take over the slots", func() bool {
+		return other.do("GET", "hello") == replyError("MOVED 866 "+replica.addr)
+	})
+	if role := role(t, client); role != "master" {
+		t.Fatalf("replica has role %s after taking over", role)
+	}
+}
+
+func TestClusterRepliesOverResp3(t *testing.T) {
+	node := startTestClusterNode(t)
+	client := dialTestClient(t, node.addr)
+	client.do("CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+	client.do("HELLO", "3")
+
+	if info, ok := client.do("CLUSTER", "INFO").(verbatimString); !ok || !strings.Contains(string(info), "cluster_state:ok") {
+		t.Fatalf("CLUSTER INFO over RESP3 replied %v, want a verbatim string", info)
+	}
+	if nodes, ok := client.do("CLUSTER", "NODES").(verbatimString); !ok || !strings.Contains(string(nodes), "myself,master") {
+		t.Fatalf("CLUSTER NODES over RESP3 replied %v, want a verbatim string", nodes)
+	}
+
+	shards, ok := client.do("CLUSTER", "SHARDS").([]any)
+	if !ok || len(shards) != 1 {
+		t.Fatalf("CLUSTER SHARDS replied %v, want one shard", shards)
+	}
+	shard, ok := shards[0].(map[string]any)
+	if !ok || !reflect.DeepEqual(shard["slots"], []any{0, 16383}) {
+		t.Fatalf("CLUSTER SHARDS described the shard as %v, want a map", shards[0])
+	}
+	shardNodes, _ := shard["nodes"].([]any)
+	if len(shardNodes) != 1 {
+		t.Fatalf("CLUSTER SHARDS listed nodes %v", shard["nodes"])
+	}
+	if n, ok := shardNodes[0].(map[string]any); !ok || n["id"] != node.config.cluster.myself.id || n["role"] != "master" || n["health"] != "online" {
+		t.Fatalf("CLUSTER SHARDS described the node as %v, want a map", shardNodes[0])
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -95,7 +94,9 @@ const (
 // 	keyValueMode
 // )
 
-func (r *redisStore) set(args []string) bool {
+// set implements SET key value [PX milliseconds]. created reports that the
+// key did not exist before.
+func (r *redisStore) set(args []string) (created, ok bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	var expiry int64
@@ -106,7 +107,7 @@ func (r *redisStore) set(args []string) bool {
 		if strings.ToLower(args[2]) == "px" {
 			expiryInt, err := strconv.Atoi(args[3])
 			if err != nil {
-				return false
+				return false, false
 			} else {
 				expiry = time.Now().Add(time.Millisecond * time.Duration(expiryInt)).UnixNano()
 			}
@@ -115,11 +116,14 @@ func (r *redisStore) set(args []string) bool {
 		expiry = 0
 	}
 
+	current, exists := r.store[args[0]]
+	created = !exists || current.expiry != 0 && expired(current.expiry)
+	r.touch(args[0])
 	r.store[args[0]] = value{
 		content: args[1],
 		expiry:  expiry,
 	}
-	return true
+	return created, true
 }
 
 func (r *redisStore) get(key string) (string, error) {
@@ -139,33 +143,132 @@ func (r *redisStore) get(key string) (string, error) {
 	return "", errors.New("err - no value for this key")
 }
 
-func (r *redisStore) keys(args []string, config *config) (string, error) {
+func (r *redisStore) exists(key string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	val, ok := r.store[key]
+	return ok && (val.expiry == 0 || !expired(val.expiry))
+}
+
+// del removes keys and returns those of them that existed.
+func (r *redisStore) del(keys []string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted []string
+	for _, key := range keys {
+		if val, ok := r.store[key]; ok {
+			if val.expiry == 0 || !expired(val.expiry) {
+				deleted = append(deleted, key)
+			}
+			r.touch(key)
+			delete(r.store, key)
+		}
+	}
+	return deleted
+}
+
+func (r *redisStore) keys(args []string, config *config, w *replyWriter) error {
 	if args[0] == "*" {
 		path := config.rdb.dir + "/" + config.rdb.dbFileName
 		file, err := os.Open(path)
 		if err != nil {
 			fmt.Println("error opening file", err)
-			return "", err
+			return err
 		}
 
 		defer file.Close()
 		rdbStore, err := buildRdbStore(file)
 		if err != nil {
-			return "", err
+			return err
 		}
-		return allKeysFromRdbStore(rdbStore)
+		allKeysFromRdbStore(rdbStore, w)
+		return nil
+	}
+	w.arrayHeader(0)
+	return nil
+}
 
+// globMatch reports whether s matches a Redis glob pattern: * and ? match any
+// run of characters and any one character, [...] a set such as [a-z] or
+// [^0-9], and a backslash escapes the next character.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					matched = matched || pattern[1] == s[0]
+					pattern = pattern[2:]
+				case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || s[0] >= lo && s[0] <= hi
+					pattern = pattern[3:]
+				default:
+					matched = matched || pattern[0] == s[0]
+					pattern = pattern[1:]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			s = s[1:]
+			if len(pattern) == 0 {
+				// An unterminated set ends the pattern.
+				return len(s) == 0
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
 	}
-	return "", nil
+	return len(s) == 0
 }
 
-func allKeysFromRdbStore(store rdbStore) (string, error) {
-	output := ""
-	output += fmt.Sprintf("*%d\r\n", len(store.store))
+func allKeysFromRdbStore(store rdbStore, w *replyWriter) {
+	keys := make([]string, 0, len(store.store))
 	for key := range store.store {
-		output += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+		keys = append(keys, key)
 	}
-	return output, nil
+	w.bulkArray(keys)
 }
 
 func buildRdbStore(file io.Reader, opts ...Option) (rdbStore, error) {
@@ -174,54 +277,78 @@ func buildRdbStore(file io.Reader, opts ...Option) (rdbStore, error) {
 		opt(&options)
 	}
 
-	reader := bufio.NewReader(file)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return rdbStore{}, err
+	}
 	rdbParser := &rdbFileParser{currentState: startState, rdbFileInfo: rdbFileInfo{}}
 	rdbStore := &rdbStore{store: map[string]value{}}
+	// Skip the aux fields and function records, whose bytes the parser below
+	// could mistake for opcodes, and start at the keyspace.
+	if _, end, err := rdbReadHeader(data); err == nil {
+		data = data[end:]
+		rdbParser.currentState = metaDataState
+	}
 
-	buffer := make([]byte, 8*1024)
-
-	for {
-		rdbValCount, err := reader.Read(buffer)
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("EOF: reading RDB file")
-				break
-			}
-			fmt.Println("Error while reading byte", err)
-		} else {
-			rdbParser.rdbFileInfo.currentByteCount += 1
-		}
-
-		for i := 0; i < rdbValCount; i++ {
-			currentState := rdbParser.currentState
-
-			rdbParser = getNextState(rdbParser, buffer, &i, rdbStore)
-			if options.singleKey != "" {
-				if _, ok := rdbStore.store[options.singleKey]; ok {
-					return *rdbStore, nil
-				}
-			}
-
-			if currentState != rdbParser.currentState {
-				// fmt.Printf("State changes from current %s -> next %s\n", stateChangeMap[currentState], stateChangeMap[rdbParser.currentState])
+	for i := 0; i < len(data); i++ {
+		rdbParser = getNextState(rdbParser, data, &i, rdbStore)
+		if options.singleKey != "" {
+			if _, ok := rdbStore.store[options.singleKey]; ok {
+				return *rdbStore, nil
 			}
 		}
 	}
 	return *rdbStore, nil
 }
 
-func (c *config) getRDBConfig(args []string) (string, error) {
+// configCommand implements CONFIG GET for the RDB settings,
+// notify-keyspace-events and requirepass, and CONFIG SET for the latter two.
+func (c *config) configCommand(args []string, w *replyWriter) error {
 	var output string
-	if args[0] == "get" {
+	switch strings.ToLower(args[0]) {
+	case "get":
+		args[1] = strings.ToLower(args[1])
 		if args[1] == "dir" {
 			output = c.rdb.dir
 		} else if args[1] == "rdbfilename" {
 			output = c.rdb.dbFileName
+		} else if args[1] == "notify-keyspace-events" {
+			output = keyspaceEventsString(int(c.server.notifyKeyspaceEvents.Load()))
+		} else if args[1] == "requirepass" {
+			c.acl.mu.RLock()
+			output = c.acl.requirepass
+			c.acl.mu.RUnlock()
+		} else {
+			// Unknown parameters match nothing.
+			w.mapHeader(0)
+			return nil
 		}
-		respArgs := []string{args[1], output}
-		return respGenerator(respArgs), nil
+		w.mapHeader(1)
+		w.bulk(args[1])
+		w.bulk(output)
+		return nil
+	case "set":
+		if len(args) != 3 {
+			return errors.New("ERR wrong number of arguments for 'config|set' command")
+		}
+		switch strings.ToLower(args[1]) {
+		case "notify-keyspace-events":
+		case "requirepass":
+			c.acl.setRequirepass(args[2])
+			w.simpleString("OK")
+			return nil
+		default:
+			return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", args[1])
+		}
+		classes, err := parseKeyspaceEvents(args[2])
+		if err != nil {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %v", args[1], err)
+		}
+		c.server.notifyKeyspaceEvents.Store(int32(classes))
+		w.simpleString("OK")
+		return nil
 	}
-	return "", errors.New("err - unknown argument")
+	return fmt.Errorf("ERR unknown subcommand '%s'", args[0])
 }
 
 func (rdbC *rdbConfig) get(key string) (string, error) {
@@ -251,18 +378,27 @@ func (rdbC *rdbConfig) get(key string) (string, error) {
 	return "", errors.New("err - no value for this key")
 }
 
-func getReplicationInfo(args []string, config *config) (string, error) {
+func getReplicationInfo(args []string, config *config, cm *connectionManager) (string, error) {
 	output := ""
 	role := ""
-	if args[0] == "replication" && config.server.actAsReplica {
+	if len(args) > 0 && strings.ToLower(args[0]) == "replication" && config.isReplica() {
 		role = "slave"
 	} else {
 		role = "master"
 	}
-	masterReplId := "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
-	output += fmt.Sprintf("role:%s\nmaster_replid:%s\nmaster_repl_offset:%d", role, masterReplId, 0)
+	_, offset := config.server.repl.ids()
+	if config.isReplica() {
+		offset = int(config.server.bytesReadAsReplica.Load())
+	}
+	output += fmt.Sprintf("role:%s\n%s\nmaster_repl_offset:%d\nmaster_failover_state:%s", role, config.server.repl.info(), offset, config.server.failover.current())
+	if !config.isReplica() {
+		output += "\n" + cm.replicaInfo()
+	} else {
+		masterHost, masterPort, _ := strings.Cut(config.masterAddress(), " ")
+		output += fmt.Sprintf("\nmaster_host:%s\nmaster_port:%s\n%s", masterHost, masterPort, config.server.link.info())
+	}
 
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(output), output), nil
+	return output, nil
 }
 
 func getNextState(rdbParser *rdbFileParser, buffer []byte, i *int, rdbStore *rdbStore) *rdbFileParser {
@@ -368,22 +504,29 @@ func keyExpiryTimeStamp(buffer []byte, i *int) int64 {
 	return timeStamp
 }
 
-func sendPsyncCommand(conn net.Conn) {
-	fullResyncResponse := "+FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0\r\n"
+func sendPsyncCommand(conn net.Conn, replid string, offset int) {
+	fullResyncResponse := fmt.Sprintf("+FULLRESYNC %s %d\r\n", replid, offset)
 	_, err := conn.Write([]byte(fullResyncResponse))
 	if err != nil {
 		fmt.Printf("error sending FULLRESYNC response: %v", err)
 	}
 }
 
-func sendEmptyRDBFile(conn net.Conn) {
-	emptyRDBHex := "524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2"
+// emptyRDBHex is an RDB file with no keys and no function libraries.
+const emptyRDBHex = "524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2"
 
+// sendRDBFile sends a full resynchronisation's RDB payload, which holds the
+// loaded function libraries but no keys.
+func sendRDBFile(conn net.Conn, libraries []string) {
 	rdbFile, err := hex.DecodeString(emptyRDBHex)
 	if err != nil {
 		fmt.Printf("error decoding RDB file: %v", err)
 	}
 
+	if len(libraries) > 0 {
+		rdbFile = rdbAddFunctions(rdbFile, libraries)
+	}
+
 	rdbLength := len(rdbFile)
 	rdbHeader := fmt.Sprintf("$%d\r\n", rdbLength)
 
@@ -398,49 +541,406 @@ func sendEmptyRDBFile(conn net.Conn) {
 	}
 }
 
-func handleCommand(conn net.Conn, command string, args []string, store *redisStore, config *config, cm *connectionManager) (string, error) {
-	byteCountBeforeProcessingCurrentCommand := config.server.bytesReadAsReplica
-	if config.server.actAsReplica {
-		respGeneratorArg := append([]string{}, append(args, command)...)
-		respString := respGenerator(respGeneratorArg)
-		config.server.bytesReadAsReplica += len([]byte(respString))
+// writeCommands are refused on read-only replicas unless they arrive over the
+// master link.
+var writeCommands = map[string]bool{
+	"set":            true,
+	"del":            true,
+	"restore":        true,
+	"restore-asking": true,
+	"migrate":        true,
+}
+
+// isWriteCommand reports whether a command changes the dataset. FUNCTION
+// only does so through some of its subcommands.
+func isWriteCommand(command string, args []string) bool {
+	if command == "function" && len(args) > 0 {
+		return functionWriteSubcommands[strings.ToLower(args[0])]
+	}
+	return writeCommands[command]
+}
+
+// staleCommands keep working on a replica whose master link is down even when
+// replica-serve-stale-data is disabled.
+var staleCommands = map[string]bool{
+	"info":         true,
+	"ping":         true,
+	"replconf":     true,
+	"replicaof":    true,
+	"slaveof":      true,
+	"config":       true,
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"ssubscribe":   true,
+	"sunsubscribe": true,
+	"publish":      true,
+	"spublish":     true,
+	"pubsub":       true,
+	"quit":         true,
+	"hello":        true,
+	"auth":         true,
+	"acl":          true,
+	"client":       true,
+	"multi":        true,
+	"exec":         true,
+	"discard":      true,
+	"watch":        true,
+	"unwatch":      true,
+	"eval":         true,
+	"evalsha":      true,
+	"script":       true,
+	"fcall":        true,
+	"fcall_ro":     true,
+}
+
+// enoughGoodReplicas applies min-replicas-to-write, bounding how much a
+// partitioned master can accept that its replicas never see.
+func enoughGoodReplicas(config *config, cm *connectionManager) bool {
+	if config.server.minReplicasToWrite <= 0 {
+		return true
+	}
+	maxLag := time.Duration(config.server.minReplicasMaxLag) * time.Second
+	return cm.goodReplicaCount(maxLag) >= config.server.minReplicasToWrite
+}
+
+func handleCommand(cl *client, command string, args []string, store *redisStore, config *config, cm *connectionManager) error {
+	if !noAuthCommands[command] && authRequired(cl, config) {
+		return errors.New("NOAUTH Authentication required.")
+	}
+	killing := (command == "script" || command == "function") && len(args) > 0 && strings.EqualFold(args[0], "kill")
+	if !cl.isMaster && !killing && scriptBusy(config) {
+		return errBusyScript
+	}
+	if cl.protocol == 2 && cl.subscriptionCount() > 0 && !subscribedModeCommands[command] {
+		return fmt.Errorf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context", command)
+	}
+	if cl.inMulti && !transactionCommands[command] {
+		return queueCommand(cl, command, args, store, config, cm)
+	}
+	if err := checkCommand(cl, command, args, store, config, cm); err != nil {
+		return err
+	}
+	// SCRIPT KILL and FUNCTION KILL must get through while a script holds
+	// the exec lock, and EXEC takes the lock itself.
+	if !noMultiCommands[command] && command != "script" && command != "function" && command != "exec" {
+		unlock, err := lockExec(cl, exclusiveCommands[command], store, config)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	err := runCommand(cl, command, args, store, config, cm)
+	// CLIENT CACHING only applies to the command after it.
+	if command != "client" || len(args) == 0 || !strings.EqualFold(args[0], "caching") {
+		cl.caching = ""
+	}
+	return err
+}
+
+var errBusyScript = errors.New("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+
+// scriptBusy reports whether a script has run past busy-reply-threshold, from
+// which point other clients are told so instead of being left waiting.
+func scriptBusy(config *config) bool {
+	return config.scripts.busy(time.Duration(config.server.busyReplyThreshold) * time.Millisecond)
+}
+
+// lockExec takes the store's exec lock, for writing when exclusive is set,
+// and returns the function that releases it. Clients waiting behind a script
+// give up with BUSY once it runs past busy-reply-threshold; the master link
+// waits until its link is stopped.
+func lockExec(cl *client, exclusive bool, store *redisStore, config *config) (func(), error) {
+	cancel := cl.cancel
+	if !cl.isMaster {
+		cancel = config.scripts.busySignal()
+	}
+	if !store.exec.lock(exclusive, cancel) {
+		if cl.isMaster {
+			return nil, errCommandCancelled
+		}
+		return nil, errBusyScript
+	}
+	return func() { store.exec.unlock(exclusive) }, nil
+}
+
+// checkCommand decides whether a command may run at all given the server's
+// role, the cluster layout and the state of its replicas.
+func checkCommand(cl *client, command string, args []string, store *redisStore, config *config, cm *connectionManager) error {
+	if err := checkACL(cl, command, args, config); err != nil {
+		return err
+	}
+
+	// Writes wait out a failover handover and are then judged by the role
+	// the server ended up with.
+	if !cl.isMaster && isWriteCommand(command, args) {
+		config.server.failover.waitForWrites()
+	}
+
+	if !cl.isMaster && config.isReplica() {
+		if !config.server.replicaServeStaleData && !config.server.link.isUp() && !staleCommands[command] {
+			return errors.New("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+		}
+		if config.server.replicaReadOnly && isWriteCommand(command, args) {
+			return errors.New("READONLY You can't write against a read only replica.")
+		}
+	}
+
+	if !cl.isMaster && config.cluster != nil {
+		asking := cl.asking || command == "restore-asking"
+		cl.asking = false
+		if err := config.cluster.redirect(command, args, asking, store); err != nil {
+			return err
+		}
+	}
+
+	if !config.isReplica() && isWriteCommand(command, args) && !enoughGoodReplicas(config, cm) {
+		return errors.New("NOREPLICAS Not enough good replicas to write.")
+	}
+	return nil
+}
+
+func runCommand(cl *client, command string, args []string, store *redisStore, config *config, cm *connectionManager) error {
+	w := cl.out
+	conn := cl.conn
+	// Keys whose TTL passed are deleted as soon as a command looks them up.
+	if !shardChannelCommands[command] {
+		for _, key := range commandKeys(command, args) {
+			expireIfNeeded(key, store, config, cm)
+		}
+	}
+	// Keys are recorded for tracking clients before they are read, and
+	// invalidated once they were written.
+	if cl.tracking != nil && trackingReadCommands[command] {
+		store.tracking.remember(cl, commandKeys(command, args))
+	}
+	if isWriteCommand(command, args) {
+		defer store.tracking.invalidate(commandKeys(command, args), cl)
 	}
 	switch command {
 	case "replconf":
-		if args[0] == "getack" && args[1] == "*" {
-			return respGenerator([]string{"REPLCONF", "ACK", strconv.Itoa(byteCountBeforeProcessingCurrentCommand)}), nil
+		if len(args) == 0 {
+			return errors.New("ERR wrong number of arguments for 'replconf' command")
+		}
+		subcommand := strings.ToLower(args[0])
+		if subcommand == "getack" && len(args) > 1 && args[1] == "*" {
+			// The master link only counts a command once it has been
+			// processed, so GETACK itself is not part of the reported offset.
+			offset := config.server.bytesReadAsReplica.Load()
+			w.bulkArray([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)})
+		} else if subcommand == "listening-port" && len(args) > 1 {
+			port, err := strconv.Atoi(args[1])
+			if err != nil {
+				return errors.New("ERR invalid listening port")
+			}
+			cl.listeningPort = port
+			w.simpleString("OK")
+		} else if subcommand == "ack" && len(args) > 1 {
+			// ACKs are never answered, the master only records them.
+			offset, err := strconv.Atoi(args[1])
+			if err != nil {
+				return errors.New("ERR invalid ACK offset")
+			}
+			cm.recordReplicaAck(conn.RemoteAddr().String(), offset)
 		} else {
-			return "+OK\r\n", nil
+			w.simpleString("OK")
 		}
 	case "psync":
-		sendPsyncCommand(conn)
-		sendEmptyRDBFile(conn)
-		cm.addConnection(conn.RemoteAddr().String(), conn, "replica")
-		return "", nil
+		if len(args) < 2 {
+			return errors.New("ERR wrong number of arguments for 'psync' command")
+		}
+		psyncOffset, err := strconv.Atoi(args[1])
+		if err != nil {
+			psyncOffset = -1
+		}
+		if len(args) > 2 && strings.ToLower(args[2]) == "failover" {
+			if err := acceptFailoverPsync(args[0], config, cm); err != nil {
+				return err
+			}
+		}
+		// The replication stream goes straight to the connection, so
+		// anything buffered before it must go first.
+		if err := w.flush(); err != nil {
+			return err
+		}
+		cm.attachReplica(conn, cl.listeningPort, args[0], psyncOffset, config.scripts.libraryCodes())
+	case "subscribe", "psubscribe", "ssubscribe":
+		if len(args) == 0 {
+			return fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+		}
+		cm.subscribe(cl, args, subscriptionCommands[command])
+	case "unsubscribe", "punsubscribe", "sunsubscribe":
+		cm.unsubscribe(cl, args, subscriptionCommands[command])
+	case "publish":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'publish' command")
+		}
+		// Replicas pass messages on to their own subscribers.
+		if !config.isReplica() {
+			cm.propagateCommandsToReplica(respGenerator(append([]string{command}, args...)))
+		}
+		w.integer(int64(cm.publish(args[0], args[1])))
+	case "spublish":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'spublish' command")
+		}
+		if !config.isReplica() {
+			cm.propagateCommandsToReplica(respGenerator(append([]string{command}, args...)))
+		}
+		w.integer(int64(cm.spublish(args[0], args[1])))
+	case "pubsub":
+		if len(args) == 0 {
+			return errors.New("ERR wrong number of arguments for 'pubsub' command")
+		}
+		return cm.pubsubCommand(args, w)
+	case "quit":
+		cl.closing = true
+		w.simpleString("OK")
+	case "failover":
+		return failover(args, config, cm, store, w)
+	case "cluster":
+		return clusterCommand(args, config, store, w)
+	case "asking":
+		if config.cluster == nil {
+			return errors.New("ERR This instance has cluster support disabled")
+		}
+		cl.asking = true
+		w.simpleString("OK")
+	case "migrate":
+		return migrate(args, store, config, cm, w)
+	case "dump":
+		return dump(args, store, w)
+	case "save":
+		if err := save(store, config); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+	case "restore", "restore-asking":
+		created, err := restore(args, store)
+		if err != nil {
+			return err
+		}
+		if !config.isReplica() {
+			cm.propagateCommandsToReplica(respGenerator(append([]string{command}, args...)))
+		}
+		if created {
+			notifyKeyspaceEvent(config, cm, notifyNew, "new", args[0])
+		}
+		notifyKeyspaceEvent(config, cm, notifyGeneric, "restore", args[0])
+		w.simpleString("OK")
+	case "del":
+		if len(args) == 0 {
+			return errors.New("ERR wrong number of arguments for 'del' command")
+		}
+		deleted := store.del(args)
+		if len(deleted) > 0 && !config.isReplica() {
+			cm.propagateCommandsToReplica(respGenerator(append([]string{command}, args...)))
+		}
+		for _, key := range deleted {
+			notifyKeyspaceEvent(config, cm, notifyGeneric, "del", key)
+		}
+		w.integer(int64(len(deleted)))
+	case "replicaof", "slaveof":
+		return replicaOf(args, config, cm, store, w)
 	case "wait":
-		return fmt.Sprintf(":%d\r\n", len(cm.replicas)), nil
+		w.integer(int64(cm.replicaCount()))
+	case "multi":
+		return multi(cl)
+	case "exec":
+		return exec(cl, store, config, cm)
+	case "discard":
+		return discard(cl, store)
+	case "watch":
+		return watchKeys(cl, args, store)
+	case "unwatch":
+		unwatchKeys(cl, store)
+		w.simpleString("OK")
+	case "eval", "evalsha":
+		if len(args) < 2 {
+			return fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+		}
+		return config.scripts.eval(cl, command, args, store, config, cm)
+	case "script":
+		if len(args) == 0 {
+			return errors.New("ERR wrong number of arguments for 'script' command")
+		}
+		return config.scripts.scriptCommand(args, w)
+	case "fcall", "fcall_ro":
+		if len(args) < 2 {
+			return fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+		}
+		return config.scripts.fcall(cl, command, args, store, config, cm)
+	case "function":
+		if len(args) == 0 {
+			return errors.New("ERR wrong number of arguments for 'function' command")
+		}
+		if err := config.scripts.functionCommand(args, w); err != nil {
+			return err
+		}
+		if isWriteCommand(command, args) && !config.isReplica() {
+			cm.propagateCommandsToReplica(respGenerator(append([]string{command}, args...)))
+		}
 	case "ping":
-		return "+PONG\r\n", nil
+		if len(args) > 1 {
+			return errors.New("ERR wrong number of arguments for 'ping' command")
+		}
+		// A RESP2 subscriber can't tell a plain reply from a message, so
+		// PING answers in the shape of one.
+		if cl.protocol == 2 && cl.subscriptionCount() > 0 {
+			w.arrayHeader(2)
+			w.bulk("pong")
+			if len(args) == 1 {
+				w.bulk(args[0])
+			} else {
+				w.bulk("")
+			}
+		} else if len(args) == 1 {
+			w.bulk(args[0])
+		} else {
+			w.simpleString("PONG")
+		}
 	case "echo":
-		if len(args) == 0 {
-			return "", errors.New("err - wrong number of arguments")
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'echo' command")
 		}
-		return fmt.Sprintf("$%d\r\n%s\r\n", len(args[0]), args[0]), nil
+		w.bulk(args[0])
 	case "info":
-		return getReplicationInfo(args, config)
+		info, err := getReplicationInfo(args, config, cm)
+		if err != nil {
+			return err
+		}
+		w.verbatim("txt", info)
+	case "hello":
+		return hello(cl, args, config, cm)
+	case "auth":
+		return auth(cl, args, config, cm)
+	case "acl":
+		return aclCommand(cl, args, config, cm)
 	case "set":
 		if len(args) < 2 {
-			return "", errors.New("ERR wrong number of arguments for 'set' command")
+			return errors.New("ERR wrong number of arguments for 'set' command")
 		}
-		if store.set(args) {
-			if len(cm.replicas) > 0 {
-				argCopy := append([]string{command}, args...)
-				cm.propagateCommandsToReplica(respGenerator(argCopy))
-			}
-			return "+OK\r\n", nil
+		created, ok := store.set(args)
+		if !ok {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		if !config.isReplica() {
+			argCopy := append([]string{command}, args...)
+			cm.propagateCommandsToReplica(respGenerator(argCopy))
+		}
+		if created {
+			notifyKeyspaceEvent(config, cm, notifyNew, "new", args[0])
+		}
+		notifyKeyspaceEvent(config, cm, notifyString, "set", args[0])
+		if len(args) == 4 && strings.ToLower(args[2]) == "px" {
+			notifyKeyspaceEvent(config, cm, notifyGeneric, "expire", args[0])
 		}
-		return "", errors.New("err - setting value")
+		w.simpleString("OK")
 	case "get":
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'get' command")
+		}
 		var err error
 		var str string
 		if config.rdb.dbFileName != "" {
@@ -449,14 +949,36 @@ func handleCommand(conn net.Conn, command string, args []string, store *redisSto
 			str, err = store.get(args[0])
 		}
 		if err != nil {
-			return "$-1\r\n", nil
+			notifyKeyspaceEvent(config, cm, notifyKeyMiss, "keymiss", args[0])
+			w.null()
+		} else {
+			w.bulk(str)
 		}
-		return fmt.Sprintf("$%d\r\n%s\r\n", len(str), str), nil
 	case "config":
-		return config.getRDBConfig(args)
+		if len(args) < 2 {
+			return errors.New("ERR wrong number of arguments for 'config' command")
+		}
+		return config.configCommand(args, w)
+	case "client":
+		if len(args) == 0 {
+			return errors.New("ERR wrong number of arguments for 'client' command")
+		}
+		return clientCommand(cl, args, store, cm)
 	case "keys":
-		return store.keys(args, config)
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'keys' command")
+		}
+		return store.keys(args, config, w)
 	default:
-		return "", errors.New("err - unknown command")
+		return unknownCommand(command, args)
+	}
+	return nil
+}
+
+func unknownCommand(command string, args []string) error {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + arg + "' "
 	}
+	return fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", command, strings.Join(quoted, ""))
 }
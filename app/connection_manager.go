@@ -3,20 +3,43 @@ package main
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"time"
 )
 
+type replicaState struct {
+	conn          net.Conn
+	listeningPort int
+	ackOffset     int
+	lastAck       time.Time
+}
+
 type connectionManager struct {
 	mu       sync.Mutex
-	replicas map[string]net.Conn
-	clients  map[string]net.Conn
+	replicas map[string]*replicaState
+	clients  map[string]*client
+	// subscriptions maps each pub/sub channel, pattern and shard channel,
+	// indexed by subscriptionKind, to its subscribers by address.
+	subscriptions [subscriptionKinds]map[string]map[string]*client
+	repl          *replicationState
+	// While EXEC or a script runs, propagated commands collect in
+	// transaction and are sent as one MULTI/EXEC block when it ends. A
+	// script called from EXEC nests inside the EXEC's block.
+	transactionDepth int
+	transaction      []string
 }
 
-func newConnectionManager() *connectionManager {
-	return &connectionManager{
-		replicas: make(map[string]net.Conn),
-		clients:  make(map[string]net.Conn),
+func newConnectionManager(repl *replicationState) *connectionManager {
+	cm := &connectionManager{
+		replicas: make(map[string]*replicaState),
+		clients:  make(map[string]*client),
+		repl:     repl,
 	}
+	for kind := range cm.subscriptions {
+		cm.subscriptions[kind] = make(map[string]map[string]*client)
+	}
+	return cm
 }
 
 func (cm *connectionManager) addConnection(addr string, conn net.Conn, connType string) {
@@ -24,9 +47,7 @@ func (cm *connectionManager) addConnection(addr string, conn net.Conn, connType
 	defer cm.mu.Unlock()
 	switch connType {
 	case "replica":
-		cm.replicas[addr] = conn
-	case "client":
-		cm.clients[addr] = conn
+		cm.replicas[addr] = &replicaState{conn: conn, lastAck: time.Now()}
 	}
 }
 
@@ -36,16 +57,144 @@ func (cm *connectionManager) removeConnection(addr string, connType string) {
 	switch connType {
 	case "replica":
 		delete(cm.replicas, addr)
-	case "client":
-		delete(cm.clients, addr)
+	}
+}
+
+func (cm *connectionManager) replicaCount() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return len(cm.replicas)
+}
+
+func (cm *connectionManager) recordReplicaAck(addr string, offset int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if replica, ok := cm.replicas[addr]; ok {
+		replica.ackOffset = offset
+		replica.lastAck = time.Now()
+	}
+}
+
+// goodReplicaCount counts replicas whose last ACK is at most maxLag old.
+func (cm *connectionManager) goodReplicaCount(maxLag time.Duration) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	good := 0
+	for _, replica := range cm.replicas {
+		if time.Since(replica.lastAck) <= maxLag {
+			good++
+		}
+	}
+	return good
+}
+
+// replicaInfo lists the connected replicas in INFO replication format.
+func (cm *connectionManager) replicaInfo() string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	output := fmt.Sprintf("connected_slaves:%d", len(cm.replicas))
+	i := 0
+	for _, replica := range cm.replicas {
+		host, port := replica.address()
+		lag := int(time.Since(replica.lastAck).Seconds())
+		output += fmt.Sprintf("\nslave%d:ip=%s,port=%s,state=online,offset=%d,lag=%d", i, host, port, replica.ackOffset, lag)
+		i++
+	}
+	return output
+}
+
+// dropTimedOutReplicas closes replicas that have not sent a REPLCONF ACK
+// within the replication timeout.
+func (cm *connectionManager) dropTimedOutReplicas(timeout time.Duration) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for addr, replica := range cm.replicas {
+		if time.Since(replica.lastAck) > timeout {
+			fmt.Println("Replica timed out: ", addr)
+			replica.conn.Close()
+			delete(cm.replicas, addr)
+		}
+	}
+}
+
+// attachReplica answers a PSYNC and registers the replica. It runs under the
+// manager lock so no propagated command can slip in between the reply and the
+// replica joining the fan-out.
+func (cm *connectionManager) attachReplica(conn net.Conn, listeningPort int, replid string, psyncOffset int, libraries []string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if missing, ok := cm.repl.continueFrom(replid, psyncOffset); ok {
+		currentReplid, _ := cm.repl.ids()
+		conn.Write([]byte(fmt.Sprintf("+CONTINUE %s\r\n", currentReplid)))
+		conn.Write([]byte(missing))
+		fmt.Println("Partial resync accepted for: ", conn.RemoteAddr().String())
+	} else {
+		currentReplid, offset := cm.repl.ids()
+		sendPsyncCommand(conn, currentReplid, offset)
+		sendRDBFile(conn, libraries)
+	}
+	cm.replicas[conn.RemoteAddr().String()] = &replicaState{conn: conn, listeningPort: listeningPort, lastAck: time.Now()}
+}
+
+// disconnectReplicas closes every replica link so that they reconnect and
+// resynchronise after a role or replication ID change.
+func (cm *connectionManager) disconnectReplicas() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for addr, replica := range cm.replicas {
+		replica.conn.Close()
+		delete(cm.replicas, addr)
 	}
 }
 
 func (cm *connectionManager) propagateCommandsToReplica(respArray string) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	for addr, conn := range cm.replicas {
-		conn.Write([]byte(respArray))
+	if cm.transactionDepth > 0 {
+		cm.transaction = append(cm.transaction, respArray)
+		return
+	}
+	cm.propagateLocked(respArray)
+}
+
+// relay forwards the stream a replica receives from its master to its own
+// replicas unchanged, even while a local EXEC is collecting its writes.
+func (cm *connectionManager) relay(raw string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.propagateLocked(raw)
+}
+
+// beginTransaction starts collecting propagated commands. Callers hold the
+// store's exec lock, so only one transaction is collected at a time.
+func (cm *connectionManager) beginTransaction() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.transactionDepth++
+}
+
+// endTransaction propagates the commands collected since beginTransaction
+// wrapped in MULTI/EXEC. A transaction that wrote nothing sends nothing.
+func (cm *connectionManager) endTransaction() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.transactionDepth--; cm.transactionDepth > 0 {
+		return
+	}
+	commands := cm.transaction
+	cm.transaction = nil
+	if len(commands) == 0 {
+		return
+	}
+	block := respGenerator([]string{"MULTI"}) + strings.Join(commands, "") + respGenerator([]string{"EXEC"})
+	cm.propagateLocked(block)
+}
+
+func (cm *connectionManager) propagateLocked(respArray string) {
+	cm.repl.feed(respArray)
+	for addr, replica := range cm.replicas {
+		replica.conn.Write([]byte(respArray))
 		fmt.Println("Propagated command to: ", addr)
 	}
 }
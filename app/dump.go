@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// rdbVersion is the RDB format version written into DUMP payloads.
+	rdbVersion    = 11
+	rdbTypeString = 0
+
+	rdbOpcodeFunction2    = 0xF5
+	rdbOpcodeAux          = 0xFA
+	rdbOpcodeResizeDB     = 0xFB
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeSelectDB     = 0xFE
+	rdbOpcodeEOF          = 0xFF
+)
+
+// crc64Jones is the CRC-64 variant (Jones polynomial, reflected) that Redis
+// appends to RDB files and DUMP payloads.
+var crc64Jones = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func rdbChecksum(data []byte) uint64 {
+	// hash/crc64 inverts the CRC on the way in and out, Redis does not.
+	return ^crc64.Update(^uint64(0), crc64Jones, data)
+}
+
+// rdbAppendLength appends an RDB length prefix.
+func rdbAppendLength(buf []byte, length int) []byte {
+	switch {
+	case length < 1<<6:
+		return append(buf, byte(length))
+	case length < 1<<14:
+		return append(buf, byte(length>>8)|0x40, byte(length))
+	case length <= 0xFFFFFFFF:
+		buf = append(buf, 0x80)
+		return binary.BigEndian.AppendUint32(buf, uint32(length))
+	default:
+		buf = append(buf, 0x81)
+		return binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+}
+
+// rdbReadLength reads an RDB length prefix from data, returning the length
+// and the number of bytes it took.
+func rdbReadLength(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errors.New("truncated length")
+	}
+	switch data[0] >> 6 {
+	case 0:
+		return int(data[0] & 0x3F), 1, nil
+	case 1:
+		if len(data) < 2 {
+			return 0, 0, errors.New("truncated length")
+		}
+		return int(data[0]&0x3F)<<8 | int(data[1]), 2, nil
+	}
+	switch data[0] {
+	case 0x80:
+		if len(data) < 5 {
+			return 0, 0, errors.New("truncated length")
+		}
+		return int(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case 0x81:
+		if len(data) < 9 {
+			return 0, 0, errors.New("truncated length")
+		}
+		return int(binary.BigEndian.Uint64(data[1:9])), 9, nil
+	}
+	return 0, 0, errors.New("unsupported length encoding")
+}
+
+// rdbAppendString appends a string the way RDB stores it: integers that
+// round-trip exactly use the compact integer encodings.
+func rdbAppendString(buf []byte, content string) []byte {
+	if n, err := strconv.ParseInt(content, 10, 32); err == nil && strconv.FormatInt(n, 10) == content {
+		switch {
+		case n >= -1<<7 && n < 1<<7:
+			return append(buf, 0xC0, byte(n))
+		case n >= -1<<15 && n < 1<<15:
+			return binary.LittleEndian.AppendUint16(append(buf, 0xC1), uint16(n))
+		default:
+			return binary.LittleEndian.AppendUint32(append(buf, 0xC2), uint32(n))
+		}
+	}
+	buf = rdbAppendLength(buf, len(content))
+	return append(buf, content...)
+}
+
+// rdbReadString reads a string in any of the RDB encodings (plain, integer
+// or LZF compressed) and returns it with the number of bytes consumed.
+func rdbReadString(data []byte) (string, int, error) {
+	if len(data) == 0 {
+		return "", 0, errors.New("truncated string")
+	}
+	if data[0]>>6 != 3 {
+		length, n, err := rdbReadLength(data)
+		if err != nil {
+			return "", 0, err
+		}
+		if len(data) < n+length {
+			return "", 0, errors.New("truncated string")
+		}
+		return string(data[n : n+length]), n + length, nil
+	}
+
+	switch data[0] & 0x3F {
+	case 0:
+		if len(data) < 2 {
+			return "", 0, errors.New("truncated integer")
+		}
+		return strconv.Itoa(int(int8(data[1]))), 2, nil
+	case 1:
+		if len(data) < 3 {
+			return "", 0, errors.New("truncated integer")
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(data[1:])))), 3, nil
+	case 2:
+		if len(data) < 5 {
+			return "", 0, errors.New("truncated integer")
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(data[1:])))), 5, nil
+	case 3:
+		compressedLen, n1, err := rdbReadLength(data[1:])
+		if err != nil {
+			return "", 0, err
+		}
+		length, n2, err := rdbReadLength(data[1+n1:])
+		if err != nil {
+			return "", 0, err
+		}
+		start := 1 + n1 + n2
+		if len(data) < start+compressedLen {
+			return "", 0, errors.New("truncated LZF string")
+		}
+		content, err := lzfDecompress(data[start:start+compressedLen], length)
+		if err != nil {
+			return "", 0, err
+		}
+		return string(content), start + compressedLen, nil
+	}
+	return "", 0, errors.New("unsupported string encoding")
+}
+
+// lzfDecompress expands an LZF block into exactly length bytes.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 {
+			// A literal run of ctrl+1 bytes.
+			if i+ctrl+1 > len(in) {
+				return nil, errors.New("corrupt LZF literal")
+			}
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+		// A back reference of ctrl>>5 + 2 bytes (with an extra length byte
+		// when the 3 bits are all set).
+		refLen := ctrl >> 5
+		if refLen == 7 {
+			if i >= len(in) {
+				return nil, errors.New("corrupt LZF reference")
+			}
+			refLen += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("corrupt LZF reference")
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errors.New("corrupt LZF reference")
+		}
+		for j := 0; j < refLen+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != length {
+		return nil, errors.New("LZF length mismatch")
+	}
+	return out, nil
+}
+
+// dumpValue serializes a string value the way DUMP does: the RDB type and
+// value, then the RDB version and a CRC64 of everything before it.
+func dumpValue(content string) string {
+	buf := rdbAppendString([]byte{rdbTypeString}, content)
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, rdbChecksum(buf))
+	return string(buf)
+}
+
+// verifyDumpPayload checks the footer of a DUMP payload and returns the
+// serialized value it protects.
+func verifyDumpPayload(payload string) ([]byte, error) {
+	data := []byte(payload)
+	if len(data) < 10 {
+		return nil, errors.New("ERR DUMP payload version or checksum are wrong")
+	}
+	footer := len(data) - 10
+	version := binary.LittleEndian.Uint16(data[footer:])
+	if version > rdbVersion {
+		return nil, errors.New("ERR DUMP payload version or checksum are wrong")
+	}
+	if binary.LittleEndian.Uint64(data[footer+2:]) != rdbChecksum(data[:footer+2]) {
+		return nil, errors.New("ERR DUMP payload version or checksum are wrong")
+	}
+	return data[:footer], nil
+}
+
+func loadDumpValue(payload string) (string, error) {
+	data, err := verifyDumpPayload(payload)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 || data[0] != rdbTypeString {
+		return "", errors.New("ERR Bad data format")
+	}
+	content, n, err := rdbReadString(data[1:])
+	if err != nil || 1+n != len(data) {
+		return "", errors.New("ERR Bad data format")
+	}
+	return content, nil
+}
+
+// dump implements DUMP key.
+func dump(args []string, store *redisStore, w *replyWriter) error {
+	if len(args) != 1 {
+		return errors.New("ERR wrong number of arguments for 'dump' command")
+	}
+	content, err := store.get(args[0])
+	if err != nil {
+		w.null()
+	} else {
+		w.bulk(dumpValue(content))
+	}
+	return nil
+}
+
+type restoreRequest struct {
+	key      string
+	ttl      int64
+	payload  string
+	replace  bool
+	absTTL   bool
+	idleTime int64
+	freq     int64
+}
+
+func parseRestoreArgs(args []string) (restoreRequest, error) {
+	request := restoreRequest{idleTime: -1, freq: -1}
+	if len(args) < 3 {
+		return request, errors.New("ERR wrong number of arguments for 'restore' command")
+	}
+	request.key, request.payload = args[0], args[2]
+	ttl, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return request, errors.New("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return request, errors.New("ERR Invalid TTL value, must be >= 0")
+	}
+	request.ttl = ttl
+
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "replace":
+			request.replace = true
+		case "absttl":
+			request.absTTL = true
+		case "idletime":
+			if i+1 >= len(args) || request.freq >= 0 {
+				return request, errors.New("ERR syntax error")
+			}
+			idle, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return request, errors.New("ERR value is not an integer or out of range")
+			}
+			if idle < 0 {
+				return request, errors.New("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			request.idleTime = idle
+			i++
+		case "freq":
+			if i+1 >= len(args) || request.idleTime >= 0 {
+				return request, errors.New("ERR syntax error")
+			}
+			freq, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return request, errors.New("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > 255 {
+				return request, errors.New("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			request.freq = freq
+			i++
+		default:
+			return request, errors.New("ERR syntax error")
+		}
+	}
+	return request, nil
+}
+
+// restore implements RESTORE key ttl serialized-value [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency]. The payload is fully checked before
+// the store is touched. IDLETIME and FREQ are validated but have nothing to
+// set, as the store keeps no access statistics for eviction. created reports
+// that the key did not exist before.
+func restore(args []string, store *redisStore) (created bool, err error) {
+	request, err := parseRestoreArgs(args)
+	if err != nil {
+		return false, err
+	}
+	content, err := loadDumpValue(request.payload)
+	if err != nil {
+		return false, err
+	}
+
+	var expiry int64
+	if request.absTTL && request.ttl > 0 {
+		expiry = time.UnixMilli(request.ttl).UnixNano()
+	} else if request.ttl > 0 {
+		expiry = time.Now().Add(time.Duration(request.ttl) * time.Millisecond).UnixNano()
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	current, exists := store.store[request.key]
+	exists = exists && (current.expiry == 0 || !expired(current.expiry))
+	if exists && !request.replace {
+		return false, errors.New("BUSYKEY Target key name already exists.")
+	}
+	// An absolute TTL already in the past restores a key that is
+	// immediately gone.
+	store.touch(request.key)
+	if expiry != 0 && expired(expiry) {
+		delete(store.store, request.key)
+		return false, nil
+	}
+	store.store[request.key] = value{content: content, expiry: expiry}
+	return !exists, nil
+}
+
+// rdbFileFunctions returns the function libraries stored in an RDB file.
+func rdbFileFunctions(data []byte) ([]string, error) {
+	codes, _, err := rdbReadHeader(data)
+	return codes, err
+}
+
+// rdbReadHeader reads the aux fields and function records at the start of an
+// RDB file. It returns the function libraries and the offset of the first
+// record after them, where the keyspace starts.
+func rdbReadHeader(data []byte) ([]string, int, error) {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return nil, 0, errors.New("not an RDB file")
+	}
+	var codes []string
+	i := 9
+	for i < len(data) {
+		switch data[i] {
+		case rdbOpcodeAux:
+			i++
+			for field := 0; field < 2; field++ {
+				_, n, err := rdbReadString(data[i:])
+				if err != nil {
+					return nil, 0, err
+				}
+				i += n
+			}
+		case rdbOpcodeFunction2:
+			code, n, err := rdbReadString(data[i+1:])
+			if err != nil {
+				return nil, 0, err
+			}
+			codes = append(codes, code)
+			i += 1 + n
+		default:
+			return codes, i, nil
+		}
+	}
+	return codes, i, nil
+}
+
+// rdbSnapshot encodes the keyspace and the function libraries as an RDB
+// file. Strings are stored plainly, without the integer encodings, as the
+// file reader behind KEYS and GET expects.
+func rdbSnapshot(store *redisStore, codes []string) []byte {
+	buf := []byte(fmt.Sprintf("REDIS%04d", rdbVersion))
+	for _, aux := range [][2]string{{"redis-ver", "7.2.0"}, {"redis-bits", "64"}} {
+		buf = append(buf, rdbOpcodeAux)
+		buf = rdbAppendString(buf, aux[0])
+		buf = rdbAppendString(buf, aux[1])
+	}
+	buf = rdbAppendFunctions(buf, codes)
+
+	store.mu.RLock()
+	keys := make([]string, 0, len(store.store))
+	expires := 0
+	for key, val := range store.store {
+		if val.expiry != 0 {
+			if expired(val.expiry) {
+				continue
+			}
+			expires++
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf = append(buf, rdbOpcodeSelectDB, 0, rdbOpcodeResizeDB)
+	buf = rdbAppendLength(buf, len(keys))
+	buf = rdbAppendLength(buf, expires)
+	for _, key := range keys {
+		val := store.store[key]
+		if val.expiry != 0 {
+			buf = append(buf, rdbOpcodeExpireTimeMs)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(val.expiry/int64(time.Millisecond)))
+		}
+		buf = append(buf, rdbTypeString)
+		buf = rdbAppendLength(buf, len(key))
+		buf = append(buf, key...)
+		buf = rdbAppendLength(buf, len(val.content))
+		buf = append(buf, val.content...)
+	}
+	store.mu.RUnlock()
+
+	buf = append(buf, rdbOpcodeEOF)
+	return binary.LittleEndian.AppendUint64(buf, rdbChecksum(buf))
+}
+
+// save implements SAVE. The file is written under a temporary name and
+// renamed into place, so a failed SAVE leaves the previous one intact.
+func save(store *redisStore, config *config) error {
+	if config.rdb.dbFileName == "" {
+		return errors.New("ERR no dbfilename is configured")
+	}
+	data := rdbSnapshot(store, config.scripts.libraryCodes())
+	path := config.rdb.dir + "/" + config.rdb.dbFileName
+	tmp := fmt.Sprintf("%s/temp-%d.rdb", config.rdb.dir, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("ERR %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("ERR %v", err)
+	}
+	return nil
+}
+
+// rdbAddFunctions adds function records to an RDB file that holds no keys,
+// just before its end, and recomputes its checksum.
+func rdbAddFunctions(data []byte, codes []string) []byte {
+	end := len(data) - 9
+	buf := append([]byte{}, data[:end]...)
+	buf = rdbAppendFunctions(buf, codes)
+	buf = append(buf, rdbOpcodeEOF)
+	return binary.LittleEndian.AppendUint64(buf, rdbChecksum(buf))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRdbChecksumMatchesRedis(t *testing.T) {
+	// The check value of Redis' crc64.c self test.
+	if got := rdbChecksum([]byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("rdbChecksum(123456789) = %#x, want 0xe9c6d914c4b8d9ca", got)
+	}
+}
+
+func TestDumpRestoreRoundTrip(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	for _, content := range []string{"", "hello", "12", "-300", "70000", "007", strings.Repeat("x", 20000)} {
+		client.do("SET", "src", content)
+		payload, ok := client.do("DUMP", "src").(string)
+		if !ok {
+			t.Fatalf("DUMP of %q did not return a payload", content)
+		}
+		if reply := client.do("RESTORE", "dst", "0", payload, "REPLACE"); reply != "OK" {
+			t.Fatalf("RESTORE of %q replied %v", content, reply)
+		}
+		if reply := client.do("GET", "dst"); reply != content {
+			t.Fatalf("restored %q as %v", content, reply)
+		}
+	}
+	if reply := client.do("DUMP", "missing"); reply != nil {
+		t.Fatalf("DUMP of a missing key replied %v, want nil", reply)
+	}
+}
+
+func TestDumpUsesIntegerEncodings(t *testing.T) {
+	for content, encoding := range map[string]byte{"12": 0xC0, "-300": 0xC1, "70000": 0xC2} {
+		if payload := dumpValue(content); payload[1] != encoding {
+			t.Errorf("dumpValue(%q) uses encoding %#x, want %#x", content, payload[1], encoding)
+		}
+	}
+	if payload := dumpValue("007"); payload[1] != 3 {
+		t.Errorf("dumpValue(\"007\") does not keep the string as is")
+	}
+}
+
+func TestRestoreReadsLZFStrings(t *testing.T) {
+	// A literal "a" followed by a back reference repeating it nine times.
+	compressed := []byte{0x00, 'a', 0xE0, 0x00, 0x00}
+	buf := []byte{rdbTypeString, 0xC3}
+	buf = rdbAppendLength(buf, len(compressed))
+	buf = rdbAppendLength(buf, 10)
+	buf = append(buf, compressed...)
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, rdbChecksum(buf))
+
+	content, err := loadDumpValue(string(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "aaaaaaaaaa" {
+		t.Fatalf("LZF string decoded as %q", content)
+	}
+}
+
+func TestRestoreOptions(t *testing.T) {
+	store := &redisStore{store: map[string]value{}}
+	payload := dumpValue("v")
+
+	if _, err := restore([]string{"k", "0", payload}, store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restore([]string{"k", "0", payload}, store); err == nil || !strings.HasPrefix(err.Error(), "BUSYKEY") {
+		t.Fatalf("RESTORE over an existing key returned %v, want BUSYKEY", err)
+	}
+	if _, err := restore([]string{"k", "60000", payload, "REPLACE"}, store); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := time.Until(time.Unix(0, store.store["k"].expiry)); ttl <= 50*time.Second || ttl > time.Minute {
+		t.Fatalf("RESTORE with a TTL of 60000 left %v to live", ttl)
+	}
+
+	past := time.Now().Add(-time.Second).UnixMilli()
+	if _, err := restore([]string{"k", strconv.FormatInt(past, 10), payload, "REPLACE", "ABSTTL"}, store); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.store["k"]; ok {
+		t.Fatal("RESTORE with an ABSTTL in the past kept the key")
+	}
+
+	for _, args := range [][]string{
+		{"k", "-1", payload},
+		{"k", "0", payload, "FREQ", "256"},
+		{"k", "0", payload, "IDLETIME", "1", "FREQ", "1"},
+		{"k", "0", payload, "BOGUS"},
+	} {
+		if _, err := restore(args, store); err == nil {
+			t.Errorf("RESTORE %q was accepted", args[1:])
+		}
+	}
+}
+
+func TestRestoreRejectsDamagedPayloads(t *testing.T) {
+	store := &redisStore{store: map[string]value{}}
+	payload := []byte(dumpValue("value"))
+
+	corrupted := append([]byte(nil), payload...)
+	corrupted[2] ^= 0xFF
+	newer := append([]byte(nil), payload...)
+	binary.LittleEndian.PutUint16(newer[len(newer)-10:], rdbVersion+1)
+	for name, bad := range map[string][]byte{"corrupted": corrupted, "newer": newer, "truncated": payload[:5]} {
+		if _, err := restore([]string{"k", "0", string(bad)}, store); err == nil || !strings.Contains(err.Error(), "checksum") {
+			t.Errorf("RESTORE of a %s payload returned %v", name, err)
+		}
+	}
+	if _, ok := store.store["k"]; ok {
+		t.Fatal("a rejected payload reached the store")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// activeExpireInterval is how often the expiry cycle looks for keys
+	// whose TTL passed without anyone reading them.
+	activeExpireInterval = 100 * time.Millisecond
+	// activeExpireSample is how many keys with a TTL each round checks. A
+	// round that finds more than a quarter of them expired is repeated, up
+	// to activeExpireBudget per cycle.
+	activeExpireSample = 20
+	activeExpireBudget = 25 * time.Millisecond
+)
+
+// deleteExpired deletes key if its TTL has passed and reports whether it
+// did.
+func (r *redisStore) deleteExpired(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	val, ok := r.store[key]
+	if !ok || val.expiry == 0 || !expired(val.expiry) {
+		return false
+	}
+	r.touch(key)
+	delete(r.store, key)
+	return true
+}
+
+// sampleExpired returns the expired keys among up to activeExpireSample keys
+// that have a TTL, and whether enough of those were expired that another
+// round is worth it.
+func (r *redisStore) sampleExpired() ([]string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var keys []string
+	sampled, visited := 0, 0
+	// Map iteration starts at a random key, which makes this a random
+	// sample. Keys without a TTL are skipped, up to a bound.
+	for key, val := range r.store {
+		if visited++; visited > activeExpireSample*20 || sampled == activeExpireSample {
+			break
+		}
+		if val.expiry == 0 {
+			continue
+		}
+		sampled++
+		if expired(val.expiry) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, len(keys) > activeExpireSample/4
+}
+
+// expireIfNeeded deletes key if its TTL has passed, telling the replicas
+// with a DEL and subscribers with an expired event. Replicas never expire
+// keys themselves: they hide them from reads and wait for the master's DEL.
+func expireIfNeeded(key string, store *redisStore, config *config, cm *connectionManager) bool {
+	if config.isReplica() || !store.deleteExpired(key) {
+		return false
+	}
+	cm.propagateCommandsToReplica(respGenerator([]string{"DEL", key}))
+	store.tracking.invalidate([]string{key}, nil)
+	notifyKeyspaceEvent(config, cm, notifyExpired, "expired", key)
+	return true
+}
+
+// activeExpireCycle deletes expired keys nobody reads, so that they free
+// their memory and their expired events go out close to when they expire.
+// It takes the store's exec lock like a command would, so no key expires in
+// the middle of a transaction or script.
+func activeExpireCycle(ctx context.Context, store *redisStore, config *config, cm *connectionManager) {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if config.isReplica() {
+			continue
+		}
+		if !store.exec.lock(false, ctx.Done()) {
+			return
+		}
+		start := time.Now()
+		for time.Since(start) < activeExpireBudget {
+			keys, more := store.sampleExpired()
+			for _, key := range keys {
+				expireIfNeeded(key, store, config, cm)
+			}
+			if !more {
+				break
+			}
+		}
+		store.exec.unlock(false)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	noFailover           = "no-failover"
+	waitingForSync       = "waiting-for-sync"
+	failoverInProgress   = "failover-in-progress"
+	failoverPollInterval = 100 * time.Millisecond
+	// failoverPsyncTimeout bounds the handover when FAILOVER has no TIMEOUT.
+	failoverPsyncTimeout = 10 * time.Second
+)
+
+// failoverState coordinates a FAILOVER: it pauses writes on the master while
+// the target replica catches up and the roles are swapped.
+type failoverState struct {
+	mu      sync.Mutex
+	state   string
+	resumed chan struct{}
+	abort   chan struct{}
+}
+
+func newFailoverState() *failoverState {
+	return &failoverState{state: noFailover}
+}
+
+type failoverRequest struct {
+	targetHost string
+	targetPort string
+	timeout    time.Duration
+	force      bool
+}
+
+// waitForWrites blocks a write command while a failover has writes paused.
+func (f *failoverState) waitForWrites() {
+	f.mu.Lock()
+	resumed := f.resumed
+	f.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+func (f *failoverState) current() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *failoverState) setState(state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+}
+
+func (f *failoverState) begin() (chan struct{}, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state != noFailover {
+		return nil, false
+	}
+	f.state = waitingForSync
+	f.resumed = make(chan struct{})
+	f.abort = make(chan struct{})
+	return f.abort, true
+}
+
+func (f *failoverState) end() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = noFailover
+	if f.resumed != nil {
+		close(f.resumed)
+	}
+	f.resumed = nil
+	f.abort = nil
+}
+
+func (f *failoverState) requestAbort() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state == noFailover {
+		return false
+	}
+	select {
+	case <-f.abort:
+	default:
+		close(f.abort)
+	}
+	return true
+}
+
+func parseFailoverArgs(args []string) (failoverRequest, bool, error) {
+	request := failoverRequest{}
+	abort := false
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "to":
+			if i+2 >= len(args) {
+				return request, false, errors.New("ERR syntax error")
+			}
+			if _, err := strconv.Atoi(args[i+2]); err != nil {
+				return request, false, errors.New("ERR Invalid target port")
+			}
+			request.targetHost, request.targetPort = args[i+1], args[i+2]
+			i += 2
+		case "timeout":
+			if i+1 >= len(args) {
+				return request, false, errors.New("ERR syntax error")
+			}
+			ms, err := strconv.Atoi(args[i+1])
+			if err != nil || ms <= 0 {
+				return request, false, errors.New("ERR FAILOVER timeout must be greater than 0")
+			}
+			request.timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case "force":
+			request.force = true
+		case "abort":
+			abort = true
+		default:
+			return request, false, errors.New("ERR syntax error")
+		}
+	}
+	if abort && (request.targetHost != "" || request.timeout > 0 || request.force) {
+		return request, false, errors.New("ERR syntax error")
+	}
+	if request.force && (request.targetHost == "" || request.timeout == 0) {
+		return request, false, errors.New("ERR FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+	return request, abort, nil
+}
+
+// failover implements FAILOVER [TO host port] [TIMEOUT ms] [FORCE] [ABORT].
+// The handover itself runs in the background; the client gets +OK as soon as
+// it has started.
+func failover(args []string, config *config, cm *connectionManager, store *redisStore, w *replyWriter) error {
+	request, abort, err := parseFailoverArgs(args)
+	if err != nil {
+		return err
+	}
+	fs := config.server.failover
+
+	if abort {
+		if !fs.requestAbort() {
+			return errors.New("ERR No failover in progress.")
+		}
+		w.simpleString("OK")
+		return nil
+	}
+
+	if config.isReplica() {
+		return errors.New("ERR FAILOVER is not valid when server is a replica.")
+	}
+	if cm.replicaCount() == 0 {
+		return errors.New("ERR FAILOVER requires connected replicas.")
+	}
+	if request.targetHost != "" {
+		if _, ok := cm.replicaAt(request.targetHost, request.targetPort); !ok {
+			return errors.New("ERR FAILOVER target HOST and PORT is not a replica.")
+		}
+	}
+
+	abortCh, ok := fs.begin()
+	if !ok {
+		return errors.New("ERR FAILOVER already in progress.")
+	}
+	go runFailover(config, cm, store, request, abortCh)
+	w.simpleString("OK")
+	return nil
+}
+
+func runFailover(config *config, cm *connectionManager, store *redisStore, request failoverRequest, abortCh chan struct{}) {
+	fs := config.server.failover
+	defer fs.end()
+
+	// Writes are paused, so once a replica acks this offset it has
+	// everything the clients wrote.
+	_, targetOffset := config.server.repl.ids()
+	cm.propagateCommandsToReplica(respGenerator([]string{"REPLCONF", "GETACK", "*"}))
+
+	var deadline <-chan time.Time
+	if request.timeout > 0 {
+		deadline = time.After(request.timeout)
+	}
+	ticker := time.NewTicker(failoverPollInterval)
+	defer ticker.Stop()
+
+	target := ""
+	for target == "" {
+		select {
+		case <-abortCh:
+			fmt.Println("FAILOVER aborted while waiting for sync")
+			return
+		case <-deadline:
+			if !request.force {
+				fmt.Println("FAILOVER timed out waiting for a replica to sync")
+				return
+			}
+			target = request.targetHost + " " + request.targetPort
+		case <-ticker.C:
+			target = cm.syncedReplica(request.targetHost, request.targetPort, targetOffset)
+		}
+	}
+
+	fs.setState(failoverInProgress)
+	fmt.Println("FAILOVER handing over to", target)
+
+	result := make(chan error, 1)
+	config.server.repl.requestFailoverPsync(result)
+	setMaster(config, cm, store, target)
+
+	handoverTimeout := failoverPsyncTimeout
+	if request.timeout > 0 {
+		handoverTimeout = request.timeout
+	}
+
+	select {
+	case err := <-result:
+		if err == nil {
+			fmt.Println("FAILOVER completed, now a replica of", target)
+			return
+		}
+		fmt.Println("FAILOVER handover failed:", err)
+	case <-abortCh:
+		fmt.Println("FAILOVER aborted during handover")
+	case <-time.After(handoverTimeout):
+		fmt.Println("FAILOVER handover timed out")
+	}
+	config.server.repl.requestFailoverPsync(nil)
+	unsetMaster(config, cm)
+}
+
+// acceptFailoverPsync handles PSYNC ... FAILOVER on a replica: our master asks
+// us to take over, so we promote ourselves before answering its PSYNC.
+func acceptFailoverPsync(replid string, config *config, cm *connectionManager) error {
+	if !config.isReplica() {
+		return errors.New("ERR PSYNC FAILOVER can't be sent to a master.")
+	}
+	if currentReplid, _ := config.server.repl.ids(); replid != currentReplid {
+		return errors.New("ERR PSYNC FAILOVER replid must match my replid.")
+	}
+	unsetMaster(config, cm)
+	return nil
+}
+
+// replicaAt finds the replica announcing host:port as its listening address.
+func (cm *connectionManager) replicaAt(host, port string) (*replicaState, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, replica := range cm.replicas {
+		replicaHost, replicaPort := replica.address()
+		if replicaHost == host && replicaPort == port {
+			return replica, true
+		}
+	}
+	return nil, false
+}
+
+// syncedReplica returns the address of a replica (the requested one, if any)
+// that has acknowledged offset.
+func (cm *connectionManager) syncedReplica(host, port string, offset int) string {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, replica := range cm.replicas {
+		replicaHost, replicaPort := replica.address()
+		if host != "" && (replicaHost != host || replicaPort != port) {
+			continue
+		}
+		if replica.ackOffset >= offset {
+			return replicaHost + " " + replicaPort
+		}
+	}
+	return ""
+}
+
+func (r *replicaState) address() (string, string) {
+	host, _, _ := net.SplitHostPort(r.conn.RemoteAddr().String())
+	return host, strconv.Itoa(r.listeningPort)
+}
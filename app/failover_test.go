@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// role returns the role line of INFO replication.
+func role(tb testing.TB, client *testClient) string {
+	tb.Helper()
+	info, _ := client.do("INFO", "replication").(string)
+	for _, line := range strings.Split(info, "\n") {
+		if role, ok := strings.CutPrefix(strings.TrimSpace(line), "role:"); ok {
+			return role
+		}
+	}
+	tb.Fatalf("no role in %q", info)
+	return ""
+}
+
+func TestFailoverSwapsRoles(t *testing.T) {
+	master := startTestServer(t, "")
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	masterClient := dialTestClient(t, master.addr)
+	replicaClient := dialTestClient(t, replica.addr)
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+
+	masterClient.do("SET", "before", "failover")
+	if reply := masterClient.do("FAILOVER"); reply != "OK" {
+		t.Fatalf("FAILOVER replied %v", reply)
+	}
+	waitFor(t, "the roles to swap", func() bool {
+		return role(t, masterClient) == "slave" && role(t, replicaClient) == "master"
+	})
+	if reply := replicaClient.do("GET", "before"); reply != "failover" {
+		t.Fatalf("new master has before=%v, want failover", reply)
+	}
+
+	// The old master now follows the new one.
+	replicaClient.do("SET", "after", "failover")
+	waitFor(t, "the write to reach the old master", func() bool {
+		return masterClient.do("GET", "after") == "failover"
+	})
+	waitFor(t, "the failover to finish", func() bool {
+		info, _ := masterClient.do("INFO", "replication").(string)
+		return strings.Contains(info, "master_failover_state:no-failover")
+	})
+}
+
+func TestFailoverErrors(t *testing.T) {
+	master := startTestServer(t, "")
+	client := dialTestClient(t, master.addr)
+
+	if reply := client.do("FAILOVER"); reply != replyError("ERR FAILOVER requires connected replicas.") {
+		t.Fatalf("FAILOVER without replicas replied %v", reply)
+	}
+	if reply := client.do("FAILOVER", "ABORT"); reply != replyError("ERR No failover in progress.") {
+		t.Fatalf("FAILOVER ABORT replied %v", reply)
+	}
+
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+	if reply := client.do("FAILOVER", "TO", "127.0.0.1", "1"); reply != replyError("ERR FAILOVER target HOST and PORT is not a replica.") {
+		t.Fatalf("FAILOVER TO a stranger replied %v", reply)
+	}
+	if reply := dialTestClient(t, replica.addr).do("FAILOVER"); reply != replyError("ERR FAILOVER is not valid when server is a replica.") {
+		t.Fatalf("FAILOVER on a replica replied %v", reply)
+	}
+}
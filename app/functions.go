@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// functionLoadTimeout bounds how long a library's code may run while it
+// registers its functions.
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionWriteSubcommands change the loaded libraries. They are refused on
+// read-only replicas and propagated to replicas like writes.
+var functionWriteSubcommands = map[string]bool{
+	"load":    true,
+	"delete":  true,
+	"flush":   true,
+	"restore": true,
+}
+
+var functionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+// library is the code given to FUNCTION LOAD and the functions it registered
+// with redis.register_function.
+type library struct {
+	name      string
+	code      string
+	functions []*function
+}
+
+type function struct {
+	name        string
+	description string
+	flags       []string
+	callback    *lua.LFunction
+	library     *library
+}
+
+func (f *function) hasFlag(flag string) bool {
+	for _, set := range f.flags {
+		if set == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// validFunctionName accepts the names Redis allows for libraries and
+// functions: letters, digits and underscores.
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMetadata reads the "#!lua name=<library>" line that starts a
+// library and returns the name and the Lua code. The metadata line is
+// blanked rather than dropped so that error line numbers stay right.
+func parseLibraryMetadata(code string) (string, string, error) {
+	first, body, _ := strings.Cut(code, "\n")
+	if !strings.HasPrefix(first, "#!") {
+		return "", "", errors.New("ERR Missing library metadata")
+	}
+	fields := strings.Fields(first[2:])
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "lua") {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return "", "", fmt.Errorf("ERR Engine '%s' not found", engine)
+	}
+	name := ""
+	for _, field := range fields[1:] {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok || key != "name" {
+			return "", "", fmt.Errorf("ERR Invalid metadata value given: %s", field)
+		}
+		name = val
+	}
+	if name == "" {
+		return "", "", errors.New("ERR Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	return name, "\n" + body, nil
+}
+
+// registerFunction implements redis.register_function, called either as
+// (name, callback) or with a table holding function_name, callback and the
+// optional flags and description.
+func (e *scriptEngine) registerFunction(L *lua.LState) int {
+	lib := e.loading
+	if lib == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+		return 0
+	}
+	f := &function{library: lib}
+	switch L.GetTop() {
+	case 1:
+		spec := L.CheckTable(1)
+		var specErr string
+		spec.ForEach(func(key, val lua.LValue) {
+			switch key.String() {
+			case "function_name":
+				f.name = val.String()
+			case "callback":
+				f.callback, _ = val.(*lua.LFunction)
+			case "description":
+				f.description = val.String()
+			case "flags":
+				flags, ok := val.(*lua.LTable)
+				if !ok {
+					specErr = "flags argument to redis.register_function must be a table representing function flags"
+					return
+				}
+				flags.ForEach(func(_, flag lua.LValue) {
+					if !functionFlags[flag.String()] {
+						specErr = "unknown flag given"
+					}
+					f.flags = append(f.flags, flag.String())
+				})
+			default:
+				specErr = "unknown argument given to redis.register_function"
+			}
+		})
+		if specErr != "" {
+			L.RaiseError("%s", specErr)
+		}
+		if f.callback == nil {
+			L.RaiseError("redis.register_function must get a callback argument")
+		}
+	case 2:
+		f.name = L.CheckString(1)
+		f.callback = L.CheckFunction(2)
+	default:
+		L.RaiseError("wrong number of arguments to redis.register_function")
+	}
+
+	if !validFunctionName(f.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	for _, registered := range lib.functions {
+		if registered.name == f.name {
+			L.RaiseError("Function already exists in the library")
+		}
+	}
+	lib.functions = append(lib.functions, f)
+	return 0
+}
+
+// loadLibrary compiles a library and runs its code to collect the functions
+// it registers, without installing them. The code runs with its own globals,
+// falling back to the shared ones, so libraries don't see each other's. The
+// caller holds e.mu.
+func (e *scriptEngine) loadLibrary(code string) (*library, error) {
+	name, body, err := parseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+	L := e.state
+	fn, err := L.Load(strings.NewReader(body), "@user_function")
+	if err != nil {
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) && apiErr.Cause != nil {
+			err = apiErr.Cause
+		}
+		return nil, fmt.Errorf("ERR Error compiling function: %s", strings.ReplaceAll(err.Error(), "\n", " "))
+	}
+	env := L.NewTable()
+	meta := L.NewTable()
+	meta.RawSetString("__index", L.Get(lua.GlobalsIndex))
+	L.SetMetatable(env, meta)
+	fn.Env = env
+
+	lib := &library{name: name, code: code}
+	e.loading = lib
+	defer func() { e.loading = nil }()
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	L.Push(fn)
+	err = L.PCall(0, 0, nil)
+	defer L.SetTop(0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.New("ERR FUNCTION LOAD timeout")
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			msg, ok := errorReplyMessage(apiErr.Object)
+			if !ok {
+				msg = apiErr.Object.String()
+			}
+			err = errors.New(msg)
+		}
+		return nil, fmt.Errorf("ERR Error registering functions: %s", err)
+	}
+	if len(lib.functions) == 0 {
+		return nil, errors.New("ERR No functions registered")
+	}
+	return lib, nil
+}
+
+// installLibraries adds libs, replacing libraries of the same name when
+// replace is set. On a conflict nothing is installed. The caller holds e.mu.
+func (e *scriptEngine) installLibraries(libs []*library, replace bool) error {
+	libNames := map[string]bool{}
+	functionNames := map[string]bool{}
+	for _, lib := range libs {
+		if _, ok := e.libraries[lib.name]; ok && !replace || libNames[lib.name] {
+			return fmt.Errorf("ERR Library '%s' already exists", lib.name)
+		}
+		libNames[lib.name] = true
+		for _, f := range lib.functions {
+			existing, ok := e.functions[f.name]
+			if ok && existing.library.name != lib.name || functionNames[f.name] {
+				return fmt.Errorf("ERR Function %s already exists", f.name)
+			}
+			functionNames[f.name] = true
+		}
+	}
+	for _, lib := range libs {
+		if old, ok := e.libraries[lib.name]; ok {
+			e.deleteLibrary(old)
+		}
+		e.libraries[lib.name] = lib
+		for _, f := range lib.functions {
+			e.functions[f.name] = f
+		}
+	}
+	return nil
+}
+
+func (e *scriptEngine) deleteLibrary(lib *library) {
+	for _, f := range lib.functions {
+		delete(e.functions, f.name)
+	}
+	delete(e.libraries, lib.name)
+}
+
+func (e *scriptEngine) flushLibraries() {
+	e.libraries = make(map[string]*library)
+	e.functions = make(map[string]*function)
+}
+
+func (e *scriptEngine) sortedLibraries() []*library {
+	libs := make([]*library, 0, len(e.libraries))
+	for _, lib := range e.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// libraryCodes returns the code of every loaded library, for the RDB sent to
+// replicas.
+func (e *scriptEngine) libraryCodes() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var codes []string
+	for _, lib := range e.sortedLibraries() {
+		codes = append(codes, lib.code)
+	}
+	return codes
+}
+
+// replaceLibraries swaps every loaded library for the ones in codes, as a
+// replica does after a full resynchronisation.
+func (e *scriptEngine) replaceLibraries(codes []string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	libs, err := e.loadLibraries(codes)
+	if err != nil {
+		return err
+	}
+	e.flushLibraries()
+	return e.installLibraries(libs, false)
+}
+
+// loadRDBFile loads the function libraries stored in the RDB file at path.
+// A missing file holds no libraries, the same as it holds no keys.
+func (e *scriptEngine) loadRDBFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	codes, err := rdbFileFunctions(data)
+	if err != nil || len(codes) == 0 {
+		return err
+	}
+	return e.replaceLibraries(codes)
+}
+
+func (e *scriptEngine) loadLibraries(codes []string) ([]*library, error) {
+	var libs []*library
+	for _, code := range codes {
+		lib, err := e.loadLibrary(code)
+		if err != nil {
+			return nil, err
+		}
+		libs = append(libs, lib)
+	}
+	return libs, nil
+}
+
+// fcall implements FCALL and FCALL_RO function numkeys [key ...] [arg ...].
+// The function gets the keys and the remaining arguments as two tables.
+func (e *scriptEngine) fcall(cl *client, command string, args []string, store *redisStore, config *config, cm *connectionManager) error {
+	numKeys, err := parseNumKeys(args)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f, ok := e.functions[args[0]]
+	if !ok {
+		return errors.New("ERR Function not found")
+	}
+	readOnly := f.hasFlag("no-writes")
+	if command == "fcall_ro" && !readOnly {
+		return errors.New("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	L := e.state
+	callArgs := []lua.LValue{stringsTable(L, args[2:2+numKeys]), stringsTable(L, args[2+numKeys:])}
+	return e.execute(cl, f.name, f.callback, callArgs, readOnly, store, config, cm)
+}
+
+// functionCommand implements FUNCTION LOAD, LIST, DELETE, FLUSH, DUMP,
+// RESTORE and KILL.
+func (e *scriptEngine) functionCommand(args []string, w *replyWriter) error {
+	subcommand := strings.ToLower(args[0])
+	if subcommand == "kill" {
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'function|kill' command")
+		}
+		if err := e.kill(); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch subcommand {
+	case "load":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("ERR wrong number of arguments for 'function|load' command")
+		}
+		replace := false
+		if len(args) == 3 {
+			if !strings.EqualFold(args[1], "replace") {
+				return fmt.Errorf("ERR Unknown option given: %s", args[1])
+			}
+			replace = true
+		}
+		lib, err := e.loadLibrary(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+		if err := e.installLibraries([]*library{lib}, replace); err != nil {
+			return err
+		}
+		w.bulk(lib.name)
+	case "list":
+		return e.listLibraries(args[1:], w)
+	case "delete":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'function|delete' command")
+		}
+		lib, ok := e.libraries[args[1]]
+		if !ok {
+			return errors.New("ERR Library not found")
+		}
+		e.deleteLibrary(lib)
+		w.simpleString("OK")
+	case "flush":
+		if len(args) > 2 || len(args) == 2 && !strings.EqualFold(args[1], "sync") && !strings.EqualFold(args[1], "async") {
+			return errors.New("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+		}
+		e.flushLibraries()
+		w.simpleString("OK")
+	case "dump":
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'function|dump' command")
+		}
+		var codes []string
+		for _, lib := range e.sortedLibraries() {
+			codes = append(codes, lib.code)
+		}
+		w.bulk(dumpFunctions(codes))
+	case "restore":
+		return e.restoreLibraries(args[1:], w)
+	default:
+		return fmt.Errorf("ERR unknown subcommand '%s'. Try FUNCTION HELP.", args[0])
+	}
+	return nil
+}
+
+// listLibraries implements FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE].
+func (e *scriptEngine) listLibraries(args []string, w *replyWriter) error {
+	withCode := false
+	pattern := ""
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "withcode":
+			withCode = true
+		case "libraryname":
+			if i+1 >= len(args) {
+				return errors.New("ERR library name argument was not given")
+			}
+			pattern = args[i+1]
+			i++
+		default:
+			return fmt.Errorf("ERR Unknown argument %s", args[i])
+		}
+	}
+
+	var libs []*library
+	for _, lib := range e.sortedLibraries() {
+		if pattern == "" || globMatch(pattern, lib.name) {
+			libs = append(libs, lib)
+		}
+	}
+	w.arrayHeader(len(libs))
+	for _, lib := range libs {
+		if withCode {
+			w.mapHeader(4)
+		} else {
+			w.mapHeader(3)
+		}
+		w.bulk("library_name")
+		w.bulk(lib.name)
+		w.bulk("engine")
+		w.bulk("LUA")
+		w.bulk("functions")
+		w.arrayHeader(len(lib.functions))
+		for _, f := range lib.functions {
+			w.mapHeader(3)
+			w.bulk("name")
+			w.bulk(f.name)
+			w.bulk("description")
+			if f.description == "" {
+				w.null()
+			} else {
+				w.bulk(f.description)
+			}
+			w.bulk("flags")
+			w.setHeader(len(f.flags))
+			for _, flag := range f.flags {
+				w.bulk(flag)
+			}
+		}
+		if withCode {
+			w.bulk("library_code")
+			w.bulk(lib.code)
+		}
+	}
+	return nil
+}
+
+// restoreLibraries implements FUNCTION RESTORE payload [FLUSH|APPEND|REPLACE].
+// APPEND, the default, fails on any library that already exists.
+func (e *scriptEngine) restoreLibraries(args []string, w *replyWriter) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("ERR wrong number of arguments for 'function|restore' command")
+	}
+	policy := "append"
+	if len(args) == 2 {
+		policy = strings.ToLower(args[1])
+		if policy != "flush" && policy != "append" && policy != "replace" {
+			return errors.New("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		}
+	}
+	data, err := verifyDumpPayload(args[0])
+	if err != nil {
+		return err
+	}
+	codes, err := rdbReadFunctions(data)
+	if err != nil || len(codes) == 0 {
+		return errors.New("ERR given type is not a function")
+	}
+	libs, err := e.loadLibraries(codes)
+	if err != nil {
+		return err
+	}
+	if policy == "flush" {
+		e.flushLibraries()
+	}
+	if err := e.installLibraries(libs, policy == "replace"); err != nil {
+		return err
+	}
+	w.simpleString("OK")
+	return nil
+}
+
+// dumpFunctions serializes libraries the way FUNCTION DUMP does: one RDB
+// function record per library, then the RDB version and a CRC64.
+func dumpFunctions(codes []string) string {
+	buf := rdbAppendFunctions(nil, codes)
+	buf = binary.LittleEndian.AppendUint16(buf, rdbVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, rdbChecksum(buf))
+	return string(buf)
+}
+
+func rdbAppendFunctions(buf []byte, codes []string) []byte {
+	for _, code := range codes {
+		buf = append(buf, rdbOpcodeFunction2)
+		buf = rdbAppendString(buf, code)
+	}
+	return buf
+}
+
+// rdbReadFunctions reads consecutive RDB function records.
+func rdbReadFunctions(data []byte) ([]string, error) {
+	var codes []string
+	for len(data) > 0 {
+		if data[0] != rdbOpcodeFunction2 {
+			return nil, errors.New("not a function record")
+		}
+		code, n, err := rdbReadString(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		data = data[1+n:]
+	}
+	return codes, nil
+}
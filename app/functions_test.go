@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFcallRunsLoadedFunctions(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	code := "#!lua name=lib\n" +
+		"redis.register_function('put', function(keys, args) return redis.call('SET', keys[1], args[1]) end)\n" +
+		"redis.register_function{function_name='peek', callback=function(keys) return redis.call('GET', keys[1]) end, flags={'no-writes'}}"
+	if reply := client.do("FUNCTION", "LOAD", code); reply != "lib" {
+		t.Fatalf("FUNCTION LOAD replied %v", reply)
+	}
+	if reply := client.do("FUNCTION", "LOAD", code); reply != replyError("ERR Library 'lib' already exists") {
+		t.Fatalf("second FUNCTION LOAD replied %v", reply)
+	}
+	if reply := client.do("FCALL", "put", "1", "k", "v"); reply != "OK" {
+		t.Fatalf("FCALL put replied %v", reply)
+	}
+	if reply := client.do("FCALL_RO", "peek", "1", "k"); reply != "v" {
+		t.Fatalf("FCALL_RO peek replied %v", reply)
+	}
+	if reply := client.do("FCALL_RO", "put", "1", "k", "w"); reply != replyError("ERR Can not execute a script with write flag using *_ro command.") {
+		t.Fatalf("FCALL_RO of a writing function replied %v", reply)
+	}
+	if reply := client.do("FUNCTION", "DELETE", "lib"); reply != "OK" {
+		t.Fatalf("FUNCTION DELETE replied %v", reply)
+	}
+	if reply := client.do("FCALL", "put", "1", "k", "v"); reply != replyError("ERR Function not found") {
+		t.Fatalf("FCALL after FUNCTION DELETE replied %v", reply)
+	}
+}
+
+func TestLoadRDBFileFunctions(t *testing.T) {
+	empty, err := hex.DecodeString(emptyRDBHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := []string{
+		"#!lua name=first\nredis.register_function('one', function(keys, args) return 1 end)",
+		"#!lua name=second\nredis.register_function('two', function(keys, args) return 2 end)",
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.rdb")
+	if err := os.WriteFile(path, rdbAddFunctions(empty, codes), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scripts := newScriptEngine()
+	if err := scripts.loadRDBFile(path); err != nil {
+		t.Fatalf("loadRDBFile: %v", err)
+	}
+	for _, name := range []string{"first", "second"} {
+		if _, ok := scripts.libraries[name]; !ok {
+			t.Errorf("library %q was not loaded", name)
+		}
+	}
+
+	// A server started without an RDB file has no libraries to load.
+	if err := newScriptEngine().loadRDBFile(filepath.Join(dir, "missing.rdb")); err != nil {
+		t.Errorf("loadRDBFile of a missing file: %v", err)
+	}
+}
+
+func TestSaveWritesKeysAndFunctions(t *testing.T) {
+	dir := t.TempDir()
+	server := startTestServer(t, "", func(config *config) {
+		config.rdb.dir = dir
+		config.rdb.dbFileName = "dump.rdb"
+	})
+	client := dialTestClient(t, server.addr)
+
+	code := "#!lua name=saved\nredis.register_function('saved', function(keys, args) return 'hi' end)"
+	if reply := client.do("FUNCTION", "LOAD", code); reply != "saved" {
+		t.Fatalf("FUNCTION LOAD replied %v", reply)
+	}
+	client.do("SET", "k", "v")
+	client.do("SET", "n", "12")
+	client.do("SET", "later", "x", "PX", "60000")
+	if reply := client.do("SAVE"); reply != "OK" {
+		t.Fatalf("SAVE replied %v", reply)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "dump.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := len(data) - 8
+	if got := binary.LittleEndian.Uint64(data[end:]); got != rdbChecksum(data[:end]) {
+		t.Fatalf("saved RDB has checksum %#x, want %#x", got, rdbChecksum(data[:end]))
+	}
+	scripts := newScriptEngine()
+	if err := scripts.loadRDBFile(filepath.Join(dir, "dump.rdb")); err != nil {
+		t.Fatalf("loadRDBFile: %v", err)
+	}
+	if _, ok := scripts.libraries["saved"]; !ok {
+		t.Fatal("saved library was not loaded back")
+	}
+
+	// With a dbfilename, GET and KEYS read the saved file.
+	for key, want := range map[string]string{"k": "v", "n": "12", "later": "x"} {
+		if reply := client.do("GET", key); reply != want {
+			t.Errorf("GET %s from the saved file replied %v, want %s", key, reply, want)
+		}
+	}
+	keys, _ := client.do("KEYS", "*").([]any)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(string) < keys[j].(string) })
+	if want := []any{"k", "later", "n"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("KEYS * from the saved file replied %v, want %v", keys, want)
+	}
+}
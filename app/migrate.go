@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultMigrateTimeout = time.Second
+
+// setSlot implements CLUSTER SETSLOT slot MIGRATING|IMPORTING|NODE id and
+// CLUSTER SETSLOT slot STABLE.
+func (cs *clusterState) setSlot(args []string, store *redisStore) error {
+	if len(args) < 2 {
+		return errors.New("ERR wrong number of arguments for 'cluster|setslot' command")
+	}
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return err
+	}
+	action := strings.ToLower(args[1])
+	if action != "stable" && len(args) != 3 {
+		return errors.New("ERR syntax error")
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.myself.replica {
+		return errors.New("ERR Please use SETSLOT only with masters.")
+	}
+	var node *clusterNode
+	if action != "stable" {
+		var ok bool
+		if node, ok = cs.nodes[args[2]]; !ok {
+			return fmt.Errorf("ERR I don't know about node %s", args[2])
+		}
+		if node.replica {
+			return fmt.Errorf("ERR Target node %s is not a master", args[2])
+		}
+	}
+
+	switch action {
+	case "migrating":
+		if cs.slots[slot] != cs.myself {
+			return fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+		}
+		if node == cs.myself {
+			return errors.New("ERR I'm already the owner of the hash slot")
+		}
+		cs.migrating[slot] = node
+	case "importing":
+		if cs.slots[slot] == cs.myself {
+			return fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+		}
+		cs.importing[slot] = node
+	case "stable":
+		cs.migrating[slot] = nil
+		cs.importing[slot] = nil
+	case "node":
+		if cs.slots[slot] == cs.myself && node != cs.myself && len(store.keysInSlot(slot, 1)) > 0 {
+			return fmt.Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		if node != cs.myself {
+			cs.migrating[slot] = nil
+		}
+		cs.slots[slot] = node
+		// The importing side publishes the move under a fresh config epoch
+		// so that its claim wins over the old owner's.
+		if node == cs.myself && cs.importing[slot] != nil {
+			cs.importing[slot] = nil
+			cs.bumpConfigEpoch()
+		}
+	default:
+		return errors.New("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	cs.dropShardChannels()
+	cs.saveConfig()
+	return nil
+}
+
+// bumpConfigEpoch gives this node the greatest config epoch in the cluster
+// without an election. The caller holds cs.mu.
+func (cs *clusterState) bumpConfigEpoch() {
+	maxEpoch := cs.currentEpoch
+	for _, node := range cs.nodes {
+		if node.configEpoch > maxEpoch {
+			maxEpoch = node.configEpoch
+		}
+	}
+	if cs.myself.configEpoch == 0 || cs.myself.configEpoch != maxEpoch {
+		cs.currentEpoch = maxEpoch + 1
+		cs.myself.configEpoch = cs.currentEpoch
+		fmt.Println("New config epoch set to", cs.myself.configEpoch)
+	}
+}
+
+// migrationLabels lists this node's open slot migrations the way CLUSTER
+// NODES shows them.
+func (cs *clusterState) migrationLabels() []string {
+	var labels []string
+	for slot := 0; slot < clusterSlots; slot++ {
+		if target := cs.migrating[slot]; target != nil {
+			labels = append(labels, fmt.Sprintf("[%d->-%s]", slot, target.id))
+		}
+		if source := cs.importing[slot]; source != nil {
+			labels = append(labels, fmt.Sprintf("[%d-<-%s]", slot, source.id))
+		}
+	}
+	return labels
+}
+
+type migrateRequest struct {
+	host     string
+	port     string
+	timeout  time.Duration
+	keys     []string
+	copy     bool
+	replace  bool
+	username string
+	password string
+}
+
+func parseMigrateArgs(args []string) (migrateRequest, error) {
+	request := migrateRequest{}
+	if len(args) < 5 {
+		return request, errors.New("ERR wrong number of arguments for 'migrate' command")
+	}
+	request.host, request.port = args[0], args[1]
+	db, err := strconv.Atoi(args[3])
+	if err != nil {
+		return request, errors.New("ERR value is not an integer or out of range")
+	}
+	// There is only database 0.
+	if db != 0 {
+		return request, errors.New("ERR DB index is out of range")
+	}
+	timeout, err := strconv.Atoi(args[4])
+	if err != nil {
+		return request, errors.New("ERR value is not an integer or out of range")
+	}
+	request.timeout = defaultMigrateTimeout
+	if timeout > 0 {
+		request.timeout = time.Duration(timeout) * time.Millisecond
+	}
+
+	for i := 5; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "copy":
+			request.copy = true
+		case "replace":
+			request.replace = true
+		case "auth":
+			if i+1 >= len(args) {
+				return request, errors.New("ERR syntax error")
+			}
+			request.password = args[i+1]
+			i++
+		case "auth2":
+			if i+2 >= len(args) {
+				return request, errors.New("ERR syntax error")
+			}
+			request.username, request.password = args[i+1], args[i+2]
+			i += 2
+		case "keys":
+			if args[2] != "" {
+				return request, errors.New("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			request.keys = args[i+1:]
+			i = len(args)
+		default:
+			return request, errors.New("ERR syntax error")
+		}
+	}
+	if args[2] != "" {
+		request.keys = []string{args[2]}
+	}
+	if len(request.keys) == 0 {
+		return request, errors.New("ERR syntax error")
+	}
+	return request, nil
+}
+
+// migrate implements MIGRATE host port key|"" db timeout [COPY] [REPLACE]
+// [AUTH password] [AUTH2 username password] [KEYS key ...]. The values are
+// serialized under the store lock, which is released while talking to the
+// target. A key the target accepted is then deleted unless it was changed
+// in the meantime, in which case the newer value is kept.
+func migrate(args []string, store *redisStore, config *config, cm *connectionManager, w *replyWriter) error {
+	request, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	store.mu.RLock()
+	var keys, payloads []string
+	var vals []value
+	var ttls []int64
+	for _, key := range request.keys {
+		val, ok := store.store[key]
+		if !ok || val.expiry != 0 && expired(val.expiry) {
+			continue
+		}
+		ttl := int64(0)
+		if val.expiry != 0 {
+			ttl = max((val.expiry-time.Now().UnixNano())/int64(time.Millisecond), 1)
+		}
+		keys = append(keys, key)
+		vals = append(vals, val)
+		payloads = append(payloads, dumpValue(val.content))
+		ttls = append(ttls, ttl)
+	}
+	store.mu.RUnlock()
+	if len(keys) == 0 {
+		w.simpleString("NOKEY")
+		return nil
+	}
+
+	moved, targetErr, err := sendToTarget(request, config, keys, payloads, ttls)
+
+	// Keys the target accepted before a failure are still moved.
+	var deleted []string
+	if !request.copy && len(moved) > 0 {
+		store.mu.Lock()
+		for _, i := range moved {
+			if current, ok := store.store[keys[i]]; ok && current == vals[i] {
+				store.touch(keys[i])
+				delete(store.store, keys[i])
+				deleted = append(deleted, keys[i])
+			}
+		}
+		store.mu.Unlock()
+	}
+	if len(deleted) > 0 && !config.isReplica() {
+		cm.propagateCommandsToReplica(respGenerator(append([]string{"DEL"}, deleted...)))
+	}
+	if len(deleted) > 0 {
+		store.tracking.invalidate(deleted, nil)
+	}
+	for _, key := range deleted {
+		notifyKeyspaceEvent(config, cm, notifyGeneric, "del", key)
+	}
+
+	if err != nil {
+		fmt.Println("MIGRATE failed:", err)
+		return errors.New("IOERR error or timeout writing to target instance")
+	}
+	if targetErr != "" {
+		return fmt.Errorf("ERR Target instance replied with error: %s", targetErr)
+	}
+	w.simpleString("OK")
+	return nil
+}
+
+// sendToTarget pipelines the RESTORE-ASKING commands to the target and
+// returns the indexes of the keys it accepted, plus the first error it
+// replied with.
+func sendToTarget(request migrateRequest, config *config, keys, payloads []string, ttls []int64) ([]int, string, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(request.host, request.port), request.timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	if isSelf(conn, config) {
+		return nil, "", errors.New("target is this instance")
+	}
+
+	var commands []string
+	if request.password != "" {
+		auth := []string{"AUTH", request.password}
+		if request.username != "" {
+			auth = []string{"AUTH", request.username, request.password}
+		}
+		commands = append(commands, respGenerator(auth))
+	}
+	preamble := len(commands)
+	for i, key := range keys {
+		restore := []string{"RESTORE-ASKING", key, strconv.FormatInt(ttls[i], 10), payloads[i]}
+		if request.replace {
+			restore = append(restore, "REPLACE")
+		}
+		commands = append(commands, respGenerator(restore))
+	}
+
+	conn.SetDeadline(time.Now().Add(request.timeout))
+	if _, err := conn.Write([]byte(strings.Join(commands, ""))); err != nil {
+		return nil, "", err
+	}
+
+	reader := bufio.NewReader(conn)
+	var moved []int
+	targetErr := ""
+	for i := range commands {
+		conn.SetDeadline(time.Now().Add(request.timeout))
+		reply, err := parseRESPReply(reader)
+		if err != nil {
+			return moved, targetErr, err
+		}
+		replyErr, failed := reply.(respError)
+		if i < preamble {
+			if failed {
+				return nil, string(replyErr), nil
+			}
+			continue
+		}
+		if failed {
+			if targetErr == "" {
+				targetErr = string(replyErr)
+			}
+			continue
+		}
+		moved = append(moved, i-preamble)
+	}
+	return moved, targetErr, nil
+}
+
+// isSelf reports whether conn leads back to this server, which would
+// otherwise restore the keys onto themselves and then delete them.
+func isSelf(conn net.Conn, config *config) bool {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	return remote.Port == config.server.port && remote.IP.Equal(local.IP)
+}
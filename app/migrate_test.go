@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// migrateArgs builds MIGRATE arguments for keys to target.
+func migrateArgs(target string, keys []string, options ...string) []string {
+	host, port, _ := net.SplitHostPort(target)
+	args := append([]string{host, port, "", "0", "1000"}, options...)
+	return append(append(args, "KEYS"), keys...)
+}
+
+func TestMigrateMovesKeys(t *testing.T) {
+	source := startTestServer(t, "")
+	target := startTestServer(t, "")
+	sourceClient := dialTestClient(t, source.addr)
+	targetClient := dialTestClient(t, target.addr)
+	sourceClient.do("SET", "plain", "one")
+	sourceClient.do("SET", "volatile", "two", "PX", "60000")
+
+	args := append([]string{"MIGRATE"}, migrateArgs(target.addr, []string{"plain", "volatile", "missing"})...)
+	if reply := sourceClient.do(args...); reply != "OK" {
+		t.Fatalf("MIGRATE replied %v", reply)
+	}
+	for key, want := range map[string]string{"plain": "one", "volatile": "two"} {
+		if reply := targetClient.do("GET", key); reply != want {
+			t.Errorf("target has %s=%v, want %s", key, reply, want)
+		}
+		if reply := sourceClient.do("GET", key); reply != nil {
+			t.Errorf("source still has %s=%v", key, reply)
+		}
+	}
+
+	sourceClient.do("SET", "copied", "three")
+	args = append([]string{"MIGRATE"}, migrateArgs(target.addr, []string{"copied"}, "COPY")...)
+	if reply := sourceClient.do(args...); reply != "OK" {
+		t.Fatalf("MIGRATE COPY replied %v", reply)
+	}
+	if reply := sourceClient.do("GET", "copied"); reply != "three" {
+		t.Fatalf("MIGRATE COPY removed the key: GET replied %v", reply)
+	}
+}
+
+func TestMigrateDeletesAcceptedKeysWhenTargetRefusesSome(t *testing.T) {
+	source := startTestServer(t, "")
+	target := startTestServer(t, "")
+	dialTestClient(t, target.addr).do("SET", "taken", "theirs")
+	sourceClient := dialTestClient(t, source.addr)
+	sourceClient.do("SET", "taken", "ours")
+	sourceClient.do("SET", "free", "ours")
+
+	args := append([]string{"MIGRATE"}, migrateArgs(target.addr, []string{"taken", "free"})...)
+	if reply, _ := sourceClient.do(args...).(replyError); !strings.Contains(string(reply), "BUSYKEY") {
+		t.Fatalf("MIGRATE onto an existing key replied %q, want the target's BUSYKEY error", reply)
+	}
+	if reply := sourceClient.do("GET", "free"); reply != nil {
+		t.Fatalf("accepted key is still on the source: GET replied %v", reply)
+	}
+	if reply := sourceClient.do("GET", "taken"); reply != "ours" {
+		t.Fatalf("refused key was lost: GET replied %v", reply)
+	}
+}
+
+func TestMigrateDeletesAcceptedKeysWhenTheTargetDies(t *testing.T) {
+	// The target accepts the first RESTORE and then goes away.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 4096))
+		conn.Write([]byte("+OK\r\n"))
+	}()
+
+	source := startTestServer(t, "")
+	client := dialTestClient(t, source.addr)
+	client.do("SET", "first", "1")
+	client.do("SET", "second", "2")
+
+	args := append([]string{"MIGRATE"}, migrateArgs(listener.Addr().String(), []string{"first", "second"})...)
+	if reply, _ := client.do(args...).(replyError); !strings.HasPrefix(string(reply), "IOERR ") {
+		t.Fatalf("MIGRATE to a dying target replied %q, want IOERR", reply)
+	}
+	if reply := client.do("GET", "first"); reply != nil {
+		t.Fatalf("key the target accepted is still on the source: GET replied %v", reply)
+	}
+	if reply := client.do("GET", "second"); reply != "2" {
+		t.Fatalf("key the target never accepted was lost: GET replied %v", reply)
+	}
+}
+
+func TestMigrateToItselfFails(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	client.do("SET", "key", "value")
+
+	args := append([]string{"MIGRATE"}, migrateArgs(server.addr, []string{"key"}, "REPLACE")...)
+	if reply, _ := client.do(args...).(replyError); !strings.HasPrefix(string(reply), "IOERR ") {
+		t.Fatalf("MIGRATE to itself replied %q, want IOERR", reply)
+	}
+	if reply := client.do("GET", "key"); reply != "value" {
+		t.Fatalf("MIGRATE to itself lost the key: GET replied %v", reply)
+	}
+}
+
+func TestMigrateRejectsOtherDatabases(t *testing.T) {
+	if _, err := parseMigrateArgs([]string{"127.0.0.1", "6379", "key", "1", "1000"}); err == nil || err.Error() != "ERR DB index is out of range" {
+		t.Fatalf("parseMigrateArgs with db 1 returned %v", err)
+	}
+}
+
+func TestAskRedirectDuringSlotMigration(t *testing.T) {
+	source := startTestClusterNode(t)
+	target := startTestClusterNode(t)
+	sourceClient := dialTestClient(t, source.addr)
+	targetClient := dialTestClient(t, target.addr)
+	sourceClient.do("CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+	host, port, _ := net.SplitHostPort(target.addr)
+	sourceClient.do("CLUSTER", "MEET", host, port)
+	waitFor(t, "the nodes to meet", func() bool {
+		info, _ := targetClient.do("CLUSTER", "INFO").(string)
+		return strings.Contains(info, "cluster_state:ok")
+	})
+
+	sourceClient.do("SET", "foo", "bar")
+	slot := "12182" // foo
+	sourceID := source.config.cluster.myself.id
+	targetID := target.config.cluster.myself.id
+	if reply := targetClient.do("CLUSTER", "SETSLOT", slot, "IMPORTING", sourceID); reply != "OK" {
+		t.Fatalf("SETSLOT IMPORTING replied %v", reply)
+	}
+	if reply := sourceClient.do("CLUSTER", "SETSLOT", slot, "MIGRATING", targetID); reply != "OK" {
+		t.Fatalf("SETSLOT MIGRATING replied %v", reply)
+	}
+
+	// Keys not moved yet are still served by the source.
+	if reply := sourceClient.do("GET", "foo"); reply != "bar" {
+		t.Fatalf("GET of a key not moved yet replied %v", reply)
+	}
+	args := append([]string{"MIGRATE"}, migrateArgs(target.addr, []string{"foo"})...)
+	if reply := sourceClient.do(args...); reply != "OK" {
+		t.Fatalf("MIGRATE replied %v", reply)
+	}
+
+	ask := replyError("ASK " + slot + " " + target.addr)
+	if reply := sourceClient.do("GET", "foo"); reply != ask {
+		t.Fatalf("GET of a moved key replied %v, want %v", reply, ask)
+	}
+	if reply := targetClient.do("GET", "foo"); reply != replyError("MOVED "+slot+" "+source.addr) {
+		t.Fatalf("GET on the importing node without ASKING replied %v", reply)
+	}
+	targetClient.do("ASKING")
+	if reply := targetClient.do("GET", "foo"); reply != "bar" {
+		t.Fatalf("GET after ASKING replied %v", reply)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type queuedCommand struct {
+	name string
+	args []string
+}
+
+// transactionCommands control a transaction, so they run at once instead of
+// being queued after MULTI.
+var transactionCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+}
+
+// noMultiCommands wait on other connections or hand this one over, so they
+// can't be part of a transaction. For the same reason they run without the
+// store's exec lock.
+var noMultiCommands = map[string]bool{
+	"psync":     true,
+	"replicaof": true,
+	"slaveof":   true,
+	"failover":  true,
+}
+
+// commandArity is the number of arguments each command takes, counting the
+// command name. A negative arity is a minimum. Transactions use it to refuse
+// malformed commands when they are queued rather than when EXEC runs them.
+var commandArity = map[string]int{
+	"replconf":       -1,
+	"psync":          -3,
+	"subscribe":      -2,
+	"unsubscribe":    -1,
+	"psubscribe":     -2,
+	"punsubscribe":   -1,
+	"ssubscribe":     -2,
+	"sunsubscribe":   -1,
+	"publish":        3,
+	"spublish":       3,
+	"pubsub":         -2,
+	"quit":           -1,
+	"failover":       -1,
+	"cluster":        -2,
+	"asking":         1,
+	"migrate":        -6,
+	"dump":           2,
+	"save":           1,
+	"restore":        -4,
+	"restore-asking": -4,
+	"del":            -2,
+	"replicaof":      3,
+	"slaveof":        3,
+	"wait":           3,
+	"ping":           -1,
+	"echo":           2,
+	"info":           -1,
+	"hello":          -1,
+	"auth":           -2,
+	"acl":            -2,
+	"client":         -2,
+	"set":            -3,
+	"get":            2,
+	"config":         -2,
+	"keys":           2,
+	"multi":          1,
+	"exec":           1,
+	"discard":        1,
+	"watch":          -2,
+	"unwatch":        1,
+	"eval":           -3,
+	"evalsha":        -3,
+	"script":         -2,
+	"function":       -2,
+	"fcall":          -3,
+	"fcall_ro":       -3,
+}
+
+// exclusiveCommands run with the store's exec lock held for writing, so that
+// no other client's command interleaves with the ones they run. EXEC takes
+// it the same way once the transaction is known to run.
+var exclusiveCommands = map[string]bool{
+	"eval":     true,
+	"evalsha":  true,
+	"fcall":    true,
+	"fcall_ro": true,
+}
+
+func arityOK(command string, args []string) bool {
+	arity := commandArity[command]
+	if arity < 0 {
+		return len(args)+1 >= -arity
+	}
+	return len(args)+1 == arity
+}
+
+func multi(cl *client) error {
+	if cl.inMulti {
+		return errors.New("ERR MULTI calls can not be nested")
+	}
+	cl.inMulti = true
+	cl.out.simpleString("OK")
+	return nil
+}
+
+func discard(cl *client, store *redisStore) error {
+	if !cl.inMulti {
+		return errors.New("ERR DISCARD without MULTI")
+	}
+	cl.resetMulti()
+	unwatchKeys(cl, store)
+	cl.out.simpleString("OK")
+	return nil
+}
+
+// queueCommand queues a command sent after MULTI. A command that would fail
+// before it even ran marks the transaction so that EXEC refuses it.
+func queueCommand(cl *client, command string, args []string, store *redisStore, config *config, cm *connectionManager) error {
+	err := func() error {
+		if _, ok := commandArity[command]; !ok {
+			return unknownCommand(command, args)
+		}
+		if !arityOK(command, args) {
+			return fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+		}
+		if noMultiCommands[command] {
+			return errors.New("ERR Command not allowed inside a transaction")
+		}
+		return checkCommand(cl, command, args, store, config, cm)
+	}()
+	if err != nil {
+		cl.multiAborted = true
+		return err
+	}
+	cl.multiQueue = append(cl.multiQueue, queuedCommand{name: command, args: args})
+	cl.out.simpleString("QUEUED")
+	return nil
+}
+
+// exec runs the queued commands while holding the store's exec lock, so no
+// other client's command runs in between. Their writes reach the replicas as
+// a single MULTI/EXEC block. If a WATCHed key changed, nothing runs and the
+// reply is a null array.
+func exec(cl *client, store *redisStore, config *config, cm *connectionManager) error {
+	if !cl.inMulti {
+		return errors.New("ERR EXEC without MULTI")
+	}
+	queue, aborted := cl.multiQueue, cl.multiAborted
+	cl.resetMulti()
+	defer unwatchKeys(cl, store)
+	if aborted {
+		return errors.New("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	// Writes queued before a failover started are judged by the role the
+	// server ended up with, as single writes are.
+	if !cl.isMaster && queuedWrites(queue) {
+		config.server.failover.waitForWrites()
+		if config.isReplica() && config.server.replicaReadOnly {
+			return errors.New("EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.")
+		}
+		if !config.isReplica() && !enoughGoodReplicas(config, cm) {
+			return errors.New("EXECABORT Transaction discarded because of: NOREPLICAS Not enough good replicas to write.")
+		}
+	}
+
+	unlock, err := lockExec(cl, true, store, config)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if store.changedSince(cl.watched) {
+		cl.out.nullArray()
+		return nil
+	}
+	cm.beginTransaction()
+	defer cm.endTransaction()
+
+	cl.out.arrayHeader(len(queue))
+	for _, queued := range queue {
+		if err := runCommand(cl, queued.name, queued.args, store, config, cm); err != nil {
+			cl.out.errorReply(err.Error())
+		}
+	}
+	return nil
+}
+
+func queuedWrites(queue []queuedCommand) bool {
+	for _, queued := range queue {
+		if writeCommands[queued.name] {
+			return true
+		}
+	}
+	return false
+}
+
+// errCommandCancelled is returned for a command abandoned while it waited
+// for the exec lock.
+var errCommandCancelled = errors.New("ERR command cancelled")
+
+// execLock is a readers-writer lock that grants waiters in arrival order,
+// so a steady stream of commands can't starve EXEC, and lets a waiter give
+// up when its cancel channel is closed.
+type execLock struct {
+	mu      sync.Mutex
+	readers int
+	writer  bool
+	waiters []*execWaiter
+}
+
+type execWaiter struct {
+	exclusive bool
+	granted   chan struct{}
+}
+
+// lock takes the lock, shared or exclusive, and reports whether it did: it
+// gives up if cancel is closed first. A nil cancel waits for good.
+func (l *execLock) lock(exclusive bool, cancel <-chan struct{}) bool {
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.free(exclusive) {
+		l.take(exclusive)
+		l.mu.Unlock()
+		return true
+	}
+	waiter := &execWaiter{exclusive: exclusive, granted: make(chan struct{})}
+	l.waiters = append(l.waiters, waiter)
+	l.mu.Unlock()
+
+	select {
+	case <-waiter.granted:
+		return true
+	case <-cancel:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-waiter.granted:
+		// Granted while giving up: hand it on.
+		l.release(exclusive)
+	default:
+		for i, w := range l.waiters {
+			if w == waiter {
+				l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	l.grant()
+	return false
+}
+
+func (l *execLock) unlock(exclusive bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.release(exclusive)
+	l.grant()
+}
+
+func (l *execLock) free(exclusive bool) bool {
+	return !l.writer && (!exclusive || l.readers == 0)
+}
+
+func (l *execLock) take(exclusive bool) {
+	if exclusive {
+		l.writer = true
+	} else {
+		l.readers++
+	}
+}
+
+func (l *execLock) release(exclusive bool) {
+	if exclusive {
+		l.writer = false
+	} else {
+		l.readers--
+	}
+}
+
+// grant wakes the waiters at the head of the queue that can now proceed.
+func (l *execLock) grant() {
+	for len(l.waiters) > 0 && l.free(l.waiters[0].exclusive) {
+		waiter := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.take(waiter.exclusive)
+		close(waiter.granted)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecRunsTheQueuedCommands(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	if reply := client.do("MULTI"); reply != "OK" {
+		t.Fatalf("MULTI replied %v", reply)
+	}
+	for _, args := range [][]string{{"SET", "k", "v"}, {"GET", "k"}, {"SET", "n", "1", "PX", "soon"}} {
+		if reply := client.do(args...); reply != "QUEUED" {
+			t.Fatalf("%v after MULTI replied %v", args, reply)
+		}
+	}
+	// Errors at EXEC time are reported in place, without rolling back.
+	reply := client.do("EXEC")
+	want := []any{"OK", "v", replyError("ERR value is not an integer or out of range")}
+	if !reflect.DeepEqual(reply, want) {
+		t.Fatalf("EXEC replied %v, want %v", reply, want)
+	}
+	if reply := client.do("GET", "k"); reply != "v" {
+		t.Fatalf("GET after EXEC replied %v", reply)
+	}
+
+	client.do("MULTI")
+	client.do("SET", "k", "discarded")
+	if reply := client.do("DISCARD"); reply != "OK" {
+		t.Fatalf("DISCARD replied %v", reply)
+	}
+	if reply := client.do("GET", "k"); reply != "v" {
+		t.Fatalf("a discarded SET ran: GET replied %v", reply)
+	}
+
+	for args, want := range map[string]replyError{
+		"EXEC":    "ERR EXEC without MULTI",
+		"DISCARD": "ERR DISCARD without MULTI",
+	} {
+		if reply := client.do(args); reply != want {
+			t.Errorf("%s replied %v, want %v", args, reply, want)
+		}
+	}
+	client.do("MULTI")
+	if reply := client.do("MULTI"); reply != replyError("ERR MULTI calls can not be nested") {
+		t.Fatalf("nested MULTI replied %v", reply)
+	}
+	if reply := client.do("EXEC"); !reflect.DeepEqual(reply, []any{}) {
+		t.Fatalf("empty EXEC replied %v", reply)
+	}
+}
+
+func TestExecAbortsAfterQueueingErrors(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	for _, bad := range [][]string{{"NOPE"}, {"GET"}, {"REPLICAOF", "NO", "ONE"}} {
+		client.do("MULTI")
+		client.do("SET", "k", "v")
+		if _, ok := client.do(bad...).(replyError); !ok {
+			t.Fatalf("%v after MULTI was queued", bad)
+		}
+		if reply := client.do("EXEC"); reply != replyError("EXECABORT Transaction discarded because of previous errors.") {
+			t.Fatalf("EXEC after queueing %v replied %v", bad, reply)
+		}
+		if reply := client.do("GET", "k"); reply != nil {
+			t.Fatalf("aborted transaction ran its SET: GET replied %v", reply)
+		}
+	}
+}
+
+func TestExecIsAtomic(t *testing.T) {
+	server := startTestServer(t, "")
+	writer := dialTestClient(t, server.addr)
+	reader := dialTestClient(t, server.addr)
+
+	// The reader must never see one key updated without the other.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			reader.send("MULTI")
+			reader.send("GET", "a")
+			reader.send("GET", "b")
+			reader.send("EXEC")
+			reader.read()
+			reader.read()
+			reader.read()
+			values, _ := reader.read().([]any)
+			if len(values) != 2 || values[0] != values[1] {
+				t.Errorf("EXEC saw a and b as %v", values)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		value := strconv.Itoa(i)
+		writer.send("MULTI")
+		writer.send("SET", "a", value)
+		writer.send("SET", "b", value)
+		writer.send("EXEC")
+		for j := 0; j < 4; j++ {
+			writer.read()
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestExecReachesReplicasAsOneBlock(t *testing.T) {
+	master := startTestServer(t, "")
+	proxy := startRecordingProxy(t, master.addr)
+	replica := startTestServer(t, masterDetailsOf(proxy.addr))
+	waitFor(t, "the replica link", replica.config.server.link.isUp)
+
+	client := dialTestClient(t, master.addr)
+	client.do("MULTI")
+	client.do("SET", "a", "1")
+	client.do("GET", "a")
+	client.do("SET", "b", "2")
+	client.do("EXEC")
+	waitFor(t, "the transaction to reach the replica", func() bool {
+		return dialTestClient(t, replica.addr).do("GET", "b") == "2"
+	})
+
+	_, _, stream := proxy.stream(t)
+	want := respGenerator([]string{"MULTI"}) + respGenerator([]string{"set", "a", "1"}) +
+		respGenerator([]string{"set", "b", "2"}) + respGenerator([]string{"EXEC"})
+	if !bytes.Contains(stream, []byte(want)) {
+		t.Fatalf("replication stream %q does not hold the block %q", stream, want)
+	}
+}
+
+func TestSubReplicaStreamIsUnchangedByLocalExec(t *testing.T) {
+	master := startTestServer(t, "")
+	upper := startRecordingProxy(t, master.addr)
+	replica := startTestServer(t, masterDetailsOf(upper.addr))
+	lower := startRecordingProxy(t, replica.addr)
+	subReplica := startTestServer(t, masterDetailsOf(lower.addr))
+	masterReplid, _ := master.config.server.repl.ids()
+	waitFor(t, "the sub-replica to sync with the master's history", func() bool {
+		replid, _ := subReplica.config.server.repl.ids()
+		return replid == masterReplid && subReplica.config.server.link.isUp()
+	})
+
+	// The middle replica is in the middle of a local EXEC, which holds the
+	// exec lock and collects its own writes, while the master writes.
+	replica.store.exec.lock(true, nil)
+	replica.cm.beginTransaction()
+	// The replica relays the write before it waits to apply it.
+	client := dialTestClient(t, master.addr)
+	client.do("SET", "k", "during")
+	waitFor(t, "the write to reach the sub-replica during EXEC", func() bool {
+		return dialTestClient(t, subReplica.addr).do("GET", "k") == "during"
+	})
+	replica.cm.endTransaction()
+	replica.store.exec.unlock(true)
+	client.do("SET", "k", "after")
+	waitFor(t, "the replica to catch up", func() bool {
+		return dialTestClient(t, subReplica.addr).do("GET", "k") == "after" &&
+			dialTestClient(t, replica.addr).do("GET", "k") == "after"
+	})
+
+	_, _, relayed := lower.stream(t)
+	_, _, received := upper.stream(t)
+	if !bytes.Equal(relayed, received) {
+		t.Fatalf("replica relayed %d bytes that differ from the %d it received", len(relayed), len(received))
+	}
+}
+
+func TestExecRechecksWritesAfterAFailover(t *testing.T) {
+	master := startTestServer(t, "")
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+
+	client := dialTestClient(t, master.addr)
+	client.do("MULTI")
+	if reply := client.do("SET", "k", "v"); reply != "QUEUED" {
+		t.Fatalf("SET after MULTI replied %v", reply)
+	}
+	if reply := dialTestClient(t, master.addr).do("FAILOVER"); reply != "OK" {
+		t.Fatalf("FAILOVER replied %v", reply)
+	}
+	waitFor(t, "the roles to swap", func() bool {
+		return role(t, dialTestClient(t, replica.addr)) == "master"
+	})
+
+	want := replyError("EXECABORT Transaction discarded because of: READONLY You can't write against a read only replica.")
+	if reply := client.do("EXEC"); reply != want {
+		t.Fatalf("EXEC on the demoted master replied %v, want %v", reply, want)
+	}
+}
+
+func TestExecLockGrantsInOrder(t *testing.T) {
+	var l execLock
+	if !l.lock(false, nil) {
+		t.Fatal("first reader did not get the lock")
+	}
+
+	// A writer waits for the reader, and a later reader waits behind it.
+	writer := make(chan bool)
+	go func() { writer <- l.lock(true, nil) }()
+	waitFor(t, "the writer to queue", func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.waiters) == 1
+	})
+	cancel := make(chan struct{})
+	reader := make(chan bool)
+	go func() { reader <- l.lock(false, cancel) }()
+	waitFor(t, "the reader to queue", func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.waiters) == 2
+	})
+
+	close(cancel)
+	if <-reader {
+		t.Fatal("cancelled reader got the lock")
+	}
+	l.unlock(false)
+	if !<-writer {
+		t.Fatal("writer did not get the lock")
+	}
+	if l.lock(false, closedChannel()) {
+		t.Fatal("reader got the lock while the writer held it")
+	}
+	l.unlock(true)
+	if !l.lock(true, nil) {
+		t.Fatal("lock is not free after everyone left")
+	}
+}
+
+func closedChannel() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func TestStoppingTheMasterLinkDoesNotWaitBehindExec(t *testing.T) {
+	master := startTestServer(t, "")
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	waitFor(t, "the replica link", replica.config.server.link.isUp)
+
+	// A command holding the exec lock (as CLUSTER REPLICATE does) is about
+	// to stop the link, an EXEC waits for it, and a write from the master
+	// queues behind the EXEC.
+	lock := &replica.store.exec
+	lock.lock(false, nil)
+	go func() {
+		lock.lock(true, nil)
+		lock.unlock(true)
+	}()
+	queued := func(n int) func() bool {
+		return func() bool {
+			lock.mu.Lock()
+			defer lock.mu.Unlock()
+			return len(lock.waiters) == n
+		}
+	}
+	waitFor(t, "EXEC to wait", queued(1))
+	dialTestClient(t, master.addr).do("SET", "k", "v")
+	waitFor(t, "the master's write to wait", queued(2))
+
+	stopped := make(chan struct{})
+	go func() {
+		unsetMaster(replica.config, replica.cm)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the master link deadlocked")
+	}
+	lock.unlock(false)
+}
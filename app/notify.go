@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Keyspace notification classes, as selected by notify-keyspace-events.
+// notifyKeyspace and notifyKeyevent choose the channels events go to, the
+// others which events are sent at all.
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZset
+	notifyExpired
+	notifyEvicted
+	notifyStream
+	notifyKeyMiss
+	notifyNew
+
+	// notifyAll is what the A flag stands for. Key misses and new keys are
+	// left out, as they must be asked for explicitly.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+// keyspaceEventFlags maps the notify-keyspace-events characters to classes,
+// in the order CONFIG GET lists them.
+var keyspaceEventFlags = []struct {
+	flag  byte
+	class int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'K', notifyKeyspace},
+	{'E', notifyKeyevent},
+	{'m', notifyKeyMiss},
+	{'n', notifyNew},
+}
+
+// parseKeyspaceEvents reads a notify-keyspace-events value such as "Ex" or
+// "KA". The empty string turns notifications off.
+func parseKeyspaceEvents(value string) (int, error) {
+	classes := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			classes |= notifyAll
+			continue
+		}
+		known := false
+		for _, f := range keyspaceEventFlags {
+			if f.flag == value[i] {
+				classes |= f.class
+				known = true
+				break
+			}
+		}
+		if !known {
+			return 0, fmt.Errorf("invalid event class character '%c'", value[i])
+		}
+	}
+	return classes, nil
+}
+
+// keyspaceEventsString is the inverse of parseKeyspaceEvents, using A when
+// every class it covers is selected.
+func keyspaceEventsString(classes int) string {
+	var b strings.Builder
+	if classes&notifyAll == notifyAll {
+		b.WriteByte('A')
+	}
+	for _, f := range keyspaceEventFlags {
+		if classes&notifyAll == notifyAll && f.class&notifyAll != 0 {
+			continue
+		}
+		if classes&f.class != 0 {
+			b.WriteByte(f.flag)
+		}
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes event on key over pub/sub when its class is
+// enabled: the event name to __keyspace@0__:<key> and the key name to
+// __keyevent@0__:<event>, as selected by the K and E flags.
+func notifyKeyspaceEvent(config *config, cm *connectionManager, class int, event, key string) {
+	classes := int(config.server.notifyKeyspaceEvents.Load())
+	if classes&class == 0 {
+		return
+	}
+	if classes&notifyKeyspace != 0 {
+		cm.publish("__keyspace@0__:"+key, event)
+	}
+	if classes&notifyKeyevent != 0 {
+		cm.publish("__keyevent@0__:"+event, key)
+	}
+}
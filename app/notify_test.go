@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestKeyspaceEventFlags(t *testing.T) {
+	for value, want := range map[string]string{
+		"":      "",
+		"Ex":    "xE",
+		"KEA":   "AKE",
+		"Kg$xn": "g$xKn",
+		"AKEmn": "AKEmn",
+	} {
+		classes, err := parseKeyspaceEvents(value)
+		if err != nil {
+			t.Fatalf("parseKeyspaceEvents(%q): %v", value, err)
+		}
+		if got := keyspaceEventsString(classes); got != want {
+			t.Errorf("notify-keyspace-events %q reads back as %q, want %q", value, got, want)
+		}
+	}
+	if _, err := parseKeyspaceEvents("KZ"); err == nil {
+		t.Fatal("parseKeyspaceEvents accepted an unknown class")
+	}
+}
+
+func TestConfigSetsNotifyKeyspaceEvents(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	if reply := client.do("CONFIG", "SET", "notify-keyspace-events", "KEA"); reply != "OK" {
+		t.Fatalf("CONFIG SET replied %v", reply)
+	}
+	if reply := client.do("CONFIG", "GET", "notify-keyspace-events"); !reflect.DeepEqual(reply, []any{"notify-keyspace-events", "AKE"}) {
+		t.Fatalf("CONFIG GET replied %v", reply)
+	}
+	if _, ok := client.do("CONFIG", "SET", "notify-keyspace-events", "Q").(replyError); !ok {
+		t.Fatal("CONFIG SET accepted an unknown class")
+	}
+	if _, ok := client.do("CONFIG", "SET", "maxmemory", "1").(replyError); !ok {
+		t.Fatal("CONFIG SET accepted an unknown parameter")
+	}
+	if reply := client.do("CONFIG", "GET", "maxmemory"); !reflect.DeepEqual(reply, []any{}) {
+		t.Fatalf("CONFIG GET of an unknown parameter replied %v", reply)
+	}
+}
+
+func TestKeyspaceEventsArePublished(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	subscriber := dialTestClient(t, server.addr)
+
+	client.do("CONFIG", "SET", "notify-keyspace-events", "KEA")
+	subscriber.do("PSUBSCRIBE", "__key*__:*")
+	expect := func(what string, events ...[2]string) {
+		t.Helper()
+		for _, event := range events {
+			want := []any{"pmessage", "__key*__:*", event[0], event[1]}
+			if reply := subscriber.read(); !reflect.DeepEqual(reply, want) {
+				t.Fatalf("%s published %v, want %v", what, reply, want)
+			}
+		}
+	}
+
+	client.do("SET", "k", "v")
+	expect("SET", [2]string{"__keyspace@0__:k", "set"}, [2]string{"__keyevent@0__:set", "k"})
+	client.do("DEL", "k", "missing")
+	expect("DEL", [2]string{"__keyspace@0__:k", "del"}, [2]string{"__keyevent@0__:del", "k"})
+
+	// New keys and misses are only sent when asked for.
+	client.do("CONFIG", "SET", "notify-keyspace-events", "Enm")
+	client.do("GET", "k")
+	expect("a GET miss", [2]string{"__keyevent@0__:keymiss", "k"})
+	client.do("SET", "k", "v")
+	expect("SET of a new key", [2]string{"__keyevent@0__:new", "k"})
+	client.do("SET", "k", "again")
+	client.do("CONFIG", "SET", "notify-keyspace-events", "Eg")
+	client.do("DEL", "k")
+	expect("DEL after an overwrite", [2]string{"__keyevent@0__:del", "k"})
+}
+
+func TestExpiredKeysPublishExpiredEvents(t *testing.T) {
+	master := startTestServer(t, "", func(config *config) { config.server.notifyKeyspaceEvents.Store(notifyKeyevent | notifyExpired) })
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+	client := dialTestClient(t, master.addr)
+	subscriber := dialTestClient(t, master.addr)
+	subscriber.do("SUBSCRIBE", "__keyevent@0__:expired")
+
+	// A read finds the key expired.
+	client.do("SET", "read", "v", "PX", "1")
+	waitFor(t, "the key to expire", func() bool { return client.do("GET", "read") == nil })
+	if reply := subscriber.read(); !reflect.DeepEqual(reply, []any{"message", "__keyevent@0__:expired", "read"}) {
+		t.Fatalf("expired read published %v", reply)
+	}
+
+	// Nobody reads this one, so the expiry cycle has to find it.
+	client.do("SET", "idle", "v", "PX", "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go activeExpireCycle(ctx, master.store, master.config, master.cm)
+	if reply := subscriber.read(); !reflect.DeepEqual(reply, []any{"message", "__keyevent@0__:expired", "idle"}) {
+		t.Fatalf("expiry cycle published %v", reply)
+	}
+	waitFor(t, "the replica to delete the expired keys", func() bool {
+		replica.store.mu.RLock()
+		defer replica.store.mu.RUnlock()
+		return len(replica.store.store) == 0
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
@@ -10,70 +11,349 @@ import (
 
 // Example input - *2\r\n$4\r\nECHO\r\n$3\r\nhey\r\n
 func parseRESPString(reader *bufio.Reader) (string, []string, error) {
+	return parseRESP(reader, nil)
+}
+
+// parseRESPStringRaw also returns the exact bytes the command occupied on the
+// wire, which a replica relays verbatim to its own replicas.
+func parseRESPStringRaw(reader *bufio.Reader) (string, []string, []byte, error) {
+	var raw []byte
+	command, args, err := parseRESP(reader, &raw)
+	return command, args, raw, err
+}
 
-	header, _, err := reader.ReadLine()
+// Limits on incoming requests, set from the command line.
+var (
+	protoMaxBulkLen   = 512 * 1024 * 1024
+	protoMaxMultibulk = 1024 * 1024
+	protoMaxInlineLen = 64 * 1024
+)
+
+// protocolError is a malformed request. The client gets an error reply and
+// is disconnected, since the rest of its stream can't be trusted.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readLine reads a line without its line ending, refusing lines longer than
+// limit. A line that fits in the reader's buffer is returned without a copy,
+// so it is only valid until the next read.
+func readLine(reader *bufio.Reader, limit int, tooLong string) ([]byte, error) {
+	chunk, isPrefix, err := reader.ReadLine()
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
-
-	if len(header) == 0 || header[0] != '*' {
-		return "", nil, fmt.Errorf("invalid RESP header")
+	if !isPrefix {
+		if len(chunk) > limit {
+			return nil, protocolError(tooLong)
+		}
+		return chunk, nil
+	}
+	line := append([]byte(nil), chunk...)
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return nil, protocolError(tooLong)
+		}
+		if !isPrefix {
+			return line, nil
+		}
 	}
+}
 
-	argSize, err := parseRESPInteger(string(header[1:]), 1, "invalid array size: %q (must be >= 1)")
-	if err != nil {
-		return "", nil, err
+func parseRESP(reader *bufio.Reader, raw *[]byte) (string, []string, error) {
+	var argSize int
+	// Blank lines and empty or null multibulks are skipped, as Redis does.
+	for argSize < 1 {
+		header, err := readLine(reader, protoMaxInlineLen, "too big inline request")
+		if err != nil {
+			return "", nil, err
+		}
+		record(raw, header, crlf)
+		if len(header) == 0 {
+			continue
+		}
+
+		if header[0] != '*' {
+			return parseInline(header)
+		}
+
+		var ok bool
+		argSize, ok = parseLength(header[1:])
+		if !ok || argSize > protoMaxMultibulk {
+			return "", nil, protocolError("invalid multibulk length")
+		}
 	}
 
 	var command string
-	var args []string
+	args := make([]string, 0, min(argSize-1, 16))
 
 	for i := 0; i < argSize; i++ {
-		line, _, err := reader.ReadLine()
+		line, err := readLine(reader, protoMaxInlineLen, "too big bulk count string")
 		if err != nil {
 			return "", nil, err
 		}
+		record(raw, line, crlf)
 
 		if len(line) == 0 || line[0] != '$' {
-			return "", nil, fmt.Errorf("invalid bulk string header")
+			return "", nil, protocolError(fmt.Sprintf("expected '$', got '%s'", firstByte(line)))
 		}
 
-		strLength, err := parseRESPInteger(string(line[1:]), 0, "invalid string length: %q (must be >= 0)")
-		if err != nil {
-			return "", nil, err
+		strLength, ok := parseLength(line[1:])
+		if !ok || strLength < 0 || strLength > protoMaxBulkLen {
+			return "", nil, protocolError("invalid bulk length")
 		}
 
-		stringBytes := make([]byte, strLength)
-		_, err = io.ReadFull(reader, stringBytes)
+		str, err := readBulk(reader, strLength)
 		if err != nil {
 			return "", nil, err
 		}
-
-		reader.Discard(2)
+		record(raw, []byte(str), crlf)
 
 		if i == 0 {
-			command = strings.ToLower(string(stringBytes))
+			command = strings.ToLower(str)
 		} else {
-
-			args = append(args, strings.ToLower(string(stringBytes)))
+			args = append(args, str)
 		}
 	}
 
 	return command, args, nil
 }
 
-// func parseRESPSetForReplica(reader *bufio.Reader) (string, []string, error) {
+// readBulk reads a bulk string of length bytes and its trailing CRLF. Strings
+// that fit in the reader's buffer are copied out of it once, straight into
+// the result.
+func readBulk(reader *bufio.Reader, length int) (string, error) {
+	if length+2 <= reader.Size() {
+		data, err := reader.Peek(length + 2)
+		if err != nil {
+			return "", err
+		}
+		str := string(data[:length])
+		reader.Discard(length + 2)
+		return str, nil
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+	if _, err := reader.Discard(2); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
 
-// }
+// parseLength parses the non-negative decimal length in a multibulk or bulk
+// header.
+func parseLength(digits []byte) (int, bool) {
+	if len(digits) == 0 || len(digits) > 18 {
+		return 0, false
+	}
+	if len(digits) == 2 && digits[0] == '-' && digits[1] == '1' {
+		return -1, true
+	}
+	n := 0
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
 
-func parseRESPInteger(s string, min int, errorFormat string) (int, error) {
-	val, err := strconv.Atoi(s)
-	if err != nil || val < min {
-		return 0, fmt.Errorf(errorFormat, s)
+// hasCompleteCommand reports whether buf holds a whole request, so that
+// parsing it won't wait for more input. Malformed requests count as
+// complete, as the parser rejects them without reading further.
+func hasCompleteCommand(buf []byte) bool {
+	for {
+		header, rest, ok := cutLine(buf)
+		if !ok {
+			return false
+		}
+		buf = rest
+		if len(header) == 0 {
+			continue
+		}
+		if header[0] != '*' {
+			return true
+		}
+		argSize, ok := parseLength(header[1:])
+		if !ok {
+			return true
+		}
+		if argSize < 1 {
+			// Skipped by the parser, which goes on to the next request.
+			continue
+		}
+		for i := 0; i < argSize; i++ {
+			line, rest, ok := cutLine(buf)
+			if !ok {
+				return false
+			}
+			if len(line) == 0 || line[0] != '$' {
+				return true
+			}
+			length, ok := parseLength(line[1:])
+			if !ok || length < 0 {
+				return true
+			}
+			if len(rest) < length+2 {
+				return false
+			}
+			buf = rest[length+2:]
+		}
+		return true
 	}
-	return val, nil
 }
 
+// cutLine splits buf after its first line, returning the line without its
+// line ending.
+func cutLine(buf []byte) ([]byte, []byte, bool) {
+	line, rest, ok := bytes.Cut(buf, []byte{'\n'})
+	return bytes.TrimSuffix(line, []byte{'\r'}), rest, ok
+}
+
+func firstByte(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	return string(line[:1])
+}
+
+// parseInline parses a command typed by hand, as in telnet: words separated
+// by spaces, with the same quoting rules as redis-cli.
+func parseInline(line []byte) (string, []string, error) {
+	words, err := splitArgs(string(line))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(words) == 0 {
+		return "", nil, protocolError("empty inline request")
+	}
+	return strings.ToLower(words[0]), words[1:], nil
+}
+
+// splitArgs splits line into arguments. Double quoted arguments understand
+// \n, \r, \t, \b, \a, \xHH and escaped quotes; single quoted ones only \'.
+// A closing quote must be followed by a space or the end of the line.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var current strings.Builder
+		inDouble, inSingle, done := false, false, false
+		for !done {
+			switch {
+			case inDouble:
+				if i == len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				c := line[i]
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					current.WriteByte(byte(n))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current.WriteByte('\n')
+					case 'r':
+						current.WriteByte('\r')
+					case 't':
+						current.WriteByte('\t')
+					case 'b':
+						current.WriteByte('\b')
+					case 'a':
+						current.WriteByte('\a')
+					default:
+						current.WriteByte(line[i])
+					}
+				} else if c == '"' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current.WriteByte(c)
+				}
+			case inSingle:
+				if i == len(line) {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				c := line[i]
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current.WriteByte('\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current.WriteByte(c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					break
+				}
+				switch c := line[i]; c {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					current.WriteByte(c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, current.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f' || c == 0
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+var crlf = []byte("\r\n")
+
+func record(raw *[]byte, chunks ...[]byte) {
+	if raw == nil {
+		return
+	}
+	for _, chunk := range chunks {
+		*raw = append(*raw, chunk...)
+	}
+}
+
+// func parseRESPSetForReplica(reader *bufio.Reader) (string, []string, error) {
+
+// }
+
 func respGenerator(args []string) string {
 	// '*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n'
 	output := fmt.Sprintf("*%d\r\n", len(args))
@@ -82,3 +362,62 @@ func respGenerator(args []string) string {
 	}
 	return output
 }
+
+// respError is an error reply (-ERR ...) received from another server.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// parseRESPReply reads a single reply sent by another server: simple strings
+// and bulk strings become string, integers int, arrays []interface{}, nulls nil
+// and error replies respError.
+func parseRESPReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty RESP reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %q", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		payload := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil, err
+		}
+		return string(payload[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length: %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = parseRESPReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown RESP reply type: %q", line)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+// repeatReader yields chunk count times without holding it all in memory.
+type repeatReader struct {
+	chunk string
+	count int
+	off   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && r.count > 0 {
+		c := copy(p[n:], r.chunk[r.off:])
+		n += c
+		r.off += c
+		if r.off == len(r.chunk) {
+			r.off = 0
+			r.count--
+		}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func TestParseRESPSkipsEmptyMultibulks(t *testing.T) {
+	// 40MB of empty requests used to recurse once per request and overflow
+	// the stack.
+	empty := &repeatReader{chunk: "*0\r\n*-1\r\n\r\n", count: 4 * 1024 * 1024}
+	command := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"
+	reader := bufio.NewReader(io.MultiReader(empty, strings.NewReader(command)))
+
+	cmd, args, err := parseRESPString(reader)
+	if err != nil {
+		t.Fatalf("parseRESPString: %v", err)
+	}
+	if cmd != "set" || len(args) != 2 || args[0] != "key" || args[1] != "value" {
+		t.Fatalf("got %q %q, want set [key value]", cmd, args)
+	}
+	if _, _, err := parseRESPString(reader); err != io.EOF {
+		t.Fatalf("got %v after the command, want EOF", err)
+	}
+}
+
+func TestParseRESPRawRecordsSkippedRequests(t *testing.T) {
+	input := "*0\r\n*1\r\n$4\r\nPING\r\n"
+	reader := bufio.NewReader(strings.NewReader(input))
+
+	cmd, _, raw, err := parseRESPStringRaw(reader)
+	if err != nil {
+		t.Fatalf("parseRESPStringRaw: %v", err)
+	}
+	if cmd != "ping" {
+		t.Fatalf("got command %q, want ping", cmd)
+	}
+	if string(raw) != input {
+		t.Fatalf("got raw %q, want %q", raw, input)
+	}
+}
+
+func TestParseInlineCommands(t *testing.T) {
+	for line, want := range map[string][]string{
+		"set key value\r\n":            {"set", "key", "value"},
+		"\r\nPING\n":                   {"ping"},
+		`SET k "a b\n\x41\""` + "\r\n": {"set", "k", "a b\nA\""},
+		`SET k 'it\'s'` + "\r\n":       {"set", "k", "it's"},
+	} {
+		cmd, args, err := parseRESPString(bufio.NewReader(strings.NewReader(line)))
+		if err != nil {
+			t.Errorf("parsing %q: %v", line, err)
+			continue
+		}
+		if got := append([]string{cmd}, args...); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("parsed %q as %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestParseRESPRejectsMalformedRequests(t *testing.T) {
+	for _, input := range []string{
+		"*2\r\n$3\r\nGET\r\n:1\r\n",
+		"*x\r\n",
+		"*1\r\n$-3\r\n",
+		"*1\r\n$999999999999\r\n",
+		"SET k \"unterminated\r\n",
+		strings.Repeat("a", protoMaxInlineLen+1) + "\r\n",
+	} {
+		if _, _, err := parseRESPString(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("parsing %.20q succeeded, want an error", input)
+		}
+	}
+}
+
+func TestHasCompleteCommand(t *testing.T) {
+	for buf, want := range map[string]bool{
+		"":                                 false,
+		"*1\r\n$4\r\nPING\r\n":             true,
+		"*1\r\n$4\r\nPING\r\n*2\r\n$3\r\n": true,
+		"*2\r\n$3\r\nGET\r\n$3\r\nke":      false,
+		"*2\r\n$3\r\nGET\r\n":              false,
+		"*1\r\n$4\r\nPI":                   false,
+		"\r\n*0\r\n*-1\r\n":                false,
+		"\r\n*0\r\n*1\r\n$4\r\nPING\r\n":   true,
+		"PING\r\n":                         true,
+		"PIN":                              false,
+		"*x\r\n":                           true,
+		"*1\r\n:1\r\n":                     true,
+	} {
+		if got := hasCompleteCommand([]byte(buf)); got != want {
+			t.Errorf("hasCompleteCommand(%q) = %v, want %v", buf, got, want)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output buffer limits for subscribers, as in Redis's client-output-buffer-limit
+// pubsub class: a subscriber is disconnected once its undelivered messages
+// exceed the hard limit, or stay above the soft limit for softSeconds.
+var (
+	pubsubHardLimit   = 32 * 1024 * 1024
+	pubsubSoftLimit   = 8 * 1024 * 1024
+	pubsubSoftSeconds = 60
+)
+
+// parsePubsubLimits reads the client-output-buffer-limit-pubsub flag. A
+// limit of 0 disables it.
+func parsePubsubLimits(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return errors.New("expected \"<hard> <soft> <soft seconds>\"")
+	}
+	hard, err := parseMemorySize(fields[0])
+	if err != nil {
+		return err
+	}
+	soft, err := parseMemorySize(fields[1])
+	if err != nil {
+		return err
+	}
+	seconds, err := strconv.Atoi(fields[2])
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("invalid soft limit seconds %q", fields[2])
+	}
+	pubsubHardLimit, pubsubSoftLimit, pubsubSoftSeconds = hard, soft, seconds
+	return nil
+}
+
+// parseMemorySize reads a byte count with an optional kb, mb or gb unit.
+func parseMemorySize(value string) (int, error) {
+	units := []struct {
+		suffix string
+		scale  int
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}}
+	lower := strings.ToLower(value)
+	scale := 1
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, scale = strings.TrimSuffix(lower, unit.suffix), unit.scale
+			break
+		}
+	}
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", value)
+	}
+	return n * scale, nil
+}
+
+// subscribedModeCommands are all a RESP2 connection may send while it has
+// subscriptions, as its replies would otherwise be mistaken for messages.
+var subscribedModeCommands = map[string]bool{
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"ssubscribe":   true,
+	"sunsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+}
+
+// subscriptionKind tells apart plain channels, glob patterns and the shard
+// channels of sharded pub/sub, which live in separate namespaces.
+type subscriptionKind int
+
+const (
+	channelSubscription subscriptionKind = iota
+	patternSubscription
+	shardSubscription
+	subscriptionKinds
+)
+
+var (
+	subscribeReplies   = [subscriptionKinds]string{"subscribe", "psubscribe", "ssubscribe"}
+	unsubscribeReplies = [subscriptionKinds]string{"unsubscribe", "punsubscribe", "sunsubscribe"}
+)
+
+// subscriptionCommands gives the kind of subscription each
+// (P|S)(UN)SUBSCRIBE command deals with.
+var subscriptionCommands = map[string]subscriptionKind{
+	"subscribe":    channelSubscription,
+	"unsubscribe":  channelSubscription,
+	"psubscribe":   patternSubscription,
+	"punsubscribe": patternSubscription,
+	"ssubscribe":   shardSubscription,
+	"sunsubscribe": shardSubscription,
+}
+
+// pubsubMessage is a push waiting for a subscriber: a message, the
+// sunsubscribe notice for a shard channel whose slot moved away, or a client
+// tracking invalidate or tracking-redir-broken notice. count is what the
+// notices report, keys the keys invalidated, and redirected marks an
+// invalidation for another connection.
+type pubsubMessage struct {
+	kind       string
+	pattern    string
+	channel    string
+	message    string
+	count      int
+	keys       []string
+	redirected bool
+}
+
+// subscriberBuffer holds the messages published to one subscriber until its
+// connection takes them, so that a slow subscriber never holds up PUBLISH.
+type subscriberBuffer struct {
+	mu        sync.Mutex
+	messages  []pubsubMessage
+	size      int
+	softSince time.Time
+	closed    bool
+	wake      chan struct{}
+}
+
+func newSubscriberBuffer() *subscriberBuffer {
+	return &subscriberBuffer{wake: make(chan struct{}, 1)}
+}
+
+// add queues a message. overLimit reports that it took the buffer over its
+// limits, after which the buffer is closed and takes no more messages.
+func (b *subscriberBuffer) add(msg pubsubMessage) (queued, overLimit bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false, false
+	}
+	b.messages = append(b.messages, msg)
+	b.size += len(msg.pattern) + len(msg.channel) + len(msg.message)
+	for _, key := range msg.keys {
+		b.size += len(key)
+	}
+	if pubsubSoftLimit > 0 && b.size > pubsubSoftLimit {
+		if b.softSince.IsZero() {
+			b.softSince = time.Now()
+		}
+	} else {
+		b.softSince = time.Time{}
+	}
+	if pubsubHardLimit > 0 && b.size > pubsubHardLimit || !b.softSince.IsZero() && time.Since(b.softSince) > time.Duration(pubsubSoftSeconds)*time.Second {
+		b.closed = true
+		b.messages, b.size = nil, 0
+		return false, true
+	}
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return true, false
+}
+
+func (b *subscriberBuffer) take() ([]pubsubMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	messages := b.messages
+	b.messages, b.size, b.softSince = nil, 0, time.Time{}
+	return messages, b.closed
+}
+
+func (b *subscriberBuffer) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+func (b *subscriberBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverMessages writes the messages queued for cl until its connection
+// closes. They go through the client's own reply buffer under its write lock,
+// so they never land in the middle of a reply nor overtake the confirmation
+// of the subscription they arrive through.
+func deliverMessages(cl *client) {
+	for range cl.messages.wake {
+		messages, closed := cl.messages.take()
+		if len(messages) > 0 {
+			cl.writeMu.Lock()
+			for _, msg := range messages {
+				writeMessage(cl, msg)
+			}
+			err := cl.out.flush()
+			cl.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// writeMessage writes msg to cl's reply buffer. The caller holds cl.writeMu,
+// which keeps cl.protocol from changing under it.
+func writeMessage(cl *client, msg pubsubMessage) {
+	w := cl.out
+	switch msg.kind {
+	case "pmessage":
+		w.pushHeader(4)
+		w.bulk(msg.kind)
+		w.bulk(msg.pattern)
+	case "sunsubscribe":
+		w.pushHeader(3)
+		w.bulk(msg.kind)
+		w.bulk(msg.channel)
+		w.integer(int64(msg.count))
+		return
+	case "invalidate":
+		// RESP2 has no pushes, so only a connection that invalidations
+		// are redirected to and that is in pub/sub mode gets them, as
+		// messages.
+		if cl.protocol == 3 {
+			w.pushHeader(2)
+			w.bulk(msg.kind)
+		} else if msg.redirected && cl.subscriptionCount() > 0 {
+			w.pushHeader(3)
+			w.bulk("message")
+			w.bulk("__redis__:invalidate")
+		} else {
+			return
+		}
+		w.bulkArray(msg.keys)
+		return
+	case "tracking-redir-broken":
+		if cl.protocol == 3 {
+			w.pushHeader(2)
+			w.bulk(msg.kind)
+			w.integer(int64(msg.count))
+		}
+		return
+	default:
+		w.pushHeader(3)
+		w.bulk(msg.kind)
+	}
+	w.bulk(msg.channel)
+	w.bulk(msg.message)
+}
+
+// addClient registers a connected client, which receives the messages of
+// the channels it subscribes to.
+func (cm *connectionManager) addClient(cl *client) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.clients[cl.conn.RemoteAddr().String()] = cl
+}
+
+// removeClient forgets a closing client and drops all its subscriptions.
+func (cm *connectionManager) removeClient(cl *client) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	addr := cl.conn.RemoteAddr().String()
+	delete(cm.clients, addr)
+	for kind, names := range cl.subscriptions {
+		for name := range names {
+			removeSubscriber(cm.subscriptions[kind], name, addr)
+		}
+	}
+	if cl.messages != nil {
+		cl.messages.close()
+	}
+}
+
+func removeSubscriber(subscriptions map[string]map[string]*client, name, addr string) {
+	delete(subscriptions[name], addr)
+	if len(subscriptions[name]) == 0 {
+		delete(subscriptions, name)
+	}
+}
+
+// subscriptionCount is the number of channels, patterns and shard channels
+// the client listens to. It is safe to call without holding cm.mu.
+func (cl *client) subscriptionCount() int {
+	return int(cl.subscribed.Load())
+}
+
+// subscriptionReplyCount is what (P|S)(UN)SUBSCRIBE replies report: shard
+// channels are counted apart from channels and patterns. The caller holds
+// cm.mu.
+func (cl *client) subscriptionReplyCount(kind subscriptionKind) int {
+	if kind == shardSubscription {
+		return len(cl.subscriptions[shardSubscription])
+	}
+	return len(cl.subscriptions[channelSubscription]) + len(cl.subscriptions[patternSubscription])
+}
+
+// startSubscriber gives cl the buffer its messages queue in, the first time
+// it subscribes.
+func (cl *client) startSubscriber() {
+	if cl.messages == nil {
+		cl.messages = newSubscriberBuffer()
+		go deliverMessages(cl)
+	}
+}
+
+// subscribe implements SUBSCRIBE, PSUBSCRIBE and SSUBSCRIBE, confirming each
+// name with a push.
+func (cm *connectionManager) subscribe(cl *client, names []string, kind subscriptionKind) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	addr := cl.conn.RemoteAddr().String()
+	subscriptions := cm.subscriptions[kind]
+	cl.startSubscriber()
+	if cl.subscriptions[kind] == nil {
+		cl.subscriptions[kind] = make(map[string]bool)
+	}
+	for _, name := range names {
+		if !cl.subscriptions[kind][name] {
+			cl.subscriptions[kind][name] = true
+			cl.subscribed.Add(1)
+			if subscriptions[name] == nil {
+				subscriptions[name] = make(map[string]*client)
+			}
+			subscriptions[name][addr] = cl
+		}
+		cl.out.pushHeader(3)
+		cl.out.bulk(subscribeReplies[kind])
+		cl.out.bulk(name)
+		cl.out.integer(int64(cl.subscriptionReplyCount(kind)))
+	}
+}
+
+// unsubscribe implements UNSUBSCRIBE, PUNSUBSCRIBE and SUNSUBSCRIBE. Without
+// names, every subscription of that kind is dropped.
+func (cm *connectionManager) unsubscribe(cl *client, names []string, kind subscriptionKind) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	own := cl.subscriptions[kind]
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		cl.out.pushHeader(3)
+		cl.out.bulk(unsubscribeReplies[kind])
+		cl.out.null()
+		cl.out.integer(int64(cl.subscriptionReplyCount(kind)))
+		return
+	}
+	for _, name := range names {
+		cm.dropSubscription(cl, name, kind)
+		cl.out.pushHeader(3)
+		cl.out.bulk(unsubscribeReplies[kind])
+		cl.out.bulk(name)
+		cl.out.integer(int64(cl.subscriptionReplyCount(kind)))
+	}
+}
+
+// dropSubscription removes one subscription of cl, if it has it. The caller
+// holds cm.mu.
+func (cm *connectionManager) dropSubscription(cl *client, name string, kind subscriptionKind) {
+	if !cl.subscriptions[kind][name] {
+		return
+	}
+	delete(cl.subscriptions[kind], name)
+	cl.subscribed.Add(-1)
+	removeSubscriber(cm.subscriptions[kind], name, cl.conn.RemoteAddr().String())
+}
+
+// dropShardChannels unsubscribes everyone from the shard channels whose slot
+// this node no longer serves, telling each subscriber with a sunsubscribe
+// push as Redis does when a slot migrates.
+func (cm *connectionManager) dropShardChannels(serves func(slot int) bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for channel, subscribers := range cm.subscriptions[shardSubscription] {
+		if serves(keyHashSlot(channel)) {
+			continue
+		}
+		for _, subscriber := range subscribers {
+			cm.dropSubscription(subscriber, channel, shardSubscription)
+			notice := pubsubMessage{kind: "sunsubscribe", channel: channel, count: subscriber.subscriptionReplyCount(shardSubscription)}
+			cm.deliver(subscriber, notice)
+		}
+	}
+}
+
+// deliver queues msg for subscriber and reports whether it was queued.
+// Subscribers that fall too far behind are disconnected. The caller holds
+// cm.mu.
+func (cm *connectionManager) deliver(subscriber *client, msg pubsubMessage) bool {
+	queued, overLimit := subscriber.messages.add(msg)
+	if overLimit {
+		fmt.Println("Closing subscriber over its output buffer limit:", subscriber.conn.RemoteAddr())
+		subscriber.conn.Close()
+	}
+	return queued
+}
+
+// publish queues message for every subscriber of channel and every pattern
+// subscription matching it, and returns how many receivers it reached.
+func (cm *connectionManager) publish(channel, message string) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	receivers := 0
+	for _, subscriber := range cm.subscriptions[channelSubscription][channel] {
+		if cm.deliver(subscriber, pubsubMessage{kind: "message", channel: channel, message: message}) {
+			receivers++
+		}
+	}
+	for pattern, subscribers := range cm.subscriptions[patternSubscription] {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for _, subscriber := range subscribers {
+			if cm.deliver(subscriber, pubsubMessage{kind: "pmessage", pattern: pattern, channel: channel, message: message}) {
+				receivers++
+			}
+		}
+	}
+	return receivers
+}
+
+// spublish implements SPUBLISH, which only reaches the subscribers of the
+// shard channel itself.
+func (cm *connectionManager) spublish(channel, message string) int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	receivers := 0
+	for _, subscriber := range cm.subscriptions[shardSubscription][channel] {
+		if cm.deliver(subscriber, pubsubMessage{kind: "smessage", channel: channel, message: message}) {
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// pubsubCommand implements PUBSUB CHANNELS [pattern], NUMSUB [channel ...],
+// NUMPAT, SHARDCHANNELS [pattern] and SHARDNUMSUB [channel ...].
+func (cm *connectionManager) pubsubCommand(args []string, w *replyWriter) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	subcommand := strings.ToLower(args[0])
+	kind := channelSubscription
+	if strings.HasPrefix(subcommand, "shard") {
+		kind = shardSubscription
+	}
+	switch subcommand {
+	case "channels", "shardchannels":
+		if len(args) > 2 {
+			return fmt.Errorf("ERR wrong number of arguments for 'pubsub|%s' command", subcommand)
+		}
+		var channels []string
+		for channel := range cm.subscriptions[kind] {
+			if len(args) == 1 || globMatch(args[1], channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		w.bulkArray(channels)
+	case "numsub", "shardnumsub":
+		w.mapHeader(len(args) - 1)
+		for _, channel := range args[1:] {
+			w.bulk(channel)
+			w.integer(int64(len(cm.subscriptions[kind][channel])))
+		}
+	case "numpat":
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'pubsub|numpat' command")
+		}
+		w.integer(int64(len(cm.subscriptions[patternSubscription])))
+	default:
+		return fmt.Errorf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", args[0])
+	}
+	return nil
+}
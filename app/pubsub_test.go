@@ -0,0 +1,273 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishReachesChannelAndPatternSubscribers(t *testing.T) {
+	server := startTestServer(t, "")
+	subscriber := dialTestClient(t, server.addr)
+	publisher := dialTestClient(t, server.addr)
+
+	if reply := subscriber.do("SUBSCRIBE", "news", "sport"); !reflect.DeepEqual(reply, []any{"subscribe", "news", 1}) {
+		t.Fatalf("SUBSCRIBE replied %v", reply)
+	}
+	if reply := subscriber.read(); !reflect.DeepEqual(reply, []any{"subscribe", "sport", 2}) {
+		t.Fatalf("second SUBSCRIBE confirmation is %v", reply)
+	}
+	if reply := subscriber.do("PSUBSCRIBE", "n*"); !reflect.DeepEqual(reply, []any{"psubscribe", "n*", 3}) {
+		t.Fatalf("PSUBSCRIBE replied %v", reply)
+	}
+
+	if reply := publisher.do("PUBLISH", "news", "hello"); reply != 2 {
+		t.Fatalf("PUBLISH replied %v, want 2 receivers", reply)
+	}
+	got := []any{subscriber.read(), subscriber.read()}
+	want := []any{[]any{"message", "news", "hello"}, []any{"pmessage", "n*", "news", "hello"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("subscriber got %v, want %v", got, want)
+	}
+	if reply := publisher.do("PUBLISH", "weather", "rain"); reply != 0 {
+		t.Fatalf("PUBLISH without subscribers replied %v", reply)
+	}
+
+	if reply := subscriber.do("UNSUBSCRIBE", "news"); !reflect.DeepEqual(reply, []any{"unsubscribe", "news", 2}) {
+		t.Fatalf("UNSUBSCRIBE replied %v", reply)
+	}
+	if reply := subscriber.do("PUNSUBSCRIBE"); !reflect.DeepEqual(reply, []any{"punsubscribe", "n*", 1}) {
+		t.Fatalf("PUNSUBSCRIBE replied %v", reply)
+	}
+	if reply := publisher.do("PUBLISH", "news", "again"); reply != 0 {
+		t.Fatalf("PUBLISH after unsubscribing replied %v", reply)
+	}
+}
+
+func TestSubscribedResp2ConnectionsOnlyTakeSubscriptionCommands(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	client.do("SUBSCRIBE", "ch")
+	want := replyError("ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+	if reply := client.do("GET", "k"); reply != want {
+		t.Fatalf("GET while subscribed replied %v", reply)
+	}
+	if reply := client.do("PING"); !reflect.DeepEqual(reply, []any{"pong", ""}) {
+		t.Fatalf("PING while subscribed replied %v", reply)
+	}
+
+	// RESP3 connections keep running any command.
+	resp3 := dialTestClient(t, server.addr)
+	resp3.do("HELLO", "3")
+	resp3.do("SUBSCRIBE", "ch")
+	if reply := resp3.do("SET", "k", "v"); reply != "OK" {
+		t.Fatalf("SET on a subscribed RESP3 connection replied %v", reply)
+	}
+
+	if reply := client.do("QUIT"); reply != "OK" {
+		t.Fatalf("QUIT replied %v", reply)
+	}
+	client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("connection still open after QUIT: %v", err)
+	}
+}
+
+func TestPubsubIntrospection(t *testing.T) {
+	server := startTestServer(t, "")
+	first := dialTestClient(t, server.addr)
+	second := dialTestClient(t, server.addr)
+	client := dialTestClient(t, server.addr)
+
+	first.do("SUBSCRIBE", "a.1")
+	second.send("SUBSCRIBE", "a.1", "b.1")
+	second.read()
+	second.read()
+	second.do("PSUBSCRIBE", "a.*")
+
+	if reply := client.do("PUBSUB", "CHANNELS"); !reflect.DeepEqual(reply, []any{"a.1", "b.1"}) {
+		t.Fatalf("PUBSUB CHANNELS replied %v", reply)
+	}
+	if reply := client.do("PUBSUB", "CHANNELS", "b.*"); !reflect.DeepEqual(reply, []any{"b.1"}) {
+		t.Fatalf("PUBSUB CHANNELS b.* replied %v", reply)
+	}
+	if reply := client.do("PUBSUB", "NUMSUB", "a.1", "none"); !reflect.DeepEqual(reply, []any{"a.1", 2, "none", 0}) {
+		t.Fatalf("PUBSUB NUMSUB replied %v", reply)
+	}
+	if reply := client.do("PUBSUB", "NUMPAT"); reply != 1 {
+		t.Fatalf("PUBSUB NUMPAT replied %v", reply)
+	}
+
+	first.conn.Close()
+	waitFor(t, "the closed subscriber to go", func() bool {
+		return reflect.DeepEqual(client.do("PUBSUB", "NUMSUB", "a.1"), []any{"a.1", 1})
+	})
+}
+
+func withPubsubLimits(t *testing.T, hard, soft, seconds int) {
+	saved := [3]int{pubsubHardLimit, pubsubSoftLimit, pubsubSoftSeconds}
+	pubsubHardLimit, pubsubSoftLimit, pubsubSoftSeconds = hard, soft, seconds
+	t.Cleanup(func() {
+		pubsubHardLimit, pubsubSoftLimit, pubsubSoftSeconds = saved[0], saved[1], saved[2]
+	})
+}
+
+func TestSubscriberBufferLimits(t *testing.T) {
+	withPubsubLimits(t, 100, 10, 60)
+	msg := func(size int) pubsubMessage { return pubsubMessage{channel: "c", message: strings.Repeat("x", size-1)} }
+
+	b := newSubscriberBuffer()
+	if queued, over := b.add(msg(5)); !queued || over {
+		t.Fatalf("a message under the limits was refused (queued %v, over %v)", queued, over)
+	}
+	if messages, closed := b.take(); len(messages) != 1 || closed {
+		t.Fatalf("take returned %d messages, closed %v", len(messages), closed)
+	}
+	// Going over the soft limit is fine until it lasts softSeconds.
+	if queued, over := b.add(msg(20)); !queued || over {
+		t.Fatalf("a message past the soft limit was refused (queued %v, over %v)", queued, over)
+	}
+	b.take()
+	withPubsubLimits(t, 100, 10, 0)
+	if queued, over := b.add(msg(20)); queued || !over {
+		t.Fatalf("a message past an expired soft limit was queued (queued %v, over %v)", queued, over)
+	}
+	if queued, _ := b.add(msg(1)); queued {
+		t.Fatal("a closed buffer took a message")
+	}
+
+	withPubsubLimits(t, 100, 0, 0)
+	b = newSubscriberBuffer()
+	if _, over := b.add(msg(60)); over {
+		t.Fatal("a buffer under the hard limit was closed")
+	}
+	if _, over := b.add(msg(60)); !over {
+		t.Fatal("a buffer past the hard limit was not closed")
+	}
+
+	if err := parsePubsubLimits("1kb 2mb 5"); err != nil {
+		t.Fatal(err)
+	}
+	if pubsubHardLimit != 1024 || pubsubSoftLimit != 2*1024*1024 || pubsubSoftSeconds != 5 {
+		t.Fatalf("parsed limits as %d %d %d", pubsubHardLimit, pubsubSoftLimit, pubsubSoftSeconds)
+	}
+	for _, bad := range []string{"1kb 2mb", "x 1 1", "1 1 -1"} {
+		if err := parsePubsubLimits(bad); err == nil {
+			t.Errorf("parsePubsubLimits(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestSubscriberOverTheHardLimitIsDisconnected(t *testing.T) {
+	withPubsubLimits(t, 1024, 0, 0)
+	server := startTestServer(t, "")
+	subscriber := dialTestClient(t, server.addr)
+	publisher := dialTestClient(t, server.addr)
+
+	subscriber.do("SUBSCRIBE", "ch")
+	if reply := publisher.do("PUBLISH", "ch", strings.Repeat("x", 2048)); reply != 0 {
+		t.Fatalf("PUBLISH of an oversized message replied %v receivers", reply)
+	}
+	subscriber.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(subscriber.reader); err != nil {
+		t.Fatalf("subscriber was not disconnected: %v", err)
+	}
+	if reply := publisher.do("PUBLISH", "ch", "small"); reply != 0 {
+		t.Fatalf("PUBLISH after the disconnect replied %v", reply)
+	}
+}
+
+func TestShardChannelsAreKeptApart(t *testing.T) {
+	server := startTestServer(t, "")
+	subscriber := dialTestClient(t, server.addr)
+	publisher := dialTestClient(t, server.addr)
+
+	subscriber.do("SUBSCRIBE", "ch")
+	if reply := subscriber.do("SSUBSCRIBE", "ch"); !reflect.DeepEqual(reply, []any{"ssubscribe", "ch", 1}) {
+		t.Fatalf("SSUBSCRIBE replied %v", reply)
+	}
+	if reply := publisher.do("SPUBLISH", "ch", "sharded"); reply != 1 {
+		t.Fatalf("SPUBLISH replied %v, want 1 receiver", reply)
+	}
+	if reply := subscriber.read(); !reflect.DeepEqual(reply, []any{"smessage", "ch", "sharded"}) {
+		t.Fatalf("shard subscriber got %v", reply)
+	}
+	publisher.do("PUBLISH", "ch", "plain")
+	if reply := subscriber.read(); !reflect.DeepEqual(reply, []any{"message", "ch", "plain"}) {
+		t.Fatalf("channel subscriber got %v", reply)
+	}
+
+	if reply := publisher.do("PUBSUB", "SHARDCHANNELS"); !reflect.DeepEqual(reply, []any{"ch"}) {
+		t.Fatalf("PUBSUB SHARDCHANNELS replied %v", reply)
+	}
+	if reply := publisher.do("PUBSUB", "SHARDNUMSUB", "ch", "none"); !reflect.DeepEqual(reply, []any{"ch", 1, "none", 0}) {
+		t.Fatalf("PUBSUB SHARDNUMSUB replied %v", reply)
+	}
+	if reply := subscriber.do("SUNSUBSCRIBE"); !reflect.DeepEqual(reply, []any{"sunsubscribe", "ch", 0}) {
+		t.Fatalf("SUNSUBSCRIBE replied %v", reply)
+	}
+	if reply := publisher.do("SPUBLISH", "ch", "gone"); reply != 0 {
+		t.Fatalf("SPUBLISH after SUNSUBSCRIBE replied %v", reply)
+	}
+}
+
+func TestSpublishReachesReplicas(t *testing.T) {
+	master := startTestServer(t, "")
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+
+	subscriber := dialTestClient(t, replica.addr)
+	subscriber.do("SSUBSCRIBE", "ch")
+	if reply := dialTestClient(t, master.addr).do("SPUBLISH", "ch", "hi"); reply != 0 {
+		t.Fatalf("SPUBLISH on the master replied %v", reply)
+	}
+	if reply := subscriber.read(); !reflect.DeepEqual(reply, []any{"smessage", "ch", "hi"}) {
+		t.Fatalf("replica's shard subscriber got %v", reply)
+	}
+}
+
+func TestShardChannelsFollowTheirSlot(t *testing.T) {
+	node := startTestClusterNode(t)
+	client := dialTestClient(t, node.addr)
+	client.do("CLUSTER", "ADDSLOTSRANGE", "0", "16383")
+
+	cs := node.config.cluster
+	other := &clusterNode{id: newReplID(), host: "127.0.0.1", port: 7000}
+	cs.mu.Lock()
+	cs.nodes[other.id] = other
+	cs.slots[keyHashSlot("bar")] = other
+	cs.mu.Unlock()
+
+	if reply := client.do("SSUBSCRIBE", "bar"); reply != replyError("MOVED 5061 127.0.0.1:7000") {
+		t.Fatalf("SSUBSCRIBE to another node's slot replied %v", reply)
+	}
+	if reply := client.do("SSUBSCRIBE", "foo", "hello"); reply != replyError("CROSSSLOT Keys in request don't hash to the same slot") {
+		t.Fatalf("SSUBSCRIBE across slots replied %v", reply)
+	}
+	subscriber := dialTestClient(t, node.addr)
+	subscriber.send("SSUBSCRIBE", "foo", "{foo}.2")
+	subscriber.read()
+	subscriber.read()
+
+	// Giving the slot away unsubscribes everyone from its shard channels.
+	if reply := client.do("CLUSTER", "SETSLOT", "12182", "NODE", other.id); reply != "OK" {
+		t.Fatalf("CLUSTER SETSLOT replied %v", reply)
+	}
+	notices := map[any]any{}
+	for i := 0; i < 2; i++ {
+		notice, _ := subscriber.read().([]any)
+		if len(notice) != 3 || notice[0] != "sunsubscribe" {
+			t.Fatalf("subscriber got %v, want a sunsubscribe notice", notice)
+		}
+		notices[notice[1]] = notice[2]
+	}
+	if len(notices) != 2 || notices["foo"] == nil || notices["{foo}.2"] == nil {
+		t.Fatalf("sunsubscribe notices cover %v, want foo and {foo}.2", notices)
+	}
+	if reply := client.do("PUBSUB", "SHARDCHANNELS"); !reflect.DeepEqual(reply, []any{}) {
+		t.Fatalf("PUBSUB SHARDCHANNELS after the move replied %v", reply)
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectBackoff = 500 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+	replicaAckInterval  = time.Second
+)
+
+// replicationState holds the replication ID history and backlog used to
+// serve partial resynchronisations, plus the handle of the master link
+// goroutine when this server is a replica.
+type replicationState struct {
+	mu               sync.Mutex
+	replid           string
+	replid2          string
+	secondReplOffset int
+	offset           int
+	backlog          []byte
+	backlogSize      int
+	rootCtx          context.Context
+	cancelLink       context.CancelFunc
+	linkDone         chan struct{}
+	failoverResult   chan error
+}
+
+func newReplicationState(backlogSize int) *replicationState {
+	return &replicationState{
+		replid:           newReplID(),
+		replid2:          strings.Repeat("0", 40),
+		secondReplOffset: -1,
+		backlogSize:      backlogSize,
+		rootCtx:          context.Background(),
+	}
+}
+
+func newReplID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// feed appends a chunk of the replication stream to the backlog and advances
+// the master offset.
+func (r *replicationState) feed(payload string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backlog = append(r.backlog, payload...)
+	// Trimming only reslices; append moves the data to a new array once the
+	// capacity runs out, so a full backlog isn't copied on every write.
+	if excess := len(r.backlog) - r.backlogSize; excess > 0 {
+		r.backlog = r.backlog[excess:]
+	}
+	r.offset += len(payload)
+}
+
+// continueFrom returns the backlog contents a replica needs to resume from
+// psyncOffset, or false when a full resynchronisation is required.
+func (r *replicationState) continueFrom(replid string, psyncOffset int) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if replid != r.replid && (replid != r.replid2 || psyncOffset > r.secondReplOffset) {
+		return "", false
+	}
+	backlogStart := r.offset - len(r.backlog)
+	needed := psyncOffset - 1
+	if needed < backlogStart || needed > r.offset {
+		return "", false
+	}
+	return string(r.backlog[needed-backlogStart:]), true
+}
+
+// shiftReplID starts a new replication history while remembering the old one,
+// so replicas of the previous master can still partially resync with us.
+func (r *replicationState) shiftReplID(offset int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replid2 = r.replid
+	r.secondReplOffset = offset + 1
+	r.replid = newReplID()
+	r.offset = offset
+}
+
+// adoptMaster records the replication ID and offset announced by a master.
+// A full resync starts a new history, so the backlog is dropped with it. It
+// reports whether the replication ID changed.
+func (r *replicationState) adoptMaster(replid string, offset int, fullSync bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.replid != replid
+	if changed && !fullSync {
+		r.replid2 = r.replid
+		r.secondReplOffset = offset + 1
+	}
+	r.replid = replid
+	r.offset = offset
+	if fullSync {
+		r.backlog = nil
+	}
+	return changed
+}
+
+func (r *replicationState) ids() (string, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.replid, r.offset
+}
+
+// requestFailoverPsync makes the next PSYNC carry the FAILOVER option and
+// report its outcome on result.
+func (r *replicationState) requestFailoverPsync(result chan error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failoverResult = result
+}
+
+func (r *replicationState) takeFailoverPsync() chan error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := r.failoverResult
+	r.failoverResult = nil
+	return result
+}
+
+func (r *replicationState) info() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("master_replid:%s\nmaster_replid2:%s\nsecond_repl_offset:%d\nrepl_backlog_size:%d\nrepl_backlog_histlen:%d",
+		r.replid, r.replid2, r.secondReplOffset, r.backlogSize, len(r.backlog))
+}
+
+// replicaLink tracks the state of a replica's connection to its master so that
+// INFO replication can report it while the link goroutine is running.
+type replicaLink struct {
+	mu             sync.Mutex
+	conn           net.Conn
+	writeMu        sync.Mutex
+	up             bool
+	lastIO         time.Time
+	syncInProgress bool
+}
+
+func newReplicaLink() *replicaLink {
+	return &replicaLink{}
+}
+
+func (l *replicaLink) setUp(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conn = conn
+	l.up = true
+	l.syncInProgress = false
+	l.lastIO = time.Now()
+}
+
+func (l *replicaLink) setDown() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conn = nil
+	l.up = false
+	l.syncInProgress = false
+}
+
+func (l *replicaLink) setSyncInProgress(inProgress bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncInProgress = inProgress
+}
+
+func (l *replicaLink) isUp() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.up
+}
+
+func (l *replicaLink) touch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastIO = time.Now()
+}
+
+// write serialises writes on the master connection, which is shared by the
+// command loop (GETACK replies) and the periodic ACK sender.
+func (l *replicaLink) write(conn net.Conn, payload string) error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	_, err := conn.Write([]byte(payload))
+	return err
+}
+
+func (l *replicaLink) info() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := "down"
+	lastIOSecondsAgo := -1
+	if l.up {
+		status = "up"
+		lastIOSecondsAgo = int(time.Since(l.lastIO).Seconds())
+	}
+	syncInProgress := 0
+	if l.syncInProgress {
+		syncInProgress = 1
+	}
+	return fmt.Sprintf("master_link_status:%s\nmaster_last_io_seconds_ago:%d\nmaster_sync_in_progress:%d",
+		status, lastIOSecondsAgo, syncInProgress)
+}
+
+// superviseMasterLink keeps the replica attached to its master, reconnecting
+// with exponential backoff whenever the link drops.
+func superviseMasterLink(config *config, ctx context.Context, cm *connectionManager, store *redisStore) {
+	backoff := minReconnectBackoff
+	for {
+		start := time.Now()
+		err := connectToMasterAsReplica(config, ctx, cm, store)
+		config.server.link.setDown()
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("Master link down:", err)
+
+		// A link that stayed up for a while resets the backoff.
+		if time.Since(start) > maxReconnectBackoff {
+			backoff = minReconnectBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+func connectToMasterAsReplica(config *config, ctx context.Context, cm *connectionManager, store *redisStore) (err error) {
+	failoverResult := config.server.repl.takeFailoverPsync()
+	defer func() {
+		if failoverResult != nil {
+			failoverResult <- err
+		}
+	}()
+
+	masterHost, masterPort := func(args []string) (string, string) {
+		return args[0], args[1]
+	}(strings.Split(config.masterAddress(), " "))
+
+	link := config.server.link
+	timeout := time.Duration(config.server.replTimeout) * time.Second
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(masterHost, masterPort), timeout)
+	if err != nil {
+		return fmt.Errorf("error connecting to master as replica: %w", err)
+	}
+	defer conn.Close()
+
+	// Unblock pending reads as soon as the server shuts down.
+	linkCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-linkCtx.Done()
+		conn.Close()
+	}()
+
+	link.setSyncInProgress(true)
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var handShakeCommands []string
+	// A master with requirepass or ACL users needs us to log in first.
+	if config.server.masterAuth != "" {
+		authArgs := []string{"AUTH", config.server.masterAuth}
+		if config.server.masterUser != "" {
+			authArgs = []string{"AUTH", config.server.masterUser, config.server.masterAuth}
+		}
+		handShakeCommands = append(handShakeCommands, respGenerator(authArgs))
+	}
+	handShakeCommands = append(handShakeCommands,
+		respGenerator([]string{"PING"}),
+		respGenerator([]string{"REPLCONF", "listening-port", strconv.Itoa(config.server.port)}),
+		respGenerator([]string{"REPLCONF", "capa", "psync2"}),
+	)
+
+	for _, cmd := range handShakeCommands {
+		response, err := sendCommand(conn, cmd)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(response, "-") {
+			return fmt.Errorf("master rejected handshake: %s", strings.TrimSpace(response))
+		}
+	}
+
+	replid, _ := config.server.repl.ids()
+	pSyncArgs := []string{"PSYNC", replid, strconv.FormatInt(config.server.bytesReadAsReplica.Load()+1, 10)}
+	if failoverResult != nil {
+		pSyncArgs = append(pSyncArgs, "FAILOVER")
+	}
+	pSyncCommand := respGenerator(pSyncArgs)
+	_, err = conn.Write([]byte(pSyncCommand))
+	if err != nil {
+		return fmt.Errorf("error sending pSyncCommand: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	psyncReply, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error while reading first line: %w", err)
+	}
+
+	// +FULLRESYNC <replid> <offset> is followed by an RDB payload, while
+	// +CONTINUE [<replid>] resumes the stream right where we left off.
+	fields := strings.Fields(strings.TrimPrefix(psyncReply, "+"))
+	switch {
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		masterOffset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid FULLRESYNC offset: %w", err)
+		}
+		rdb, err := readRDBPayload(reader)
+		if err != nil {
+			return err
+		}
+		// The keyspace isn't loaded from the payload, but the function
+		// libraries are, so that they survive a failover to this replica.
+		if libraries, err := rdbFileFunctions(rdb); err != nil {
+			fmt.Println("Error reading functions from RDB:", err)
+		} else if err := config.scripts.replaceLibraries(libraries); err != nil {
+			fmt.Println("Error loading functions from RDB:", err)
+		}
+		config.server.repl.adoptMaster(fields[1], masterOffset, true)
+		config.server.bytesReadAsReplica.Store(int64(masterOffset))
+		// Our own replicas hold a history that no longer exists.
+		cm.disconnectReplicas()
+	case len(fields) >= 1 && fields[0] == "CONTINUE":
+		if len(fields) == 2 && config.server.repl.adoptMaster(fields[1], int(config.server.bytesReadAsReplica.Load()), false) {
+			// Reconnecting lets our replicas learn the new replication ID.
+			cm.disconnectReplicas()
+		}
+	default:
+		return fmt.Errorf("unexpected PSYNC reply: %q", strings.TrimSpace(psyncReply))
+	}
+
+	if failoverResult != nil {
+		failoverResult <- nil
+		failoverResult = nil
+	}
+
+	conn.SetDeadline(time.Time{})
+	link.setUp(conn)
+	go sendPeriodicAcks(linkCtx, config, conn)
+	var replies bytes.Buffer
+	masterClient := newMasterClient(conn, &replies)
+	// Stopping the link must not wait on a command stuck behind an EXEC:
+	// the client stopping it may hold the exec lock itself.
+	masterClient.cancel = linkCtx.Done()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		command, args, raw, err := parseRESPStringRaw(reader)
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("master closed the connection")
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return fmt.Errorf("no data from master for %s: %w", timeout, err)
+			}
+			return fmt.Errorf("error parsing parseRESPString: %w", err)
+		}
+		link.touch()
+
+		// Sub-replicas receive exactly what our master sent, so they share
+		// its replication ID and offsets.
+		cm.relay(string(raw))
+
+		err = handleCommand(masterClient, command, args, store, config, cm)
+		if errors.Is(err, errCommandCancelled) {
+			return err
+		}
+		// The offset advances by exactly the bytes the master sent, whatever
+		// the command turned out to be.
+		config.server.bytesReadAsReplica.Add(int64(len(raw)))
+		masterClient.out.flush()
+		if err != nil {
+			fmt.Println("error from redisInput parser", err)
+		} else if command == "replconf" && replies.Len() > 0 {
+			if err := link.write(conn, replies.String()); err != nil {
+				return fmt.Errorf("error replying to master: %w", err)
+			}
+		}
+		replies.Reset()
+	}
+}
+
+func readRDBPayload(reader *bufio.Reader) ([]byte, error) {
+	rdbSize, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading RDB size: %w", err)
+	}
+	rdbSize = strings.TrimSuffix(rdbSize, "\r\n")
+	rdbSize = strings.TrimPrefix(rdbSize, "$")
+	rdbByteCount, err := strconv.Atoi(rdbSize)
+	if err != nil {
+		return nil, fmt.Errorf("error converting rdb file size byte values to int: %w", err)
+	}
+
+	rdb := make([]byte, rdbByteCount)
+	if _, err := io.ReadFull(reader, rdb); err != nil {
+		return nil, fmt.Errorf("error reading RDB payload: %w", err)
+	}
+	return rdb, nil
+}
+
+// sendPeriodicAcks reports the processed offset to the master every second so
+// it can detect a dead replica and measure lag.
+func sendPeriodicAcks(ctx context.Context, config *config, conn net.Conn) {
+	ticker := time.NewTicker(replicaAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ack := respGenerator([]string{"REPLCONF", "ACK", strconv.FormatInt(config.server.bytesReadAsReplica.Load(), 10)})
+			if err := config.server.link.write(conn, ack); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// pingReplicas sends a PING down the replication stream every
+// repl-ping-replica-period seconds and drops replicas that stopped acking.
+func pingReplicas(ctx context.Context, config *config, cm *connectionManager) {
+	period := time.Duration(config.server.replPingReplicaPeriod) * time.Second
+	timeout := time.Duration(config.server.replTimeout) * time.Second
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cm.dropTimedOutReplicas(timeout)
+			// Replicas relay their master's PINGs instead of sending their own.
+			if config.isReplica() {
+				continue
+			}
+			if cm.replicaCount() > 0 {
+				cm.propagateCommandsToReplica(respGenerator([]string{"PING"}))
+			}
+		}
+	}
+}
+
+func (c *config) isReplica() bool {
+	c.server.repl.mu.Lock()
+	defer c.server.repl.mu.Unlock()
+	return c.server.actAsReplica
+}
+
+func (c *config) masterAddress() string {
+	c.server.repl.mu.Lock()
+	defer c.server.repl.mu.Unlock()
+	return c.server.masterDetails
+}
+
+// startMasterLink spawns the goroutine that keeps this replica attached to
+// its master until stopMasterLink is called.
+func startMasterLink(config *config, cm *connectionManager, store *redisStore) {
+	repl := config.server.repl
+	repl.mu.Lock()
+	ctx, cancel := context.WithCancel(repl.rootCtx)
+	done := make(chan struct{})
+	repl.cancelLink = cancel
+	repl.linkDone = done
+	repl.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		superviseMasterLink(config, ctx, cm, store)
+	}()
+}
+
+func stopMasterLink(config *config) {
+	repl := config.server.repl
+	repl.mu.Lock()
+	cancel, done := repl.cancelLink, repl.linkDone
+	repl.cancelLink, repl.linkDone = nil, nil
+	repl.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// replicaOf implements REPLICAOF host port and REPLICAOF NO ONE.
+func replicaOf(args []string, config *config, cm *connectionManager, store *redisStore, w *replyWriter) error {
+	if len(args) != 2 {
+		return errors.New("ERR wrong number of arguments for 'replicaof' command")
+	}
+
+	if strings.ToLower(args[0]) == "no" && strings.ToLower(args[1]) == "one" {
+		if config.isReplica() {
+			unsetMaster(config, cm)
+		}
+		w.simpleString("OK")
+		return nil
+	}
+
+	if _, err := strconv.Atoi(args[1]); err != nil {
+		return errors.New("ERR Invalid master port")
+	}
+	masterDetails := args[0] + " " + args[1]
+	if config.isReplica() && config.masterAddress() == masterDetails {
+		w.simpleString("OK Already connected to specified master")
+		return nil
+	}
+
+	setMaster(config, cm, store, masterDetails)
+	w.simpleString("OK")
+	return nil
+}
+
+// unsetMaster promotes this replica to a master.
+func unsetMaster(config *config, cm *connectionManager) {
+	repl := config.server.repl
+	stopMasterLink(config)
+
+	repl.mu.Lock()
+	config.server.actAsReplica = false
+	config.server.masterDetails = ""
+	repl.mu.Unlock()
+	repl.shiftReplID(int(config.server.bytesReadAsReplica.Load()))
+
+	// Our replicas reconnect and continue under the new replication ID.
+	cm.disconnectReplicas()
+	fmt.Println("MASTER MODE enabled")
+}
+
+// setMaster (re)attaches this server to the master at masterDetails.
+func setMaster(config *config, cm *connectionManager, store *redisStore, masterDetails string) {
+	repl := config.server.repl
+	stopMasterLink(config)
+	wasReplica := config.isReplica()
+
+	repl.mu.Lock()
+	config.server.actAsReplica = true
+	config.server.masterDetails = masterDetails
+	repl.mu.Unlock()
+
+	// A former master tries to continue its own history with the new master.
+	if !wasReplica {
+		_, offset := repl.ids()
+		config.server.bytesReadAsReplica.Store(int64(offset))
+	}
+
+	cm.disconnectReplicas()
+	startMasterLink(config, cm, store)
+	fmt.Println("Connecting to MASTER", masterDetails)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingProxy forwards connections to target and keeps a copy of the bytes
+// sent in each direction on the latest one.
+type recordingProxy struct {
+	addr       string
+	listener   net.Listener
+	mu         sync.Mutex
+	conns      []net.Conn
+	downstream bytes.Buffer // target to client
+	upstream   bytes.Buffer // client to target
+}
+
+func startRecordingProxy(tb testing.TB, target string) *recordingProxy {
+	tb.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	p := &recordingProxy{addr: listener.Addr().String(), listener: listener}
+	tb.Cleanup(p.close)
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, client, server)
+			p.downstream.Reset()
+			p.upstream.Reset()
+			p.mu.Unlock()
+			go p.pipe(server, client, &p.upstream)
+			go p.pipe(client, server, &p.downstream)
+		}
+	}()
+	return p
+}
+
+func (p *recordingProxy) pipe(dst, src net.Conn, record *bytes.Buffer) {
+	defer dst.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			p.mu.Lock()
+			record.Write(buf[:n])
+			p.mu.Unlock()
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// drop closes every proxied connection, as a network failure would.
+func (p *recordingProxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+// stream returns the replication ID and offset of the latest full resync
+// and every byte sent after its RDB payload.
+func (p *recordingProxy) stream(tb testing.TB) (string, int, []byte) {
+	tb.Helper()
+	p.mu.Lock()
+	reader := bufio.NewReader(bytes.NewReader(p.downstream.Bytes()))
+	p.mu.Unlock()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			tb.Fatalf("no FULLRESYNC from the master: %v", err)
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "+"))
+		if len(fields) == 3 && fields[0] == "FULLRESYNC" {
+			offset, err := strconv.Atoi(fields[2])
+			if err != nil {
+				tb.Fatal(err)
+			}
+			if _, err := readRDBPayload(reader); err != nil {
+				tb.Fatal(err)
+			}
+			rest, _ := io.ReadAll(reader)
+			return fields[1], offset, rest
+		}
+	}
+}
+
+// streamOffset returns the replication offset the master has sent the
+// replica up to.
+func (p *recordingProxy) streamOffset(tb testing.TB) int {
+	tb.Helper()
+	_, offset, rest := p.stream(tb)
+	return offset + len(rest)
+}
+
+// received returns everything target has sent on the latest connection.
+func (p *recordingProxy) received() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.downstream.String()
+}
+
+// close stops accepting connections and drops the current ones, as if
+// target had gone away.
+func (p *recordingProxy) close() {
+	p.listener.Close()
+	p.drop()
+}
+
+// acks returns the offsets of the REPLCONF ACKs the replica has sent.
+func (p *recordingProxy) acks(tb testing.TB) []int {
+	tb.Helper()
+	p.mu.Lock()
+	reader := bufio.NewReader(bytes.NewReader(p.upstream.Bytes()))
+	p.mu.Unlock()
+
+	var offsets []int
+	for {
+		command, args, err := parseRESPString(reader)
+		if err != nil {
+			return offsets
+		}
+		if command == "replconf" && len(args) == 2 && strings.ToLower(args[0]) == "ack" {
+			offset, err := strconv.Atoi(args[1])
+			if err != nil {
+				tb.Fatal(err)
+			}
+			offsets = append(offsets, offset)
+		}
+	}
+}
+
+// linkStatus returns master_link_status from INFO replication.
+func linkStatus(tb testing.TB, client *testClient) string {
+	tb.Helper()
+	info, _ := client.do("INFO", "replication").(string)
+	for _, line := range strings.Split(info, "\n") {
+		if status, ok := strings.CutPrefix(strings.TrimSpace(line), "master_link_status:"); ok {
+			return status
+		}
+	}
+	tb.Fatalf("no master_link_status in %q", info)
+	return ""
+}
+
+func TestReplicaReconnectsAfterLinkDrop(t *testing.T) {
+	master := startTestServer(t, "")
+	proxy := startRecordingProxy(t, master.addr)
+	replica := startTestServer(t, masterDetailsOf(proxy.addr))
+	client := dialTestClient(t, replica.addr)
+
+	waitFor(t, "the link to come up", func() bool { return linkStatus(t, client) == "up" })
+	waitFor(t, "a periodic REPLCONF ACK", func() bool { return len(proxy.acks(t)) > 0 })
+
+	proxy.drop()
+	waitFor(t, "the link to go down", func() bool { return linkStatus(t, client) == "down" })
+	waitFor(t, "the link to come back", func() bool { return linkStatus(t, client) == "up" })
+
+	dialTestClient(t, master.addr).do("SET", "after", "reconnect")
+	waitFor(t, "the write to reach the replica", func() bool {
+		return client.do("GET", "after") == "reconnect"
+	})
+}
+
+func TestReplicaofAttachesAndPromotes(t *testing.T) {
+	master := startTestServer(t, "")
+	server := startTestServer(t, "")
+	masterClient := dialTestClient(t, master.addr)
+	client := dialTestClient(t, server.addr)
+
+	host, port, _ := net.SplitHostPort(master.addr)
+	if reply := client.do("REPLICAOF", host, port); reply != "OK" {
+		t.Fatalf("REPLICAOF replied %v", reply)
+	}
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+	masterClient.do("SET", "key", "value")
+	waitFor(t, "the write to reach the replica", func() bool {
+		server.store.mu.RLock()
+		defer server.store.mu.RUnlock()
+		return server.store.store["key"].content == "value"
+	})
+	masterReplid, _ := master.config.server.repl.ids()
+
+	if reply := client.do("REPLICAOF", "NO", "ONE"); reply != "OK" {
+		t.Fatalf("REPLICAOF NO ONE replied %v", reply)
+	}
+	info, _ := client.do("INFO", "replication").(string)
+	if !strings.Contains(info, "role:master") || !strings.Contains(info, "master_replid2:"+masterReplid) {
+		t.Fatalf("promoted replica reports %q, want role:master and master_replid2:%s", info, masterReplid)
+	}
+	waitFor(t, "the master to drop the link", func() bool { return master.cm.replicaCount() == 0 })
+	if reply := client.do("REPLICAOF", "NO", "ONE"); reply != "OK" {
+		t.Fatalf("REPLICAOF NO ONE on a master replied %v", reply)
+	}
+}
+
+func TestReplicaRejectsClientWrites(t *testing.T) {
+	master := startTestServer(t, "")
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	client := dialTestClient(t, replica.addr)
+	waitFor(t, "the link to come up", replica.config.server.link.isUp)
+
+	reply, _ := client.do("SET", "key", "value").(replyError)
+	if !strings.HasPrefix(string(reply), "READONLY ") {
+		t.Fatalf("SET on a replica replied %q, want READONLY", reply)
+	}
+
+	// Writes from the master are still applied.
+	dialTestClient(t, master.addr).do("SET", "key", "from-master")
+	waitFor(t, "the write to reach the replica", func() bool {
+		return client.do("GET", "key") == "from-master"
+	})
+}
+
+func TestReplicaWithoutStaleDataRefusesReads(t *testing.T) {
+	// Nothing listens on a closed listener's port, so the link stays down.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	replica := startTestServer(t, masterDetailsOf(listener.Addr().String()), func(c *config) {
+		c.server.replicaServeStaleData = false
+	})
+	client := dialTestClient(t, replica.addr)
+
+	reply, _ := client.do("GET", "key").(replyError)
+	if !strings.HasPrefix(string(reply), "MASTERDOWN ") {
+		t.Fatalf("GET with the link down replied %q, want MASTERDOWN", reply)
+	}
+	if reply := client.do("PING"); reply != "PONG" {
+		t.Fatalf("PING with the link down replied %v", reply)
+	}
+}
+
+func TestSubReplicaReceivesTheMasterStream(t *testing.T) {
+	master := startTestServer(t, "")
+	upper := startRecordingProxy(t, master.addr)
+	replica := startTestServer(t, masterDetailsOf(upper.addr))
+	lower := startRecordingProxy(t, replica.addr)
+	subReplica := startTestServer(t, masterDetailsOf(lower.addr))
+	masterReplid, _ := master.config.server.repl.ids()
+	// The sub-replica resyncs once the replica has synced with the master.
+	waitFor(t, "the sub-replica to sync with the master's history", func() bool {
+		replid, _ := subReplica.config.server.repl.ids()
+		return replid == masterReplid && subReplica.config.server.link.isUp()
+	})
+
+	client := dialTestClient(t, master.addr)
+	client.do("SET", "greeting", "héllo")
+	client.do("SET", "session", "abc", "PX", "60000")
+	waitFor(t, "the writes to reach the sub-replica", func() bool {
+		return dialTestClient(t, subReplica.addr).do("GET", "session") == "abc"
+	})
+
+	replid, offset, relayed := lower.stream(t)
+	if replid != masterReplid {
+		t.Fatalf("sub-replica synced with replication ID %s, want the master's %s", replid, masterReplid)
+	}
+	_, masterOffset, received := upper.stream(t)
+	if offset != masterOffset || !bytes.Equal(relayed, received) {
+		t.Fatalf("replica relayed %q from offset %d, want %q from offset %d", relayed, offset, received, masterOffset)
+	}
+}
+
+func TestReplicaOffsetCountsRawMasterBytes(t *testing.T) {
+	master := startTestServer(t, "")
+	proxy := startRecordingProxy(t, master.addr)
+	replica := startTestServer(t, masterDetailsOf(proxy.addr))
+	waitFor(t, "the replica link", replica.config.server.link.isUp)
+
+	client := dialTestClient(t, master.addr)
+	// Multi-byte values make byte and rune counts differ.
+	client.do("SET", "greeting", "héllo wörld")
+	client.do("SET", "session", "abc", "PX", "60000")
+	client.do("SET", "counter", "42")
+
+	// Replies can reach the client before the write reaches the replica, so
+	// the stream is complete once everything the master counted went through.
+	synced := func() bool {
+		_, masterOffset := master.config.server.repl.ids()
+		sent := proxy.streamOffset(t)
+		return masterOffset == sent && int(replica.config.server.bytesReadAsReplica.Load()) == sent
+	}
+	waitFor(t, "the replica offset to match the master stream", synced)
+
+	t.Run("PING", func(t *testing.T) {
+		before := proxy.streamOffset(t)
+		master.cm.propagateCommandsToReplica(respGenerator([]string{"PING"}))
+		waitFor(t, "the PING to reach the replica", func() bool { return proxy.streamOffset(t) > before })
+		waitFor(t, "the replica to count the PING", synced)
+		if got, want := proxy.streamOffset(t)-before, len("*1\r\n$4\r\nPING\r\n"); got != want {
+			t.Fatalf("PING advanced the offset by %d bytes, want %d", got, want)
+		}
+	})
+
+	t.Run("GETACK", func(t *testing.T) {
+		// Sending a PING and the GETACK in one write leaves no time for a
+		// periodic ACK to report the offset between them, so only the
+		// GETACK reply can carry it.
+		ping := respGenerator([]string{"PING"})
+		getack := respGenerator([]string{"REPLCONF", "GETACK", "*"})
+		want := proxy.streamOffset(t) + len(ping)
+		master.cm.propagateCommandsToReplica(ping + getack)
+
+		waitFor(t, "the GETACK reply", func() bool {
+			for _, ack := range proxy.acks(t) {
+				if ack == want {
+					return true
+				}
+			}
+			return false
+		})
+		waitFor(t, "the replica to count the GETACK", synced)
+		if got := int(replica.config.server.bytesReadAsReplica.Load()); got != want+len(getack) {
+			t.Fatalf("replica offset %d after GETACK, want %d", got, want+len(getack))
+		}
+	})
+}
+
+func TestPromotedReplicaLetsTheOldMasterContinue(t *testing.T) {
+	master := startTestServer(t, "")
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	masterClient := dialTestClient(t, master.addr)
+	replicaClient := dialTestClient(t, replica.addr)
+	waitFor(t, "the replica link", replica.config.server.link.isUp)
+
+	masterClient.do("SET", "before", "promotion")
+	waitFor(t, "the write to reach the replica", func() bool {
+		return replicaClient.do("GET", "before") == "promotion"
+	})
+	replicaClient.do("REPLICAOF", "NO", "ONE")
+	replicaClient.do("SET", "after", "promotion")
+
+	// The old master shares the promoted replica's history up to the
+	// promotion, so it only needs the writes made since.
+	proxy := startRecordingProxy(t, replica.addr)
+	host, port, _ := net.SplitHostPort(proxy.addr)
+	masterClient.do("REPLICAOF", host, port)
+	waitFor(t, "the old master to catch up", func() bool {
+		return masterClient.do("GET", "after") == "promotion"
+	})
+	if reply := proxy.received(); !strings.Contains(reply, "+CONTINUE") {
+		t.Fatalf("old master was not partially resynced: %q", reply)
+	}
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	master := startTestServer(t, "", func(c *config) { c.server.minReplicasToWrite = 1 })
+	client := dialTestClient(t, master.addr)
+
+	reply, _ := client.do("SET", "key", "value").(replyError)
+	if !strings.HasPrefix(string(reply), "NOREPLICAS ") {
+		t.Fatalf("SET without replicas replied %q, want NOREPLICAS", reply)
+	}
+	if reply := client.do("GET", "key"); reply != nil {
+		t.Fatalf("refused SET was applied: GET replied %v", reply)
+	}
+
+	startTestServer(t, masterDetailsOf(master.addr))
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+	if reply := client.do("SET", "key", "value"); reply != "OK" {
+		t.Fatalf("SET with a replica replied %v", reply)
+	}
+}
+
+func TestGoodReplicaCountIgnoresLaggingReplicas(t *testing.T) {
+	cm := newConnectionManager(newReplicationState(1024))
+	for _, addr := range []string{"fresh", "lagging"} {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		defer peer.Close()
+		cm.addConnection(addr, conn, "replica")
+	}
+	cm.replicas["lagging"].lastAck = time.Now().Add(-time.Minute)
+
+	if got := cm.goodReplicaCount(10 * time.Second); got != 1 {
+		t.Fatalf("goodReplicaCount = %d, want 1", got)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// replyWriter encodes replies in the protocol a client negotiated with
+// HELLO and buffers them until flush. RESP2 clients get the closest RESP2
+// shape for the RESP3-only types: maps and sets become flat arrays, doubles,
+// big numbers and verbatim strings become bulk strings, and booleans become
+// integers.
+type replyWriter struct {
+	proto int
+	buf   *bufio.Writer
+}
+
+// replyBufferSize bounds the replies buffered for a client. Replies to a
+// long pipeline are written out whenever the buffer fills, so it never
+// grows past this.
+const replyBufferSize = 16 * 1024
+
+func newReplyWriter(dst io.Writer, proto int) *replyWriter {
+	return &replyWriter{proto: proto, buf: bufio.NewWriterSize(dst, replyBufferSize)}
+}
+
+func (w *replyWriter) flush() error {
+	return w.buf.Flush()
+}
+
+func (w *replyWriter) simpleString(s string) {
+	w.buf.WriteString("+" + s + "\r\n")
+}
+
+// errorReply writes an error. Messages are expected to start with an error
+// code such as ERR or WRONGTYPE; ERR is added when they do not.
+func (w *replyWriter) errorReply(msg string) {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	code, _, _ := strings.Cut(msg, " ")
+	if code == "" || strings.ToUpper(code) != code {
+		msg = "ERR " + msg
+	}
+	w.buf.WriteString("-" + msg + "\r\n")
+}
+
+func (w *replyWriter) integer(n int64) {
+	w.buf.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *replyWriter) bulk(s string) {
+	fmt.Fprintf(w.buf, "$%d\r\n%s\r\n", len(s), s)
+}
+
+// bulkArray writes an array of bulk strings.
+func (w *replyWriter) bulkArray(items []string) {
+	w.arrayHeader(len(items))
+	for _, item := range items {
+		w.bulk(item)
+	}
+}
+
+func (w *replyWriter) null() {
+	if w.proto == 3 {
+		w.buf.WriteString("_\r\n")
+	} else {
+		w.buf.WriteString("$-1\r\n")
+	}
+}
+
+func (w *replyWriter) nullArray() {
+	if w.proto == 3 {
+		w.buf.WriteString("_\r\n")
+	} else {
+		w.buf.WriteString("*-1\r\n")
+	}
+}
+
+func (w *replyWriter) arrayHeader(n int) {
+	fmt.Fprintf(w.buf, "*%d\r\n", n)
+}
+
+// mapHeader starts a map of n key/value pairs.
+func (w *replyWriter) mapHeader(n int) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.buf, "%%%d\r\n", n)
+	} else {
+		fmt.Fprintf(w.buf, "*%d\r\n", 2*n)
+	}
+}
+
+func (w *replyWriter) setHeader(n int) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.buf, "~%d\r\n", n)
+	} else {
+		fmt.Fprintf(w.buf, "*%d\r\n", n)
+	}
+}
+
+// pushHeader starts an out-of-band message such as a pub/sub delivery.
+func (w *replyWriter) pushHeader(n int) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.buf, ">%d\r\n", n)
+	} else {
+		fmt.Fprintf(w.buf, "*%d\r\n", n)
+	}
+}
+
+func (w *replyWriter) double(f float64) {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', 17, 64)
+	}
+	if w.proto == 3 {
+		w.buf.WriteString("," + s + "\r\n")
+	} else {
+		w.bulk(s)
+	}
+}
+
+func (w *replyWriter) boolean(b bool) {
+	switch {
+	case w.proto == 3 && b:
+		w.buf.WriteString("#t\r\n")
+	case w.proto == 3:
+		w.buf.WriteString("#f\r\n")
+	case b:
+		w.integer(1)
+	default:
+		w.integer(0)
+	}
+}
+
+// bigNumber writes an integer too large for a 64-bit reply, given in decimal.
+func (w *replyWriter) bigNumber(n string) {
+	if w.proto == 3 {
+		w.buf.WriteString("(" + n + "\r\n")
+	} else {
+		w.bulk(n)
+	}
+}
+
+// verbatim writes text with a three letter format hint such as "txt".
+func (w *replyWriter) verbatim(format, s string) {
+	if w.proto == 3 {
+		fmt.Fprintf(w.buf, "=%d\r\n%s:%s\r\n", len(s)+4, format, s)
+	} else {
+		w.bulk(s)
+	}
+}
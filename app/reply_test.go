@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestReplyWriterEncodings(t *testing.T) {
+	write := func(w *replyWriter) {
+		w.mapHeader(1)
+		w.bulk("k")
+		w.setHeader(1)
+		w.double(math.Inf(1))
+		w.boolean(true)
+		w.bigNumber("12345678901234567890")
+		w.verbatim("txt", "hi")
+		w.null()
+		w.nullArray()
+		w.pushHeader(0)
+	}
+	for proto, want := range map[int]string{
+		2: "*2\r\n$1\r\nk\r\n*1\r\n$3\r\ninf\r\n:1\r\n$20\r\n12345678901234567890\r\n$2\r\nhi\r\n$-1\r\n*-1\r\n*0\r\n",
+		3: "%1\r\n$1\r\nk\r\n~1\r\n,inf\r\n#t\r\n(12345678901234567890\r\n=6\r\ntxt:hi\r\n_\r\n_\r\n>0\r\n",
+	} {
+		var out strings.Builder
+		w := newReplyWriter(&out, proto)
+		write(w)
+		w.flush()
+		if out.String() != want {
+			t.Errorf("RESP%d wrote %q, want %q", proto, out.String(), want)
+		}
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	var out strings.Builder
+	w := newReplyWriter(&out, 2)
+	w.errorReply("BUSYKEY Target key name already exists.")
+	w.errorReply("open dump.rdb: no such\r\nfile")
+	w.flush()
+	if want := "-BUSYKEY Target key name already exists.\r\n-ERR open dump.rdb: no such  file\r\n"; out.String() != want {
+		t.Fatalf("errorReply wrote %q, want %q", out.String(), want)
+	}
+
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"NOPE", "a"}, "ERR unknown command 'nope', with args beginning with: 'a' "},
+		{[]string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"SET", "k", "v", "PX", "soon"}, "ERR value is not an integer or out of range"},
+		{[]string{"CLUSTER", "INFO"}, "ERR This instance has cluster support disabled"},
+		{[]string{"MIGRATE", "127.0.0.1", "1", "k", "1", "1000"}, "ERR DB index is out of range"},
+	} {
+		if reply := client.do(test.args...); reply != replyError(test.want) {
+			t.Errorf("%v replied %v, want -%s", test.args, reply, test.want)
+		}
+	}
+	// The connection is still usable after errors.
+	if reply := client.do("PING"); reply != "PONG" {
+		t.Fatalf("PING after errors replied %v", reply)
+	}
+}
+
+func TestHelloSwitchesReplyShapes(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	reply, ok := client.do("HELLO", "3", "SETNAME", "shapes").(map[string]any)
+	if !ok {
+		t.Fatalf("HELLO 3 did not reply with a map: %v", reply)
+	}
+	if len(reply) != 7 || reply["server"] != "redis" || reply["proto"] != 3 || reply["role"] != "master" || reply["mode"] != "standalone" {
+		t.Fatalf("HELLO 3 replied %v", reply)
+	}
+	if modules, ok := reply["modules"].([]any); !ok || len(modules) != 0 {
+		t.Fatalf("HELLO 3 listed modules %v", reply["modules"])
+	}
+
+	if info, ok := client.do("INFO", "replication").(verbatimString); !ok || !strings.Contains(string(info), "role:master") {
+		t.Fatalf("INFO over RESP3 replied %v, want a verbatim string", info)
+	}
+	if config, ok := client.do("CONFIG", "GET", "dir").(map[string]any); !ok || len(config) != 1 {
+		t.Fatalf("CONFIG GET over RESP3 replied %v, want a map", config)
+	}
+	if config, ok := client.do("CONFIG", "GET", "no-such-parameter").(map[string]any); !ok || len(config) != 0 {
+		t.Fatalf("CONFIG GET of an unknown parameter replied %v, want an empty map", config)
+	}
+	if reply := client.do("GET", "missing"); reply != nil {
+		t.Fatalf("GET of a missing key replied %v", reply)
+	}
+
+	if reply, ok := client.do("HELLO", "2").([]any); !ok || len(reply) != 14 {
+		t.Fatalf("HELLO 2 replied %v, want a flat array", reply)
+	}
+	if config, ok := client.do("CONFIG", "GET", "no-such-parameter").([]any); !ok || len(config) != 0 {
+		t.Fatalf("CONFIG GET of an unknown parameter replied %v, want an empty array", config)
+	}
+	if info, ok := client.do("INFO", "replication").(string); !ok || !strings.Contains(info, "role:master") {
+		t.Fatalf("INFO over RESP2 replied %v, want a bulk string", info)
+	}
+	if reply, _ := client.do("HELLO", "4").(replyError); !strings.HasPrefix(string(reply), "NOPROTO") {
+		t.Fatalf("HELLO 4 replied %q, want NOPROTO", reply)
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// noScriptCommands can't be called from a script, as they wait on other
+// connections or change the state of the calling connection.
+var noScriptCommands = map[string]bool{
+	"psync":        true,
+	"replconf":     true,
+	"replicaof":    true,
+	"slaveof":      true,
+	"failover":     true,
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"ssubscribe":   true,
+	"sunsubscribe": true,
+	"quit":         true,
+	"hello":        true,
+	"auth":         true,
+	"acl":          true,
+	"client":       true,
+	"wait":         true,
+	"multi":        true,
+	"exec":         true,
+	"discard":      true,
+	"watch":        true,
+	"unwatch":      true,
+	"eval":         true,
+	"evalsha":      true,
+	"script":       true,
+	"function":     true,
+	"fcall":        true,
+	"fcall_ro":     true,
+}
+
+// scriptEngine runs the Lua scripts of EVAL and EVALSHA and the functions
+// of FCALL. All of them share one Lua state and run one at a time.
+// handleCommand holds the store's exec lock for writing around them, so a
+// script is as atomic as a transaction.
+type scriptEngine struct {
+	mu        sync.Mutex
+	state     *lua.LState
+	scripts   map[string]*lua.LFunction
+	libraries map[string]*library
+	functions map[string]*function
+	// run is the invocation in progress, used by redis.call.
+	run *scriptRun
+	// loading is the library whose code FUNCTION LOAD is running, which
+	// redis.register_function adds to.
+	loading *library
+
+	// The running script is tracked separately from mu, which the script
+	// holds, so that SCRIPT KILL can reach it.
+	runMu   sync.Mutex
+	running bool
+	started time.Time
+	wrote   bool
+	killed  bool
+	cancel  context.CancelFunc
+	// busyCh is closed once the running script passes busy-reply-threshold,
+	// and replaced when that script ends. runs tells a stale timer apart.
+	busyCh    chan struct{}
+	busyTimer *time.Timer
+	runs      uint64
+}
+
+type scriptRun struct {
+	client   *client
+	replies  bytes.Buffer
+	readOnly bool
+	store    *redisStore
+	config   *config
+	cm       *connectionManager
+}
+
+func newScriptEngine() *scriptEngine {
+	e := &scriptEngine{scripts: make(map[string]*lua.LFunction), busyCh: make(chan struct{})}
+	e.flushLibraries()
+	e.state = e.newState()
+	return e
+}
+
+// newState creates a Lua state with the libraries Redis offers scripts and
+// the redis table.
+func (e *scriptEngine) newState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	libs := []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	}
+	for _, lib := range libs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Scripts must not reach the file system.
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			return e.redisCall(L, true)
+		},
+		"pcall": func(L *lua.LState) int {
+			return e.redisCall(L, false)
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1hex(L.CheckString(1))))
+			return 1
+		},
+		"error_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(replyTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"register_function": e.registerFunction,
+	})
+	L.SetGlobal("redis", redis)
+	return L
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// replyTable builds the {err=...} and {ok=...} tables that stand for error
+// and status replies in Lua.
+func replyTable(L *lua.LState, field, msg string) *lua.LTable {
+	tbl := L.NewTable()
+	tbl.RawSetString(field, lua.LString(msg))
+	return tbl
+}
+
+// scriptKeys returns the keys an EVAL or EVALSHA call declares.
+func scriptKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		return nil
+	}
+	return args[2 : 2+numKeys]
+}
+
+// load compiles a script and caches it under its SHA1. The caller holds
+// e.mu.
+func (e *scriptEngine) load(body string) (string, *lua.LFunction, error) {
+	sha := sha1hex(body)
+	if fn, ok := e.scripts[sha]; ok {
+		return sha, fn, nil
+	}
+	fn, err := e.state.Load(strings.NewReader(body), "@user_script")
+	if err != nil {
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) && apiErr.Cause != nil {
+			err = apiErr.Cause
+		}
+		return "", nil, fmt.Errorf("ERR Error compiling script (new function): %s", strings.ReplaceAll(err.Error(), "\n", " "))
+	}
+	e.scripts[sha] = fn
+	return sha, fn, nil
+}
+
+// parseNumKeys checks the numkeys argument of EVAL and FCALL against the
+// arguments that follow it.
+func parseNumKeys(args []string) (int, error) {
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil {
+		return 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return 0, errors.New("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-2 {
+		return 0, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	return numKeys, nil
+}
+
+// eval implements EVAL script numkeys [key ...] [arg ...] and EVALSHA, which
+// names the script by its SHA1 instead.
+func (e *scriptEngine) eval(cl *client, command string, args []string, store *redisStore, config *config, cm *connectionManager) error {
+	numKeys, err := parseNumKeys(args)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var sha string
+	var fn *lua.LFunction
+	if command == "eval" {
+		if sha, fn, err = e.load(args[0]); err != nil {
+			return err
+		}
+	} else {
+		sha = strings.ToLower(args[0])
+		if fn = e.scripts[sha]; fn == nil {
+			return errors.New("NOSCRIPT No matching script. Please use EVAL.")
+		}
+	}
+
+	e.state.SetGlobal("KEYS", stringsTable(e.state, args[2:2+numKeys]))
+	e.state.SetGlobal("ARGV", stringsTable(e.state, args[2+numKeys:]))
+	return e.execute(cl, "f_"+sha, fn, nil, false, store, config, cm)
+}
+
+// execute runs fn with args and writes what it returns to cl. The script's
+// writes are replicated as their effects, wrapped in MULTI/EXEC, rather than
+// as the script itself. A readOnly script may not write at all. The caller
+// holds e.mu.
+func (e *scriptEngine) execute(cl *client, name string, fn *lua.LFunction, args []lua.LValue, readOnly bool, store *redisStore, config *config, cm *connectionManager) error {
+	L := e.state
+	run := &scriptRun{store: store, config: config, cm: cm, readOnly: readOnly}
+	run.client = &client{id: nextClientID.Add(1), user: cl.user, authenticated: cl.authenticated, fromScript: true, protocol: 2, out: newReplyWriter(&run.replies, 2)}
+	e.run = run
+	defer func() { e.run = nil }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+	e.begin(cancel, time.Duration(config.server.busyReplyThreshold)*time.Millisecond)
+	defer e.end()
+	cm.beginTransaction()
+	defer cm.endTransaction()
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	err := L.PCall(len(args), 1, nil)
+	defer L.SetTop(0)
+	if err != nil {
+		return e.scriptError(err, name)
+	}
+	luaToReply(cl.out, L.Get(-1))
+	return nil
+}
+
+func stringsTable(L *lua.LState, items []string) *lua.LTable {
+	tbl := L.CreateTable(len(items), 0)
+	for i, item := range items {
+		tbl.RawSetInt(i+1, lua.LString(item))
+	}
+	return tbl
+}
+
+// scriptError turns a failed script into the error reply for its caller.
+func (e *scriptEngine) scriptError(err error, name string) error {
+	e.runMu.Lock()
+	killed := e.killed
+	e.runMu.Unlock()
+	if killed {
+		return errors.New("ERR Script killed by user with SCRIPT KILL...")
+	}
+	var apiErr *lua.ApiError
+	if !errors.As(err, &apiErr) {
+		return fmt.Errorf("ERR Error running script (call to %s): %s", name, err)
+	}
+	// Errors raised by redis.call, or returned with redis.error_reply and
+	// raised with error(), reach the caller unchanged.
+	if msg, ok := errorReplyMessage(apiErr.Object); ok {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("ERR Error running script (call to %s): %s", name, apiErr.Object.String())
+}
+
+// errorReplyMessage returns the message of an {err=...} table.
+func errorReplyMessage(v lua.LValue) (string, bool) {
+	if tbl, ok := v.(*lua.LTable); ok {
+		if msg, ok := tbl.RawGetString("err").(lua.LString); ok {
+			return string(msg), true
+		}
+	}
+	return "", false
+}
+
+func (e *scriptEngine) begin(cancel context.CancelFunc, threshold time.Duration) {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	e.running, e.started, e.wrote, e.killed, e.cancel = true, time.Now(), false, false, cancel
+	e.runs++
+	run, busyCh := e.runs, e.busyCh
+	e.busyTimer = time.AfterFunc(threshold, func() {
+		e.runMu.Lock()
+		defer e.runMu.Unlock()
+		if e.running && e.runs == run {
+			close(busyCh)
+		}
+	})
+}
+
+func (e *scriptEngine) end() {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	e.running, e.cancel = false, nil
+	e.busyTimer.Stop()
+	select {
+	case <-e.busyCh:
+		e.busyCh = make(chan struct{})
+	default:
+	}
+}
+
+// busy reports whether a script has been running for longer than threshold,
+// from which point other clients are told to wait or kill it.
+func (e *scriptEngine) busy(threshold time.Duration) bool {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	return e.running && time.Since(e.started) > threshold
+}
+
+// busySignal returns a channel that is closed once the running script, or
+// the next one if none is running, passes busy-reply-threshold.
+func (e *scriptEngine) busySignal() <-chan struct{} {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	return e.busyCh
+}
+
+// kill implements SCRIPT KILL. A script that already wrote can't be stopped,
+// as that would leave half of its effects applied.
+func (e *scriptEngine) kill() error {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	if !e.running {
+		return errors.New("NOTBUSY No scripts in execution right now.")
+	}
+	if e.wrote {
+		return errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	e.killed = true
+	e.cancel()
+	return nil
+}
+
+// redisCall implements redis.call and redis.pcall. Both run the command as
+// handleCommand would and convert its reply to Lua; an error reply is raised
+// by redis.call and returned as an {err=...} table by redis.pcall.
+func (e *scriptEngine) redisCall(L *lua.LState, raise bool) int {
+	reply := e.call(L)
+	if tbl, ok := reply.(*lua.LTable); ok && raise && tbl.RawGetString("err") != lua.LNil {
+		L.Error(tbl, 1)
+		return 0
+	}
+	L.Push(reply)
+	return 1
+}
+
+func (e *scriptEngine) call(L *lua.LState) lua.LValue {
+	n := L.GetTop()
+	if n == 0 {
+		return replyTable(L, "err", "ERR Please specify at least one argument for this redis lib call")
+	}
+	args := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = string(arg)
+		case lua.LNumber:
+			args[i-1] = arg.String()
+		default:
+			return replyTable(L, "err", "ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	command := strings.ToLower(args[0])
+	if _, ok := commandArity[command]; !ok {
+		return replyTable(L, "err", "ERR Unknown Redis command called from script")
+	}
+	if noScriptCommands[command] {
+		return replyTable(L, "err", "ERR This Redis command is not allowed from script")
+	}
+	if !arityOK(command, args[1:]) {
+		return replyTable(L, "err", "ERR Wrong number of args calling Redis command from script")
+	}
+
+	run := e.run
+	if run == nil {
+		return replyTable(L, "err", "ERR Redis commands can only be called while a script runs")
+	}
+	if run.readOnly && isWriteCommand(command, args[1:]) {
+		return replyTable(L, "err", "ERR Write commands are not allowed from read-only scripts.")
+	}
+	if err := checkCommand(run.client, command, args[1:], run.store, run.config, run.cm); err != nil {
+		return replyTable(L, "err", err.Error())
+	}
+	if isWriteCommand(command, args[1:]) {
+		e.runMu.Lock()
+		e.wrote = true
+		e.runMu.Unlock()
+	}
+	if err := runCommand(run.client, command, args[1:], run.store, run.config, run.cm); err != nil {
+		run.client.out.errorReply(err.Error())
+	}
+	run.client.out.flush()
+	defer run.replies.Reset()
+	reply, err := respToLua(L, bufio.NewReader(&run.replies))
+	if err != nil {
+		return replyTable(L, "err", "ERR "+err.Error())
+	}
+	return reply
+}
+
+// respToLua converts a RESP2 reply to Lua: integers become numbers, bulk
+// strings strings, arrays tables, nulls false, and status and error replies
+// {ok=...} and {err=...} tables.
+func respToLua(L *lua.LState, reader *bufio.Reader) (lua.LValue, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return replyTable(L, "ok", line[1:]), nil
+	case '-':
+		return replyTable(L, "err", line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LNumber(n), nil
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return lua.LFalse, nil
+		}
+		payload := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return nil, err
+		}
+		return lua.LString(payload[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return lua.LFalse, nil
+		}
+		tbl := L.CreateTable(count, 0)
+		for i := 1; i <= count; i++ {
+			item, err := respToLua(L, reader)
+			if err != nil {
+				return nil, err
+			}
+			tbl.RawSetInt(i, item)
+		}
+		return tbl, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// luaToReply writes a script's return value: numbers are truncated to
+// integers, true becomes 1 and false a null, {ok=...} and {err=...} tables
+// become status and error replies, and other tables arrays up to their first
+// nil.
+func luaToReply(w *replyWriter, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		w.bulk(string(v))
+	case lua.LNumber:
+		w.integer(int64(v))
+	case lua.LBool:
+		if v {
+			w.integer(1)
+		} else {
+			w.null()
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			w.errorReply(string(msg))
+			return
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			w.simpleString(strings.NewReplacer("\r", " ", "\n", " ").Replace(string(msg)))
+			return
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		w.arrayHeader(n)
+		for i := 1; i <= n; i++ {
+			luaToReply(w, v.RawGetInt(i))
+		}
+	default:
+		w.null()
+	}
+}
+
+// scriptCommand implements SCRIPT LOAD, EXISTS, FLUSH and KILL.
+func (e *scriptEngine) scriptCommand(args []string, w *replyWriter) error {
+	switch strings.ToLower(args[0]) {
+	case "load":
+		if len(args) != 2 {
+			return errors.New("ERR wrong number of arguments for 'script|load' command")
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		sha, _, err := e.load(args[1])
+		if err != nil {
+			return err
+		}
+		w.bulk(sha)
+	case "exists":
+		if len(args) < 2 {
+			return errors.New("ERR wrong number of arguments for 'script|exists' command")
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		w.arrayHeader(len(args) - 1)
+		for _, sha := range args[1:] {
+			if _, ok := e.scripts[strings.ToLower(sha)]; ok {
+				w.integer(1)
+			} else {
+				w.integer(0)
+			}
+		}
+	case "flush":
+		if len(args) > 2 || len(args) == 2 && !strings.EqualFold(args[1], "sync") && !strings.EqualFold(args[1], "async") {
+			return errors.New("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.scripts = make(map[string]*lua.LFunction)
+		w.simpleString("OK")
+	case "kill":
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'script|kill' command")
+		}
+		if err := e.kill(); err != nil {
+			return err
+		}
+		w.simpleString("OK")
+	default:
+		return fmt.Errorf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", args[0])
+	}
+	return nil
+}
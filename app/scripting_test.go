@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEvalRunsCommands(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	script := "redis.call('SET', KEYS[1], ARGV[1]) return redis.call('GET', KEYS[1])"
+	if reply := client.do("EVAL", script, "1", "k", "v"); reply != "v" {
+		t.Fatalf("EVAL replied %v", reply)
+	}
+	for script, want := range map[string]any{
+		"return {1, 'two', {3}, true, false}":           []any{1, "two", []any{3}, 1, nil},
+		"return 3.9":                                    3,
+		"return redis.status_reply('FINE')":             "FINE",
+		"return redis.error_reply('MY error')":          replyError("MY error"),
+		"return redis.call('NOPE')":                     replyError("ERR Unknown Redis command called from script"),
+		"local r = redis.pcall('NOPE') return r['err']": "ERR Unknown Redis command called from script",
+		"return redis.sha1hex('')":                      "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		"return redis.call('SET', 'k')":                 replyError("ERR Wrong number of args calling Redis command from script"),
+	} {
+		if reply := client.do("EVAL", script, "0"); !reflect.DeepEqual(reply, want) {
+			t.Errorf("EVAL %q replied %#v, want %#v", script, reply, want)
+		}
+	}
+	if _, ok := client.do("EVAL", "return (", "0").(replyError); !ok {
+		t.Fatal("EVAL of a script that does not compile succeeded")
+	}
+	if _, ok := client.do("EVAL", "return 1", "2", "k").(replyError); !ok {
+		t.Fatal("EVAL with more keys than arguments succeeded")
+	}
+}
+
+func TestEvalshaUsesTheScriptCache(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	sha, ok := client.do("SCRIPT", "LOAD", "return ARGV[1]").(string)
+	if !ok || sha != sha1hex("return ARGV[1]") {
+		t.Fatalf("SCRIPT LOAD replied %v", sha)
+	}
+	if reply := client.do("EVALSHA", sha, "0", "x"); reply != "x" {
+		t.Fatalf("EVALSHA replied %v", reply)
+	}
+	if reply := client.do("SCRIPT", "EXISTS", sha, sha1hex("other")); !reflect.DeepEqual(reply, []any{1, 0}) {
+		t.Fatalf("SCRIPT EXISTS replied %v", reply)
+	}
+	client.do("SCRIPT", "FLUSH")
+	if reply := client.do("EVALSHA", sha, "0"); reply != replyError("NOSCRIPT No matching script. Please use EVAL.") {
+		t.Fatalf("EVALSHA after SCRIPT FLUSH replied %v", reply)
+	}
+}
+
+func TestScriptWritesReachReplicasAsOneBlock(t *testing.T) {
+	master := startTestServer(t, "")
+	proxy := startRecordingProxy(t, master.addr)
+	replica := startTestServer(t, masterDetailsOf(proxy.addr))
+	waitFor(t, "the replica link", replica.config.server.link.isUp)
+
+	client := dialTestClient(t, master.addr)
+	client.do("EVAL", "redis.call('SET', 'a', '1') redis.call('SET', 'b', '2')", "0")
+	waitFor(t, "the script's writes to reach the replica", func() bool {
+		return dialTestClient(t, replica.addr).do("GET", "b") == "2"
+	})
+
+	_, _, stream := proxy.stream(t)
+	want := respGenerator([]string{"MULTI"}) + respGenerator([]string{"set", "a", "1"}) +
+		respGenerator([]string{"set", "b", "2"}) + respGenerator([]string{"EXEC"})
+	if !bytes.Contains(stream, []byte(want)) {
+		t.Fatalf("replication stream %q does not hold the block %q", stream, want)
+	}
+}
+
+func scriptRunning(e *scriptEngine) bool {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	return e.running
+}
+
+func TestBusyScriptCanBeKilled(t *testing.T) {
+	server := startTestServer(t, "", func(config *config) { config.server.busyReplyThreshold = 20 })
+	runner := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	runner.send("EVAL", "while true do end", "0")
+	waitFor(t, "the script to run past the threshold", func() bool {
+		return other.do("GET", "k") == replyError(errBusyScript.Error())
+	})
+	if reply := other.do("SCRIPT", "KILL"); reply != "OK" {
+		t.Fatalf("SCRIPT KILL replied %v", reply)
+	}
+	if reply := runner.read(); reply != replyError("ERR Script killed by user with SCRIPT KILL...") {
+		t.Fatalf("killed EVAL replied %v", reply)
+	}
+	if reply := other.do("SCRIPT", "KILL"); reply != replyError("NOTBUSY No scripts in execution right now.") {
+		t.Fatalf("SCRIPT KILL without a script replied %v", reply)
+	}
+
+	// A script that wrote can't be killed and runs to the end, which the
+	// test decides by writing to the store behind its back.
+	runner.send("EVAL", "redis.call('SET', 'k', 'v') while not redis.call('GET', 'stop') do end return 1", "0")
+	waitFor(t, "the writing script to run past the threshold", func() bool {
+		return other.do("GET", "k") == replyError(errBusyScript.Error())
+	})
+	if _, ok := other.do("SCRIPT", "KILL").(replyError); !ok {
+		t.Fatal("SCRIPT KILL stopped a script that wrote")
+	}
+	server.store.mu.Lock()
+	server.store.store["stop"] = value{content: "1"}
+	server.store.mu.Unlock()
+	if reply := runner.read(); reply != 1 {
+		t.Fatalf("writing script replied %v", reply)
+	}
+	if reply := other.do("GET", "k"); reply != "v" {
+		t.Fatalf("GET after the script replied %v", reply)
+	}
+}
+
+func TestCommandsWaitingBehindAScriptTurnBusy(t *testing.T) {
+	server := startTestServer(t, "", func(config *config) { config.server.busyReplyThreshold = 300 })
+	runner := dialTestClient(t, server.addr)
+	waiter := dialTestClient(t, server.addr)
+
+	runner.send("EVAL", "while true do end", "0")
+	waitFor(t, "the script to start", func() bool { return scriptRunning(server.config.scripts) })
+	// The GET arrives before the script is busy, so it queues for the exec
+	// lock and must be told once the script passes the threshold.
+	waiter.send("GET", "k")
+	lock := &server.store.exec
+	waitFor(t, "the GET to wait for the lock", func() bool {
+		lock.mu.Lock()
+		defer lock.mu.Unlock()
+		return len(lock.waiters) == 1
+	})
+	if reply := waiter.read(); reply != replyError(errBusyScript.Error()) {
+		t.Fatalf("GET behind a busy script replied %v", reply)
+	}
+	lock.mu.Lock()
+	waiting := len(lock.waiters)
+	lock.mu.Unlock()
+	if waiting != 0 {
+		t.Fatalf("%d commands still wait for the lock after giving up", waiting)
+	}
+
+	waiter.do("SCRIPT", "KILL")
+	runner.read()
+	// The next script starts with a fresh signal.
+	if reply := runner.do("EVAL", "return 1", "0"); reply != 1 {
+		t.Fatalf("EVAL after a killed script replied %v", reply)
+	}
+	if reply := waiter.do("SET", "k", "v"); reply != "OK" {
+		t.Fatalf("SET after the script replied %v", reply)
+	}
+}
@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSentinelPort     = 26379
+	sentinelHelloChannel    = "__sentinel__:hello"
+	sentinelTickInterval    = time.Second
+	sentinelHelloInterval   = 2 * time.Second
+	sentinelRequestTimeout  = time.Second
+	sentinelRoleFixDelay    = 4 * sentinelHelloInterval
+	sentinelPromotionPollMs = 200
+)
+
+type sentinelConfig struct {
+	enabled         bool
+	monitors        []string
+	downAfter       int
+	failoverTimeout int
+}
+
+// sentinelInstance is a replica of a monitored master, as discovered through
+// the master's INFO replication.
+type sentinelInstance struct {
+	host              string
+	port              string
+	lastPong          time.Time
+	role              string
+	masterHost        string
+	masterPort        string
+	linkUp            bool
+	offset            int
+	roleMismatchSince time.Time
+}
+
+type knownSentinel struct {
+	runID     string
+	host      string
+	port      string
+	lastHello time.Time
+}
+
+type monitoredMaster struct {
+	name                string
+	host                string
+	port                string
+	quorum              int
+	configEpoch         int
+	lastPong            time.Time
+	sdown               bool
+	odown               bool
+	replicas            map[string]*sentinelInstance
+	sentinels           map[string]*knownSentinel
+	leader              string
+	leaderEpoch         int
+	failoverInProgress  bool
+	lastFailoverAttempt time.Time
+	subscribed          map[string]bool
+}
+
+type sentinel struct {
+	mu              sync.Mutex
+	runID           string
+	port            int
+	currentEpoch    int
+	masters         map[string]*monitoredMaster
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	ctx             context.Context
+}
+
+func newSentinel(ctx context.Context, config *config) (*sentinel, error) {
+	s := &sentinel{
+		runID:           newReplID(),
+		port:            config.server.port,
+		masters:         make(map[string]*monitoredMaster),
+		downAfter:       time.Duration(config.sentinel.downAfter) * time.Millisecond,
+		failoverTimeout: time.Duration(config.sentinel.failoverTimeout) * time.Millisecond,
+		ctx:             ctx,
+	}
+	for _, monitor := range config.sentinel.monitors {
+		fields := strings.Fields(monitor)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("sentinel-monitor expects \"<name> <host> <port> <quorum>\", got %q", monitor)
+		}
+		quorum, err := strconv.Atoi(fields[3])
+		if err != nil || quorum <= 0 {
+			return nil, fmt.Errorf("invalid quorum in sentinel-monitor %q", monitor)
+		}
+		s.masters[fields[0]] = &monitoredMaster{
+			name:       fields[0],
+			host:       fields[1],
+			port:       fields[2],
+			quorum:     quorum,
+			lastPong:   time.Now(),
+			replicas:   make(map[string]*sentinelInstance),
+			sentinels:  make(map[string]*knownSentinel),
+			subscribed: make(map[string]bool),
+		}
+	}
+	if len(s.masters) == 0 {
+		return nil, errors.New("sentinel mode requires at least one --sentinel-monitor")
+	}
+	return s, nil
+}
+
+// runSentinel replaces the data server when the binary starts with --sentinel.
+func runSentinel(config *config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := newSentinel(ctx, config)
+	if err != nil {
+		fmt.Println("Error starting sentinel:", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", config.server.port))
+	if err != nil {
+		fmt.Println("Error starting sentinel:", err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+	fmt.Printf("sentinel %s is listening on port %d\n", s.runID, config.server.port)
+
+	for _, m := range s.masters {
+		go s.monitor(m)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error in lister.Accept() connection, ", err)
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *sentinel) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	// Sentinels only speak RESP2.
+	w := newReplyWriter(conn, 2)
+	for {
+		command, args, err := parseRESPString(reader)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("Error parsing RESP string", err)
+			}
+			return
+		}
+		if err := s.handleCommand(command, args, w); err != nil {
+			w.errorReply(err.Error())
+		}
+		if err := w.flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *sentinel) handleCommand(command string, args []string, w *replyWriter) error {
+	switch command {
+	case "ping":
+		w.simpleString("PONG")
+	case "info":
+		w.verbatim("txt", s.info())
+	case "sentinel":
+		if len(args) == 0 {
+			return errors.New("ERR wrong number of arguments for 'sentinel' command")
+		}
+		return s.sentinelCommand(strings.ToLower(args[0]), args[1:], w)
+	default:
+		return fmt.Errorf("ERR unknown command '%s'", command)
+	}
+	return nil
+}
+
+func (s *sentinel) sentinelCommand(subcommand string, args []string, w *replyWriter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch subcommand {
+	case "myid":
+		w.bulk(s.runID)
+	case "get-master-addr-by-name":
+		if len(args) != 1 {
+			return errors.New("ERR wrong number of arguments for 'sentinel get-master-addr-by-name' command")
+		}
+		m, ok := s.masters[args[0]]
+		if !ok {
+			w.nullArray()
+			return nil
+		}
+		w.bulkArray([]string{m.host, m.port})
+	case "masters":
+		w.arrayHeader(len(s.masters))
+		for _, m := range s.masters {
+			writeFields(w, s.masterFields(m))
+		}
+	case "master":
+		m, err := s.lookupMaster(args)
+		if err != nil {
+			return err
+		}
+		writeFields(w, s.masterFields(m))
+	case "replicas", "slaves":
+		m, err := s.lookupMaster(args)
+		if err != nil {
+			return err
+		}
+		w.arrayHeader(len(m.replicas))
+		for _, r := range m.replicas {
+			linkStatus := "err"
+			if r.linkUp {
+				linkStatus = "ok"
+			}
+			writeFields(w, []string{
+				"name", net.JoinHostPort(r.host, r.port), "ip", r.host, "port", r.port,
+				"flags", s.instanceFlags("slave", r.lastPong), "master-link-status", linkStatus,
+				"slave-repl-offset", strconv.Itoa(r.offset),
+			})
+		}
+	case "sentinels":
+		m, err := s.lookupMaster(args)
+		if err != nil {
+			return err
+		}
+		w.arrayHeader(len(m.sentinels))
+		for _, peer := range m.sentinels {
+			writeFields(w, []string{
+				"name", peer.runID, "ip", peer.host, "port", peer.port, "runid", peer.runID,
+				"last-hello-message", strconv.FormatInt(time.Since(peer.lastHello).Milliseconds(), 10),
+			})
+		}
+	case "is-master-down-by-addr":
+		return s.isMasterDownByAddr(args, w)
+	default:
+		return fmt.Errorf("ERR unknown sentinel subcommand '%s'", subcommand)
+	}
+	return nil
+}
+
+// writeFields writes name/value pairs as a map.
+func writeFields(w *replyWriter, fields []string) {
+	w.mapHeader(len(fields) / 2)
+	for _, field := range fields {
+		w.bulk(field)
+	}
+}
+
+func (s *sentinel) lookupMaster(args []string) (*monitoredMaster, error) {
+	if len(args) != 1 {
+		return nil, errors.New("ERR wrong number of arguments")
+	}
+	m, ok := s.masters[args[0]]
+	if !ok {
+		return nil, errors.New("ERR No such master with that name")
+	}
+	return m, nil
+}
+
+func (s *sentinel) masterFields(m *monitoredMaster) []string {
+	flags := s.instanceFlags("master", m.lastPong)
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverInProgress {
+		flags += ",failover_in_progress"
+	}
+	return []string{
+		"name", m.name, "ip", m.host, "port", m.port, "flags", flags,
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"config-epoch", strconv.Itoa(m.configEpoch),
+	}
+}
+
+func (s *sentinel) instanceFlags(role string, lastPong time.Time) string {
+	if time.Since(lastPong) > s.downAfter {
+		return role + ",s_down"
+	}
+	return role
+}
+
+func (s *sentinel) info() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	output := fmt.Sprintf("# Sentinel\nsentinel_masters:%d\nsentinel_run_id:%s\nsentinel_current_epoch:%d", len(s.masters), s.runID, s.currentEpoch)
+	i := 0
+	for _, m := range s.masters {
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.sdown {
+			status = "sdown"
+		}
+		output += fmt.Sprintf("\nmaster%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, m.name, status, net.JoinHostPort(m.host, m.port), len(m.replicas), len(m.sentinels)+1)
+		i++
+	}
+	return output
+}
+
+// isMasterDownByAddr answers SENTINEL IS-MASTER-DOWN-BY-ADDR ip port epoch
+// runid. With a runid other than "*" the caller also asks for our vote, which
+// we give to the first sentinel asking in each epoch.
+func (s *sentinel) isMasterDownByAddr(args []string, w *replyWriter) error {
+	if len(args) != 4 {
+		return errors.New("ERR wrong number of arguments for 'sentinel is-master-down-by-addr' command")
+	}
+	epoch, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errors.New("ERR invalid epoch")
+	}
+
+	var m *monitoredMaster
+	for _, candidate := range s.masters {
+		if candidate.host == args[0] && candidate.port == args[1] {
+			m = candidate
+		}
+	}
+	if m == nil {
+		w.arrayHeader(3)
+		w.integer(0)
+		w.bulk("*")
+		w.integer(0)
+		return nil
+	}
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	if args[3] != "*" && epoch > m.leaderEpoch {
+		m.leader = args[3]
+		m.leaderEpoch = epoch
+		fmt.Printf("+vote-for-leader %s %d\n", m.leader, m.leaderEpoch)
+		// Give the sentinel we voted for time to finish before we try
+		// ourselves.
+		if m.leader != s.runID {
+			m.lastFailoverAttempt = time.Now()
+		}
+	}
+
+	down := 0
+	if m.sdown {
+		down = 1
+	}
+	leader := "*"
+	if args[3] != "*" {
+		leader = m.leader
+	}
+	w.arrayHeader(3)
+	w.integer(int64(down))
+	w.bulk(leader)
+	w.integer(int64(m.leaderEpoch))
+	return nil
+}
+
+// monitor runs the periodic checks for one master until the sentinel stops.
+func (s *sentinel) monitor(m *monitoredMaster) {
+	ticker := time.NewTicker(sentinelTickInterval)
+	defer ticker.Stop()
+	lastHello := time.Time{}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.pingInstances(m)
+		s.refreshInfo(m)
+		if time.Since(lastHello) >= sentinelHelloInterval {
+			s.sendHellos(m)
+			lastHello = time.Now()
+		}
+		s.checkDown(m)
+		s.fixReplicaRoles(m)
+	}
+}
+
+func (s *sentinel) masterAddr(m *monitoredMaster) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return net.JoinHostPort(m.host, m.port)
+}
+
+func (s *sentinel) instanceAddrs(m *monitoredMaster) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := []string{net.JoinHostPort(m.host, m.port)}
+	for addr := range m.replicas {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (s *sentinel) pingInstances(m *monitoredMaster) {
+	for _, addr := range s.instanceAddrs(m) {
+		reply, err := sentinelRequest(addr, "PING")
+		if err != nil {
+			continue
+		}
+		// A busy or loading instance is alive, anything else is not a
+		// valid PING reply.
+		if replyErr, isErr := reply.(respError); isErr && !strings.HasPrefix(string(replyErr), "LOADING") && !strings.HasPrefix(string(replyErr), "MASTERDOWN") {
+			continue
+		}
+		s.mu.Lock()
+		if addr == net.JoinHostPort(m.host, m.port) {
+			m.lastPong = time.Now()
+		} else if r, ok := m.replicas[addr]; ok {
+			r.lastPong = time.Now()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// refreshInfo discovers replicas from the master's INFO and records what each
+// replica reports about itself.
+func (s *sentinel) refreshInfo(m *monitoredMaster) {
+	masterAddr := s.masterAddr(m)
+	if fields, err := instanceInfo(masterAddr); err == nil && fields["role"] == "master" {
+		s.mu.Lock()
+		for key, val := range fields {
+			if !strings.HasPrefix(key, "slave") || key == "slave_repl_offset" {
+				continue
+			}
+			replica := parseInfoList(val)
+			if replica["ip"] == "" || replica["port"] == "" {
+				continue
+			}
+			addr := net.JoinHostPort(replica["ip"], replica["port"])
+			if _, ok := m.replicas[addr]; !ok && addr != masterAddr {
+				m.replicas[addr] = &sentinelInstance{host: replica["ip"], port: replica["port"], lastPong: time.Now()}
+				fmt.Printf("+slave slave %s @ %s %s\n", addr, m.name, masterAddr)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	for _, addr := range s.instanceAddrs(m)[1:] {
+		fields, err := instanceInfo(addr)
+		if err != nil {
+			continue
+		}
+		offset, _ := strconv.Atoi(fields["master_repl_offset"])
+		s.mu.Lock()
+		if r, ok := m.replicas[addr]; ok {
+			r.role = fields["role"]
+			r.masterHost = fields["master_host"]
+			r.masterPort = fields["master_port"]
+			r.linkUp = fields["master_link_status"] == "up"
+			r.offset = offset
+		}
+		s.mu.Unlock()
+	}
+}
+
+// fixReplicaRoles points instances that report the wrong role or master back
+// at the current master, e.g. an old master that comes back after failover.
+func (s *sentinel) fixReplicaRoles(m *monitoredMaster) {
+	s.mu.Lock()
+	if m.sdown || m.failoverInProgress {
+		s.mu.Unlock()
+		return
+	}
+	var toFix []string
+	for addr, r := range m.replicas {
+		if r.role == "" || (r.role == "slave" && r.masterHost == m.host && r.masterPort == m.port) {
+			r.roleMismatchSince = time.Time{}
+			continue
+		}
+		if r.roleMismatchSince.IsZero() {
+			r.roleMismatchSince = time.Now()
+		} else if time.Since(r.roleMismatchSince) > sentinelRoleFixDelay {
+			toFix = append(toFix, addr)
+			r.roleMismatchSince = time.Time{}
+		}
+	}
+	host, port := m.host, m.port
+	s.mu.Unlock()
+
+	for _, addr := range toFix {
+		if _, err := sentinelRequest(addr, "REPLICAOF", host, port); err == nil {
+			fmt.Printf("+fix-slave-config slave %s @ %s %s %s\n", addr, m.name, host, port)
+		}
+	}
+}
+
+// sendHellos announces this sentinel and its view of the master on every
+// monitored instance, and makes sure we listen to the other sentinels there.
+func (s *sentinel) sendHellos(m *monitoredMaster) {
+	for _, addr := range s.instanceAddrs(m) {
+		s.mu.Lock()
+		if !m.subscribed[addr] {
+			m.subscribed[addr] = true
+			go s.subscribeHellos(addr)
+		}
+		s.mu.Unlock()
+
+		conn, err := net.DialTimeout("tcp", addr, sentinelRequestTimeout)
+		if err != nil {
+			continue
+		}
+		localHost, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+		s.mu.Lock()
+		hello := strings.Join([]string{
+			localHost, strconv.Itoa(s.port), s.runID, strconv.Itoa(s.currentEpoch),
+			m.name, m.host, m.port, strconv.Itoa(m.configEpoch),
+		}, ",")
+		s.mu.Unlock()
+		conn.SetDeadline(time.Now().Add(sentinelRequestTimeout))
+		conn.Write([]byte(respGenerator([]string{"PUBLISH", sentinelHelloChannel, hello})))
+		parseRESPReply(bufio.NewReader(conn))
+		conn.Close()
+	}
+}
+
+// subscribeHellos listens to the hello channel of one instance for as long as
+// the sentinel runs, reconnecting when the instance goes away.
+func (s *sentinel) subscribeHellos(addr string) {
+	for s.ctx.Err() == nil {
+		conn, err := net.DialTimeout("tcp", addr, sentinelRequestTimeout)
+		if err != nil {
+			time.Sleep(sentinelHelloInterval)
+			continue
+		}
+		conn.Write([]byte(respGenerator([]string{"SUBSCRIBE", sentinelHelloChannel})))
+		reader := bufio.NewReader(conn)
+		for {
+			// Hellos arrive every couple of seconds while anyone is alive.
+			conn.SetReadDeadline(time.Now().Add(5 * sentinelHelloInterval))
+			reply, err := parseRESPReply(reader)
+			if err != nil {
+				break
+			}
+			if message, ok := reply.([]interface{}); ok && len(message) == 3 && message[0] == "message" {
+				if payload, ok := message[2].(string); ok {
+					s.processHello(payload)
+				}
+			}
+		}
+		conn.Close()
+	}
+}
+
+func (s *sentinel) processHello(payload string) {
+	fields := strings.Split(payload, ",")
+	if len(fields) != 8 {
+		return
+	}
+	host, port, runID := fields[0], fields[1], fields[2]
+	epoch, _ := strconv.Atoi(fields[3])
+	masterName, masterHost, masterPort := fields[4], fields[5], fields[6]
+	masterEpoch, _ := strconv.Atoi(fields[7])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if runID == s.runID {
+		return
+	}
+	m, ok := s.masters[masterName]
+	if !ok {
+		return
+	}
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+
+	peer, ok := m.sentinels[runID]
+	if !ok {
+		peer = &knownSentinel{runID: runID}
+		m.sentinels[runID] = peer
+		fmt.Printf("+sentinel sentinel %s %s %s @ %s %s %s\n", runID, host, port, m.name, m.host, m.port)
+	}
+	peer.host, peer.port, peer.lastHello = host, port, time.Now()
+
+	// A newer configuration means another sentinel completed a failover.
+	if masterEpoch > m.configEpoch && (masterHost != m.host || masterPort != m.port) {
+		s.switchMaster(m, masterHost, masterPort, masterEpoch)
+	}
+}
+
+// switchMaster makes host:port the master of m. The old master is kept as a
+// replica so it gets reconfigured once it is reachable again. Callers hold
+// s.mu.
+func (s *sentinel) switchMaster(m *monitoredMaster, host, port string, epoch int) {
+	fmt.Printf("+switch-master %s %s %s %s %s\n", m.name, m.host, m.port, host, port)
+	oldAddr := net.JoinHostPort(m.host, m.port)
+	m.replicas[oldAddr] = &sentinelInstance{host: m.host, port: m.port}
+	delete(m.replicas, net.JoinHostPort(host, port))
+	m.host, m.port, m.configEpoch = host, port, epoch
+	m.lastPong = time.Now()
+	m.sdown, m.odown = false, false
+}
+
+// checkDown moves the master through SDOWN and ODOWN and starts a failover
+// when we win the leader election for it.
+func (s *sentinel) checkDown(m *monitoredMaster) {
+	s.mu.Lock()
+	m.sdown = time.Since(m.lastPong) > s.downAfter
+	if !m.sdown {
+		if m.odown {
+			fmt.Printf("-odown master %s %s %s\n", m.name, m.host, m.port)
+		}
+		m.odown = false
+		s.mu.Unlock()
+		return
+	}
+	peers := s.peerAddrs(m)
+	host, port, quorum := m.host, m.port, m.quorum
+	epoch := s.currentEpoch
+	s.mu.Unlock()
+
+	agreed := 1
+	for _, peer := range peers {
+		reply, err := sentinelRequest(peer, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.Itoa(epoch), "*")
+		if items, ok := reply.([]interface{}); err == nil && ok && len(items) == 3 && items[0] == 1 {
+			agreed++
+		}
+	}
+
+	s.mu.Lock()
+	if agreed >= quorum && !m.odown {
+		m.odown = true
+		fmt.Printf("+odown master %s %s %s #quorum %d/%d\n", m.name, host, port, agreed, quorum)
+	}
+	startElection := m.odown && !m.failoverInProgress && time.Since(m.lastFailoverAttempt) > 2*s.failoverTimeout
+	s.mu.Unlock()
+
+	if startElection {
+		s.electAndFailover(m)
+	}
+}
+
+func (s *sentinel) peerAddrs(m *monitoredMaster) []string {
+	var peers []string
+	for _, peer := range m.sentinels {
+		peers = append(peers, net.JoinHostPort(peer.host, peer.port))
+	}
+	return peers
+}
+
+// electAndFailover asks the other sentinels to vote for us in a new epoch and
+// runs the failover if we get a majority.
+func (s *sentinel) electAndFailover(m *monitoredMaster) {
+	s.mu.Lock()
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	m.leader, m.leaderEpoch = s.runID, epoch
+	m.lastFailoverAttempt = time.Now()
+	peers := s.peerAddrs(m)
+	host, port, quorum := m.host, m.port, m.quorum
+	s.mu.Unlock()
+	fmt.Printf("+try-failover master %s %s %s epoch %d\n", m.name, host, port, epoch)
+
+	votes := 1
+	for _, peer := range peers {
+		reply, err := sentinelRequest(peer, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.Itoa(epoch), s.runID)
+		if items, ok := reply.([]interface{}); err == nil && ok && len(items) == 3 && items[1] == s.runID {
+			votes++
+		}
+	}
+
+	needed := (len(peers)+1)/2 + 1
+	if quorum > needed {
+		needed = quorum
+	}
+	if votes < needed {
+		fmt.Printf("-failover-abort-not-elected master %s %s %s (%d/%d votes)\n", m.name, host, port, votes, needed)
+		return
+	}
+	fmt.Printf("+elected-leader master %s %s %s epoch %d\n", m.name, host, port, epoch)
+	s.failover(m, epoch)
+}
+
+// failover promotes the best replica with REPLICAOF NO ONE and points the
+// remaining replicas at it.
+func (s *sentinel) failover(m *monitoredMaster, epoch int) {
+	s.mu.Lock()
+	m.failoverInProgress = true
+	var candidate *sentinelInstance
+	for _, r := range m.replicas {
+		if time.Since(r.lastPong) > s.downAfter || r.role != "slave" {
+			continue
+		}
+		if candidate == nil || r.offset > candidate.offset {
+			candidate = r
+		}
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		m.failoverInProgress = false
+		s.mu.Unlock()
+	}()
+
+	if candidate == nil {
+		fmt.Printf("-failover-abort-no-good-slave master %s\n", m.name)
+		return
+	}
+	candidateAddr := net.JoinHostPort(candidate.host, candidate.port)
+	fmt.Printf("+selected-slave slave %s @ %s\n", candidateAddr, m.name)
+
+	if _, err := sentinelRequest(candidateAddr, "REPLICAOF", "NO", "ONE"); err != nil {
+		fmt.Println("-failover-abort-slave-timeout", err)
+		return
+	}
+
+	promoted := false
+	for waited := 0; waited < int(s.failoverTimeout.Milliseconds()); waited += sentinelPromotionPollMs {
+		if fields, err := instanceInfo(candidateAddr); err == nil && fields["role"] == "master" {
+			promoted = true
+			break
+		}
+		time.Sleep(sentinelPromotionPollMs * time.Millisecond)
+	}
+	if !promoted {
+		fmt.Printf("-failover-abort-slave-timeout slave %s @ %s\n", candidateAddr, m.name)
+		return
+	}
+	fmt.Printf("+promoted-slave slave %s @ %s\n", candidateAddr, m.name)
+
+	s.mu.Lock()
+	s.switchMaster(m, candidate.host, candidate.port, epoch)
+	var others []string
+	for addr := range m.replicas {
+		others = append(others, addr)
+	}
+	s.mu.Unlock()
+
+	for _, addr := range others {
+		if _, err := sentinelRequest(addr, "REPLICAOF", candidate.host, candidate.port); err == nil {
+			fmt.Printf("+slave-reconf-sent slave %s @ %s\n", addr, m.name)
+		}
+	}
+	fmt.Printf("+failover-end master %s %s %s\n", m.name, candidate.host, candidate.port)
+}
+
+// sentinelRequest sends one command to an instance on a short-lived
+// connection and returns its reply.
+func sentinelRequest(addr string, args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", addr, sentinelRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sentinelRequestTimeout))
+	if _, err := conn.Write([]byte(respGenerator(args))); err != nil {
+		return nil, err
+	}
+	return parseRESPReply(bufio.NewReader(conn))
+}
+
+// instanceInfo fetches INFO replication from an instance as key/value pairs.
+func instanceInfo(addr string) (map[string]string, error) {
+	reply, err := sentinelRequest(addr, "INFO", "replication")
+	if err != nil {
+		return nil, err
+	}
+	text, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected INFO reply from %s", addr)
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		key, val, found := strings.Cut(strings.TrimSpace(line), ":")
+		if found {
+			fields[key] = val
+		}
+	}
+	return fields, nil
+}
+
+// parseInfoList splits an INFO value like "ip=1.2.3.4,port=6379" into pairs.
+func parseInfoList(val string) map[string]string {
+	pairs := make(map[string]string)
+	for _, pair := range strings.Split(val, ",") {
+		key, v, found := strings.Cut(pair, "=")
+		if found {
+			pairs[key] = v
+		}
+	}
+	return pairs
+}
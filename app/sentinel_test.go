@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestSentinel serves a sentinel monitoring masterAddr as "mymaster"
+// with a quorum of one. Its checks only run when the test calls them.
+func startTestSentinel(tb testing.TB, masterAddr string) (*sentinel, string) {
+	tb.Helper()
+	host, port, _ := net.SplitHostPort(masterAddr)
+	var config config
+	config.sentinel.monitors = []string{"mymaster " + host + " " + port + " 1"}
+	config.sentinel.downAfter = 1000
+	config.sentinel.failoverTimeout = 5000
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := newSentinel(ctx, &config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		listener.Close()
+		cancel()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn)
+		}
+	}()
+	return s, listener.Addr().String()
+}
+
+func TestSentinelPromotesAReplicaOfADownMaster(t *testing.T) {
+	master := startTestServer(t, "")
+	replica := startTestServer(t, masterDetailsOf(master.addr))
+	waitFor(t, "the replica to attach", func() bool { return master.cm.replicaCount() == 1 })
+
+	// The sentinel reaches the master through a proxy, so closing the proxy
+	// takes the master down for the sentinel only.
+	proxy := startRecordingProxy(t, master.addr)
+	s, addr := startTestSentinel(t, proxy.addr)
+	m := s.masters["mymaster"]
+	client := dialTestClient(t, addr)
+
+	proxyHost, proxyPort, _ := net.SplitHostPort(proxy.addr)
+	if reply := client.do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"); !reflect.DeepEqual(reply, []any{proxyHost, proxyPort}) {
+		t.Fatalf("GET-MASTER-ADDR-BY-NAME replied %v, want the monitored master", reply)
+	}
+	s.refreshInfo(m)
+	if replicas, _ := client.do("SENTINEL", "REPLICAS", "mymaster").([]any); len(replicas) != 1 {
+		t.Fatalf("SENTINEL REPLICAS listed %v, want the replica", replicas)
+	}
+
+	// Backdating the last PONG stands in for waiting out down-after.
+	proxy.close()
+	s.mu.Lock()
+	m.lastPong = time.Now().Add(-2 * s.downAfter)
+	s.mu.Unlock()
+	s.pingInstances(m)
+	s.refreshInfo(m)
+	s.checkDown(m)
+
+	replicaHost, replicaPort, _ := net.SplitHostPort(replica.addr)
+	if reply := client.do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster"); !reflect.DeepEqual(reply, []any{replicaHost, replicaPort}) {
+		t.Fatalf("GET-MASTER-ADDR-BY-NAME replied %v after the failover, want the replica", reply)
+	}
+	if role := role(t, dialTestClient(t, replica.addr)); role != "master" {
+		t.Fatalf("promoted replica has role %s", role)
+	}
+}
+
+func TestSentinelHelloChannel(t *testing.T) {
+	server := startTestServer(t, "")
+	subscriber := dialTestClient(t, server.addr)
+	want := []any{"subscribe", sentinelHelloChannel, 1}
+	if reply := subscriber.do("SUBSCRIBE", sentinelHelloChannel); !reflect.DeepEqual(reply, want) {
+		t.Fatalf("SUBSCRIBE replied %v, want %v", reply, want)
+	}
+
+	if reply := dialTestClient(t, server.addr).do("PUBLISH", sentinelHelloChannel, "hello"); reply != 1 {
+		t.Fatalf("PUBLISH replied %v, want 1", reply)
+	}
+	want = []any{"message", sentinelHelloChannel, "hello"}
+	if reply := subscriber.read(); !reflect.DeepEqual(reply, want) {
+		t.Fatalf("subscriber got %v, want %v", reply, want)
+	}
+}
+
+func TestSentinelReplies(t *testing.T) {
+	master := startTestServer(t, "")
+	_, addr := startTestSentinel(t, master.addr)
+	client := dialTestClient(t, addr)
+
+	fields, ok := client.do("SENTINEL", "MASTER", "mymaster").([]any)
+	if !ok || len(fields)%2 != 0 || fields[0] != "name" || fields[1] != "mymaster" {
+		t.Fatalf("SENTINEL MASTER replied %v, want name/value pairs", fields)
+	}
+	if reply := client.do("SENTINEL", "MASTER", "nobody"); reply != replyError("ERR No such master with that name") {
+		t.Fatalf("SENTINEL MASTER of an unknown master replied %v", reply)
+	}
+	if reply := client.do("SENTINEL", "GET-MASTER-ADDR-BY-NAME", "nobody"); reply != nil {
+		t.Fatalf("GET-MASTER-ADDR-BY-NAME of an unknown master replied %v", reply)
+	}
+	if reply := client.do("SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "10.0.0.1", "1", "0", "*"); !reflect.DeepEqual(reply, []any{0, "*", 0}) {
+		t.Fatalf("IS-MASTER-DOWN-BY-ADDR of an unknown master replied %v", reply)
+	}
+	if info, _ := client.do("INFO").(string); !strings.Contains(info, "sentinel_masters:1") {
+		t.Fatalf("INFO replied %q", info)
+	}
+}
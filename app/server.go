@@ -3,13 +3,12 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,10 +19,36 @@ type clientData struct {
 }
 
 type serverConfig struct {
-	port               int
-	masterDetails      string
-	actAsReplica       bool
-	bytesReadAsReplica int
+	port                  int
+	masterDetails         string
+	actAsReplica          bool
+	bytesReadAsReplica    atomic.Int64
+	replTimeout           int
+	replPingReplicaPeriod int
+	replBacklogSize       int
+	replicaReadOnly       bool
+	replicaServeStaleData bool
+	minReplicasToWrite    int
+	minReplicasMaxLag     int
+	clusterEnabled        bool
+	clusterAnnounceIP     string
+	clusterConfigFile     string
+	clusterNodeTimeout    int
+	busyReplyThreshold    int
+	trackingTableMaxKeys  int
+	requirepass           string
+	aclFile               string
+	aclLogMaxLen          int
+	// masterUser and masterAuth are what a replica authenticates with to
+	// its master.
+	masterUser string
+	masterAuth string
+	// notifyKeyspaceEvents holds the notify-keyspace-events classes, which
+	// CONFIG SET can change at any time.
+	notifyKeyspaceEvents atomic.Int32
+	link                 *replicaLink
+	repl                 *replicationState
+	failover             *failoverState
 }
 
 type rdbConfig struct {
@@ -39,19 +64,54 @@ type value struct {
 type redisStore struct {
 	mu    sync.RWMutex
 	store map[string]value
+	// exec is held shared by every command and exclusively by EXEC, which
+	// makes a transaction atomic.
+	exec execLock
+	// watched holds the keys clients WATCH, guarded by mu.
+	watched map[string]*keyWatch
+	// tracking records the keys CLIENT TRACKING clients may have cached.
+	tracking *trackingTable
 }
 
 type config struct {
-	rdb    rdbConfig
-	server serverConfig
+	rdb      rdbConfig
+	server   serverConfig
+	sentinel sentinelConfig
+	cluster  *clusterState
+	scripts  *scriptEngine
+	acl      *aclState
 }
 
 func main() {
 	c := &clientData{}
 	c.activeClients.Store(0)
-	store := &redisStore{store: map[string]value{}}
-
 	config := parseFlags()
+	store := &redisStore{store: map[string]value{}, watched: map[string]*keyWatch{}, tracking: newTrackingTable(config.server.trackingTableMaxKeys)}
+	if config.sentinel.enabled {
+		runSentinel(config)
+		return
+	}
+
+	if config.rdb.dbFileName != "" {
+		if err := config.scripts.loadRDBFile(config.rdb.dir + "/" + config.rdb.dbFileName); err != nil {
+			fmt.Println("Error loading functions from RDB:", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.server.aclFile != "" {
+		if err := config.acl.loadFile(); err != nil {
+			fmt.Println("Error loading ACL file:", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.cluster != nil {
+		if err := config.cluster.loadConfig(); err != nil {
+			fmt.Println("Error loading cluster config:", err)
+			os.Exit(1)
+		}
+	}
 
 	port := fmt.Sprintf("0.0.0.0:%d", config.server.port)
 
@@ -63,11 +123,20 @@ func main() {
 
 	fmt.Printf("server is listening on port as replica -> %d...", config.server.port)
 	ctx, cancel := context.WithCancel(context.Background())
-	cm := newConnectionManager()
+	cm := newConnectionManager(config.server.repl)
+	config.server.repl.rootCtx = ctx
 
 	actAsReplica(config)
 	if config.server.actAsReplica {
-		go connectToMasterAsReplica(config, ctx, cm, store)
+		startMasterLink(config, cm, store)
+	}
+	go pingReplicas(ctx, config, cm)
+	go activeExpireCycle(ctx, store, config, cm)
+	if config.cluster != nil {
+		if err := config.cluster.start(ctx, config, cm, store); err != nil {
+			fmt.Println("Error starting cluster bus:", err)
+			os.Exit(1)
+		}
 	}
 
 	defer func() {
@@ -88,87 +157,6 @@ func main() {
 	}
 }
 
-func connectToMasterAsReplica(config *config, ctx context.Context, cm *connectionManager, store *redisStore) {
-
-	masterHost, masterPort := func(args []string) (string, string) {
-		return args[0], args[1]
-	}(strings.Split(config.server.masterDetails, " "))
-
-	conn, err := net.Dial("tcp", net.JoinHostPort(masterHost, masterPort))
-	if err != nil {
-		fmt.Println("Error connecting to master as replica", err)
-		return
-	}
-
-	handShakeCommands := []string{
-		"*1\r\n$4\r\nPING\r\n",
-		"*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$4\r\n6380\r\n",
-		"*3\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n",
-	}
-
-	for _, cmd := range handShakeCommands {
-		if _, err := sendCommand(conn, cmd); err != nil {
-			fmt.Println(err)
-			return
-		}
-	}
-
-	pSyncCommand := "*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"
-	_, err = conn.Write([]byte(pSyncCommand))
-	if err != nil {
-		fmt.Println("Error sending pSyncCommand", err)
-		return
-	}
-
-	reader := bufio.NewReader(conn)
-
-	_, err = reader.ReadString('\n')
-	if err != nil {
-		fmt.Println("Error while reading first line", err)
-	}
-
-	rdbSize, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Println("Error reading RDB size", err)
-	}
-	rdbSize = strings.TrimSuffix(rdbSize, "\r\n")
-	rdbSize = strings.TrimPrefix(rdbSize, "$")
-	rdbByteCount, err := strconv.Atoi(rdbSize)
-	if err != nil {
-		fmt.Println("Error converting rdb file size byte values to int", err)
-	}
-
-	io.CopyN(io.Discard, reader, int64(rdbByteCount))
-
-	for {
-		command, args, err := parseRESPString(reader)
-
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("Finished reading all commands and io.EOF reached")
-			} else {
-				fmt.Println("Error parsing parseRESPString", err)
-			}
-			break
-		}
-
-		output, err := handleCommand(conn, command, args, store, config, cm)
-		if err != nil {
-			fmt.Println("error from redisInput parser", err)
-		} else {
-			if command == "replconf" {
-				conn.Write([]byte(output))
-			} else {
-				fmt.Println("Not sending anything for others.")
-			}
-
-		}
-	}
-
-	<-ctx.Done()
-	conn.Close()
-}
-
 func sendCommand(conn net.Conn, command string) (string, error) {
 	_, err := conn.Write([]byte(command))
 	if err != nil {
@@ -197,38 +185,125 @@ func parseFlags() *config {
 	flag.StringVar(&config.rdb.dbFileName, "dbfilename", "", "RDB file name")
 	flag.IntVar(&config.server.port, "port", 6379, "Port number for redis server")
 	flag.StringVar(&config.server.masterDetails, "replicaof", "", "Master details to run on a replica")
+	flag.IntVar(&config.server.replTimeout, "repl-timeout", 60, "Seconds without data before the replication link is considered dead")
+	flag.BoolVar(&config.server.replicaReadOnly, "replica-read-only", true, "Reject writes from clients while acting as a replica")
+	flag.BoolVar(&config.server.replicaServeStaleData, "replica-serve-stale-data", true, "Keep serving reads while the link with the master is down")
+	flag.IntVar(&config.server.minReplicasToWrite, "min-replicas-to-write", 0, "Refuse writes unless this many replicas are connected and acking")
+	flag.IntVar(&config.server.minReplicasMaxLag, "min-replicas-max-lag", 10, "Seconds since the last ACK for a replica to count towards min-replicas-to-write")
+	flag.IntVar(&config.server.replBacklogSize, "repl-backlog-size", 1024*1024, "Bytes of replication stream kept for partial resynchronisation")
+	flag.IntVar(&config.server.replPingReplicaPeriod, "repl-ping-replica-period", 10, "Seconds between PINGs sent by a master to its replicas")
+	flag.IntVar(&config.server.busyReplyThreshold, "busy-reply-threshold", 5000, "Milliseconds a script may run before other clients get BUSY replies")
+	flag.Func("notify-keyspace-events", "Keyspace notification classes to publish, e.g. \"Ex\" for expired key events", func(value string) error {
+		classes, err := parseKeyspaceEvents(value)
+		config.server.notifyKeyspaceEvents.Store(int32(classes))
+		return err
+	})
+	flag.IntVar(&config.server.trackingTableMaxKeys, "tracking-table-max-keys", 1000000, "Most keys tracked for client side caching, 0 for no limit")
+	flag.Func("client-output-buffer-limit-pubsub", "Subscriber output buffer limits as \"<hard> <soft> <soft seconds>\", e.g. \"32mb 8mb 60\"", parsePubsubLimits)
+	flag.StringVar(&config.server.requirepass, "requirepass", "", "Password of the default user")
+	flag.StringVar(&config.server.aclFile, "aclfile", "", "File with the ACL users, loaded at startup and by ACL LOAD")
+	flag.IntVar(&config.server.aclLogMaxLen, "acllog-max-len", 128, "Most entries kept in the ACL LOG")
+	flag.StringVar(&config.server.masterUser, "masteruser", "", "User a replica authenticates as to its master")
+	flag.StringVar(&config.server.masterAuth, "masterauth", "", "Password a replica authenticates with to its master")
+	flag.IntVar(&protoMaxBulkLen, "proto-max-bulk-len", protoMaxBulkLen, "Largest bulk string a client may send, in bytes")
+
+	flag.BoolVar(&config.sentinel.enabled, "sentinel", false, "Run as a sentinel monitoring the --sentinel-monitor masters")
+	flag.Func("sentinel-monitor", "Master to monitor as \"<name> <host> <port> <quorum>\" (repeatable)", func(monitor string) error {
+		config.sentinel.monitors = append(config.sentinel.monitors, monitor)
+		return nil
+	})
+	flag.IntVar(&config.sentinel.downAfter, "sentinel-down-after-milliseconds", 30000, "Milliseconds without a valid PING reply before an instance is subjectively down")
+	flag.IntVar(&config.sentinel.failoverTimeout, "sentinel-failover-timeout", 180000, "Milliseconds a sentinel failover may take before it is retried")
+
+	flag.BoolVar(&config.server.clusterEnabled, "cluster-enabled", false, "Run as a Redis Cluster node")
+	flag.StringVar(&config.server.clusterAnnounceIP, "cluster-announce-ip", "127.0.0.1", "IP this node advertises to clients and other nodes")
+	flag.StringVar(&config.server.clusterConfigFile, "cluster-config-file", "nodes.conf", "File where the node persists its view of the cluster")
+	flag.IntVar(&config.server.clusterNodeTimeout, "cluster-node-timeout", 15000, "Milliseconds a node may be unreachable before it is considered failing")
 
 	flag.Parse()
+
+	portSet := false
+	flag.Visit(func(f *flag.Flag) {
+		portSet = portSet || f.Name == "port"
+	})
+	if config.sentinel.enabled && !portSet {
+		config.server.port = defaultSentinelPort
+	}
+	config.server.link = newReplicaLink()
+	config.server.repl = newReplicationState(config.server.replBacklogSize)
+	config.server.failover = newFailoverState()
+	config.scripts = newScriptEngine()
+	config.acl = newACLState(config.server.requirepass, config.server.aclFile, config.server.aclLogMaxLen)
+	if config.server.clusterEnabled {
+		config.cluster = newClusterState(config.server.clusterAnnounceIP, config.server.port,
+			config.server.clusterConfigFile, time.Duration(config.server.clusterNodeTimeout)*time.Millisecond)
+	}
 	return &config
 }
 
 func handleConnection(conn net.Conn, c *clientData, store *redisStore, config *config, cm *connectionManager) {
-	defer conn.Close()
+	defer func() {
+		cm.removeConnection(conn.RemoteAddr().String(), "replica")
+		c.activeClients.Add(^uint32(0))
+		fmt.Println("Current active clients is ", c.activeClients.Load())
+		conn.Close()
+	}()
 
-	conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
 	reader := bufio.NewReader(conn)
+	cl := newClient(conn)
+	// While the default user needs no password, connections are logged in
+	// as it, and stay logged in if requirepass is set later on.
+	cl.authenticated = config.acl.defaultAuthenticates()
+	cm.addClient(cl)
+	defer cm.removeClient(cl)
+	defer store.tracking.disable(cl)
+	defer unwatchKeys(cl, store)
 
 	for {
+		// Subscribers legitimately stay silent while they wait for messages.
+		if cl.subscriptionCount() == 0 {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
 
 		command, args, err := parseRESPString(reader)
 		if err != nil {
-
+			var protoErr protocolError
+			if errors.As(err, &protoErr) {
+				cl.writeMu.Lock()
+				cl.out.errorReply("ERR " + protoErr.Error())
+				cl.out.flush()
+				cl.writeMu.Unlock()
+			}
 			if err == io.EOF {
 				fmt.Println("EOF: handleConnection")
-				c.activeClients.Add(^uint32(0))
-				fmt.Println("Current active clients is ", c.activeClients.Load())
-				break
 			} else {
-				fmt.Println("Error parsing RESP string", err)
-				continue
+				fmt.Println("Connection error: handleConnection", err)
 			}
+			break
 		}
 
-		output, err := handleCommand(conn, command, args, store, config, cm)
+		cl.writeMu.Lock()
+		if err := handleCommand(cl, command, args, store, config, cm); err != nil {
+			cl.out.errorReply(err.Error())
+		}
+		// Pipelined commands that are already fully buffered run first, so
+		// the whole batch of replies goes out in one write. A partial
+		// command may take a while to complete, so replies are flushed
+		// before waiting for the rest of it.
+		if buffered, _ := reader.Peek(reader.Buffered()); hasCompleteCommand(buffered) && !cl.closing {
+			cl.writeMu.Unlock()
+			continue
+		}
+		err = cl.out.flush()
+		cl.writeMu.Unlock()
 		if err != nil {
-			fmt.Println("error from redisInput parser", err)
-		} else {
-			conn.Write([]byte(output))
+			fmt.Println("Error writing reply:", err)
+			break
+		}
+		if cl.closing {
+			break
 		}
 	}
 }
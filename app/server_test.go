@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer is a server running in-process on a loopback port.
+type testServer struct {
+	config *config
+	cm     *connectionManager
+	store  *redisStore
+	addr   string
+}
+
+// newTestConfig returns a config with the flag defaults of parseFlags.
+func newTestConfig() *config {
+	var config config
+	config.server.replTimeout = 60
+	config.server.replicaReadOnly = true
+	config.server.replicaServeStaleData = true
+	config.server.minReplicasMaxLag = 10
+	config.server.replBacklogSize = 1024 * 1024
+	config.server.replPingReplicaPeriod = 10
+	config.server.link = newReplicaLink()
+	config.server.repl = newReplicationState(config.server.replBacklogSize)
+	config.server.failover = newFailoverState()
+	config.server.clusterAnnounceIP = "127.0.0.1"
+	config.server.clusterNodeTimeout = 15000
+	config.server.busyReplyThreshold = 5000
+	config.server.trackingTableMaxKeys = 1000000
+	config.server.aclLogMaxLen = 128
+	config.scripts = newScriptEngine()
+	config.acl = newACLState("", "", config.server.aclLogMaxLen)
+	return &config
+}
+
+// startTestServer serves connections the way main does until the test ends.
+// A non-empty masterAddr ("<host> <port>") starts it as a replica, and
+// options adjust the config before the server starts.
+func startTestServer(tb testing.TB, masterAddr string, options ...func(*config)) *testServer {
+	tb.Helper()
+	config := newTestConfig()
+	for _, option := range options {
+		option(config)
+	}
+	store := &redisStore{store: map[string]value{}, watched: map[string]*keyWatch{}, tracking: newTrackingTable(config.server.trackingTableMaxKeys)}
+
+	listener := listenTestPort(tb, config.server.clusterEnabled)
+	config.server.port = listener.Addr().(*net.TCPAddr).Port
+	if config.server.clusterEnabled {
+		dir, err := os.MkdirTemp("", "cluster")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		config.server.clusterConfigFile = filepath.Join(dir, "nodes.conf")
+		cs := newClusterState(config.server.clusterAnnounceIP, config.server.port,
+			config.server.clusterConfigFile, time.Duration(config.server.clusterNodeTimeout)*time.Millisecond)
+		config.cluster = cs
+		// The bus may still be saving nodes.conf while the test ends, so
+		// the directory goes under cs.mu, which every save holds.
+		tb.Cleanup(func() {
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			os.RemoveAll(dir)
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cm := newConnectionManager(config.server.repl)
+	config.server.repl.rootCtx = ctx
+	tb.Cleanup(func() {
+		listener.Close()
+		cancel()
+		stopMasterLink(config)
+	})
+
+	if config.cluster != nil {
+		if err := config.cluster.start(ctx, config, cm, store); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if masterAddr != "" {
+		config.server.masterDetails = masterAddr
+		actAsReplica(config)
+		startMasterLink(config, cm, store)
+	}
+
+	c := &clientData{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.activeClients.Add(1)
+			go handleConnection(conn, c, store, config, cm)
+		}
+	}()
+	return &testServer{config: config, cm: cm, store: store, addr: listener.Addr().String()}
+}
+
+// listenTestPort listens on a free loopback port. Cluster nodes also need
+// the port clusterBusPortDiff above it for the bus.
+func listenTestPort(tb testing.TB, bus bool) net.Listener {
+	tb.Helper()
+	for {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if !bus || listener.Addr().(*net.TCPAddr).Port+clusterBusPortDiff <= 65535 {
+			return listener
+		}
+		listener.Close()
+	}
+}
+
+// masterDetailsOf returns the masterAddr that makes startTestServer replicate addr.
+func masterDetailsOf(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return host + " " + port
+}
+
+func waitFor(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// replyError is an error reply read by a testClient.
+type replyError string
+
+// verbatimString is a RESP3 verbatim string read by a testClient, without
+// its format prefix.
+type verbatimString string
+
+// testClient sends commands to a test server and decodes its replies.
+type testClient struct {
+	tb     testing.TB
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestClient(tb testing.TB, addr string) *testClient {
+	tb.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return &testClient{tb: tb, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends one command and returns its reply.
+func (c *testClient) do(args ...string) any {
+	c.tb.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+func (c *testClient) send(args ...string) {
+	c.tb.Helper()
+	if _, err := c.conn.Write([]byte(respGenerator(args))); err != nil {
+		c.tb.Fatal(err)
+	}
+}
+
+// read decodes the next reply: a string for simple and bulk strings, a
+// replyError, an int for integers, nil for nulls, []any for arrays, sets and
+// pushes, map[string]any for RESP3 maps and a verbatimString.
+func (c *testClient) read() any {
+	c.tb.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := readTestReply(c.reader)
+	if err != nil {
+		c.tb.Fatalf("reading reply: %v", err)
+	}
+	return reply
+}
+
+func readTestReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return replyError(line[1:]), nil
+	case ':':
+		return strconv.Atoi(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '=':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 4 {
+			return nil, fmt.Errorf("bad verbatim string header %q", line)
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return verbatimString(buf[4:n]), nil
+	case '_':
+		return nil, nil
+	case '*', '~', '>':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readTestReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	case '%':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			key, err := readTestReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			if items[fmt.Sprint(key)], err = readTestReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func TestRepliesAreNotHeldForAPartialCommand(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	// The SET is complete, the GET behind it isn't, so the server must
+	// answer the SET instead of waiting for the rest of the batch.
+	get := respGenerator([]string{"GET", "key"})
+	client.conn.Write([]byte(respGenerator([]string{"SET", "key", "value"}) + get[:len(get)-3]))
+	if reply := client.read(); reply != "OK" {
+		t.Fatalf("SET replied %v", reply)
+	}
+	client.conn.Write([]byte(get[len(get)-3:]))
+	if reply := client.read(); reply != "value" {
+		t.Fatalf("GET replied %v", reply)
+	}
+}
+
+func TestPipelinedRepliesArriveInOrder(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	// Enough replies to overflow the reply buffer several times.
+	const count = 5000
+	var batch strings.Builder
+	for i := 0; i < count; i++ {
+		batch.WriteString(respGenerator([]string{"ECHO", strconv.Itoa(i)}))
+	}
+	go client.conn.Write([]byte(batch.String()))
+	for i := 0; i < count; i++ {
+		if reply := client.read(); reply != strconv.Itoa(i) {
+			t.Fatalf("reply %d is %v", i, reply)
+		}
+	}
+}
+
+// BenchmarkPipeline sends batches of depth commands over a loopback
+// connection served by handleConnection and waits for all of their replies
+// before sending the next batch.
+func BenchmarkPipeline(b *testing.B) {
+	for _, depth := range []int{1, 16, 128} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			server := startTestServer(b, "")
+			client := dialTestClient(b, server.addr)
+
+			var batch strings.Builder
+			for i := 0; i < depth; i++ {
+				// Every GET reads the key the SET before it wrote.
+				key := "key:" + strconv.Itoa(i/2)
+				if i%2 == 0 {
+					batch.WriteString(respGenerator([]string{"SET", key, "value"}))
+				} else {
+					batch.WriteString(respGenerator([]string{"GET", key}))
+				}
+			}
+			payload := []byte(batch.String())
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.conn.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < depth; j++ {
+					if reply, ok := client.read().(replyError); ok {
+						b.Fatalf("error reply: %s", reply)
+					}
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*depth), "ns/cmd")
+		})
+	}
+}
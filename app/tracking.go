@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// trackingReadCommands are the commands whose keys a tracking client may
+// cache, so reading them through one records the client in the tracking
+// table.
+var trackingReadCommands = map[string]bool{
+	"get":  true,
+	"dump": true,
+}
+
+// trackingOptions are the CLIENT TRACKING settings of a connection.
+type trackingOptions struct {
+	bcast  bool
+	optin  bool
+	optout bool
+	noloop bool
+	// redirect is the ID of the connection invalidations go to instead,
+	// and redirectTo that connection.
+	redirect   int64
+	redirectTo *client
+	prefixes   []string
+}
+
+// trackingTable remembers which clients may have cached which keys, so that
+// changing a key can tell them to drop it. Default mode clients are listed
+// under each key they read, broadcasting ones under the prefixes they asked
+// for. It also guards the tracking options of every client.
+type trackingTable struct {
+	mu       sync.Mutex
+	keys     map[string]map[int64]*client
+	prefixes map[string]map[int64]*client
+	// maxKeys bounds how many keys are tracked; 0 means no bound. Going
+	// over it invalidates keys until the table fits again.
+	maxKeys int
+}
+
+func newTrackingTable(maxKeys int) *trackingTable {
+	return &trackingTable{
+		keys:     make(map[string]map[int64]*client),
+		prefixes: make(map[string]map[int64]*client),
+		maxKeys:  maxKeys,
+	}
+}
+
+// enable turns tracking on for cl, or changes its options.
+func (t *trackingTable) enable(cl *client, options *trackingOptions) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cl.tracking != nil && cl.tracking.bcast != options.bcast {
+		return errors.New("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+	}
+	if options.bcast {
+		// Turning BCAST on again adds to the prefixes already tracked.
+		var prefixes []string
+		if cl.tracking != nil {
+			prefixes = append(prefixes, cl.tracking.prefixes...)
+		}
+		if len(options.prefixes) == 0 {
+			options.prefixes = []string{""}
+		}
+		for _, prefix := range options.prefixes {
+			if !slices.Contains(prefixes, prefix) {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		options.prefixes = prefixes
+		for i, prefix := range options.prefixes {
+			for _, other := range options.prefixes[:i] {
+				if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+					return fmt.Errorf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)
+				}
+			}
+		}
+	}
+	t.removePrefixes(cl)
+	cl.tracking = options
+	for _, prefix := range options.prefixes {
+		if t.prefixes[prefix] == nil {
+			t.prefixes[prefix] = make(map[int64]*client)
+		}
+		t.prefixes[prefix][cl.id] = cl
+	}
+	return nil
+}
+
+// disable turns tracking off for cl. Keys it read stay in the table until
+// they are invalidated, and are then skipped.
+func (t *trackingTable) disable(cl *client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removePrefixes(cl)
+	cl.tracking = nil
+	cl.caching = ""
+}
+
+// removePrefixes drops cl from the broadcast table. The caller holds t.mu.
+func (t *trackingTable) removePrefixes(cl *client) {
+	if cl.tracking == nil {
+		return
+	}
+	for _, prefix := range cl.tracking.prefixes {
+		delete(t.prefixes[prefix], cl.id)
+		if len(t.prefixes[prefix]) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+}
+
+// remember records that cl read keys, unless its options say it won't
+// cache them. Only cl's own connection calls it, which is why cl.tracking
+// can be read without t.mu.
+func (t *trackingTable) remember(cl *client, keys []string) {
+	options := cl.tracking
+	if options == nil || options.bcast || options.optin && cl.caching != "yes" || options.optout && cl.caching == "no" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		if t.keys[key] == nil {
+			t.keys[key] = make(map[int64]*client)
+		}
+		t.keys[key][cl.id] = cl
+	}
+	for key := range t.keys {
+		if t.maxKeys == 0 || len(t.keys) <= t.maxKeys {
+			break
+		}
+		t.invalidateLocked([]string{key}, nil)
+	}
+}
+
+// invalidate tells the clients tracking keys that they changed. origin is
+// the client that changed them, which NOLOOP clients aren't told about.
+func (t *trackingTable) invalidate(keys []string, origin *client) {
+	if len(keys) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.invalidateLocked(keys, origin)
+}
+
+func (t *trackingTable) invalidateLocked(keys []string, origin *client) {
+	var targets []*client
+	pending := make(map[*client][]string)
+	add := func(cl *client, key string) {
+		if cl.tracking == nil || cl.tracking.noloop && cl == origin {
+			return
+		}
+		if _, ok := pending[cl]; !ok {
+			targets = append(targets, cl)
+		}
+		pending[cl] = append(pending[cl], key)
+	}
+	for _, key := range keys {
+		for _, cl := range t.keys[key] {
+			if cl.tracking == nil || !cl.tracking.bcast {
+				add(cl, key)
+			}
+		}
+		delete(t.keys, key)
+		for prefix, clients := range t.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				for _, cl := range clients {
+					add(cl, key)
+				}
+			}
+		}
+	}
+	for _, cl := range targets {
+		sendInvalidation(cl, pending[cl])
+	}
+}
+
+// sendInvalidation queues the invalidation of keys for cl, or for the
+// connection it redirects to. Whether and how it is written depends on the
+// protocol of the receiving connection, which deliverMessages decides. The
+// caller holds t.mu.
+func sendInvalidation(cl *client, keys []string) {
+	if cl.tracking.redirect == 0 {
+		cl.messages.add(pubsubMessage{kind: "invalidate", keys: keys})
+		return
+	}
+	msg := pubsubMessage{kind: "invalidate", keys: keys, redirected: true}
+	if queued, _ := cl.tracking.redirectTo.messages.add(msg); !queued {
+		// The connection we redirect to is gone.
+		cl.messages.add(pubsubMessage{kind: "tracking-redir-broken", count: int(cl.tracking.redirect)})
+	}
+}
+
+// clientByID returns the connected client with the given ID.
+func (cm *connectionManager) clientByID(id int64) *client {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, cl := range cm.clients {
+		if cl.id == id {
+			return cl
+		}
+	}
+	return nil
+}
+
+// startTracking gives cl, and the client it redirects to, the buffer their
+// invalidations are queued in.
+func (cm *connectionManager) startTracking(cl *client, options *trackingOptions) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cl.startSubscriber()
+	if options.redirectTo != nil {
+		options.redirectTo.startSubscriber()
+	}
+}
+
+// clientTracking implements CLIENT TRACKING ON|OFF [REDIRECT client-id]
+// [PREFIX prefix ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP].
+func clientTracking(cl *client, args []string, store *redisStore, cm *connectionManager) error {
+	options := &trackingOptions{}
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "redirect":
+			if i+1 >= len(args) {
+				return errors.New("ERR syntax error")
+			}
+			id, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return errors.New("ERR value is not an integer or out of range")
+			}
+			options.redirect = id
+			i++
+		case "prefix":
+			if i+1 >= len(args) {
+				return errors.New("ERR syntax error")
+			}
+			options.prefixes = append(options.prefixes, args[i+1])
+			i++
+		case "bcast":
+			options.bcast = true
+		case "optin":
+			options.optin = true
+		case "optout":
+			options.optout = true
+		case "noloop":
+			options.noloop = true
+		default:
+			return errors.New("ERR syntax error")
+		}
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "off":
+		store.tracking.disable(cl)
+		cl.out.simpleString("OK")
+		return nil
+	case "on":
+	default:
+		return errors.New("ERR syntax error")
+	}
+	if len(options.prefixes) > 0 && !options.bcast {
+		return errors.New("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if options.bcast && (options.optin || options.optout) {
+		return errors.New("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	}
+	if options.optin && options.optout {
+		return errors.New("ERR You can't use both OPTIN and OPTOUT")
+	}
+	if cl.tracking != nil && (cl.tracking.optin && options.optout || cl.tracking.optout && options.optin) {
+		return errors.New("ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+	}
+	if options.redirect != 0 {
+		if options.redirect == cl.id {
+			return errors.New("ERR A client can only redirect to a different client")
+		}
+		if options.redirectTo = cm.clientByID(options.redirect); options.redirectTo == nil {
+			return errors.New("ERR The client ID you want redirect to does not exist")
+		}
+	}
+	cm.startTracking(cl, options)
+	if err := store.tracking.enable(cl, options); err != nil {
+		return err
+	}
+	cl.out.simpleString("OK")
+	return nil
+}
+
+// clientCaching implements CLIENT CACHING YES|NO, which decides whether the
+// keys read by the next command are tracked in OPTIN or OPTOUT mode.
+func clientCaching(cl *client, args []string) error {
+	if cl.tracking == nil || !cl.tracking.optin && !cl.tracking.optout {
+		return errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	switch strings.ToLower(args[0]) {
+	case "yes":
+		if !cl.tracking.optin {
+			return errors.New("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+		}
+		cl.caching = "yes"
+	case "no":
+		if !cl.tracking.optout {
+			return errors.New("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+		}
+		cl.caching = "no"
+	default:
+		return errors.New("ERR syntax error")
+	}
+	cl.out.simpleString("OK")
+	return nil
+}
+
+// clientTrackingInfo implements CLIENT TRACKINGINFO.
+func clientTrackingInfo(cl *client) {
+	w := cl.out
+	options := cl.tracking
+	w.mapHeader(3)
+	w.bulk("flags")
+	if options == nil {
+		w.bulkArray([]string{"off"})
+	} else {
+		flags := []string{"on"}
+		for _, flag := range []struct {
+			set  bool
+			name string
+		}{{options.bcast, "bcast"}, {options.optin, "optin"}, {options.optout, "optout"}, {options.noloop, "noloop"}} {
+			if flag.set {
+				flags = append(flags, flag.name)
+			}
+		}
+		if cl.caching == "yes" {
+			flags = append(flags, "caching-yes")
+		} else if cl.caching == "no" {
+			flags = append(flags, "caching-no")
+		}
+		if options.redirect != 0 && options.redirectTo.messages.isClosed() {
+			flags = append(flags, "broken_redirect")
+		}
+		w.bulkArray(flags)
+	}
+	w.bulk("redirect")
+	if options == nil {
+		w.integer(-1)
+	} else {
+		w.integer(options.redirect)
+	}
+	w.bulk("prefixes")
+	if options == nil {
+		w.bulkArray(nil)
+	} else {
+		w.bulkArray(options.prefixes)
+	}
+}
+
+// clientCommand implements the CLIENT subcommands: ID, TRACKING, CACHING,
+// GETREDIR and TRACKINGINFO.
+func clientCommand(cl *client, args []string, store *redisStore, cm *connectionManager) error {
+	subcommand := strings.ToLower(args[0])
+	arity := map[string]int{"id": 1, "tracking": -2, "caching": 2, "getredir": 1, "trackinginfo": 1}
+	n, ok := arity[subcommand]
+	if !ok {
+		return fmt.Errorf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0])
+	}
+	if n > 0 && len(args) != n || n < 0 && len(args) < -n {
+		return fmt.Errorf("ERR wrong number of arguments for 'client|%s' command", subcommand)
+	}
+	switch subcommand {
+	case "id":
+		cl.out.integer(cl.id)
+	case "tracking":
+		return clientTracking(cl, args[1:], store, cm)
+	case "caching":
+		return clientCaching(cl, args[1:])
+	case "getredir":
+		if cl.tracking == nil {
+			cl.out.integer(-1)
+		} else {
+			cl.out.integer(cl.tracking.redirect)
+		}
+	case "trackinginfo":
+		clientTrackingInfo(cl)
+	}
+	return nil
+}
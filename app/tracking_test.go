@@ -0,0 +1,211 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestTrackingClientsAreToldAboutKeysTheyRead(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	client.do("HELLO", "3")
+	if reply := client.do("CLIENT", "TRACKING", "ON"); reply != "OK" {
+		t.Fatalf("CLIENT TRACKING ON replied %v", reply)
+	}
+	client.do("GET", "k")
+	other.do("SET", "k", "v")
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"k"}}) {
+		t.Fatalf("SET of a read key pushed %v", reply)
+	}
+
+	// The key was forgotten with the invalidation, so changing it again
+	// says nothing until it is read again.
+	other.do("SET", "k", "again")
+	other.do("SET", "unread", "v")
+	if reply := client.do("GET", "k"); reply != "again" {
+		t.Fatalf("GET replied %v", reply)
+	}
+	other.do("DEL", "k")
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"k"}}) {
+		t.Fatalf("DEL of a read key pushed %v", reply)
+	}
+
+	client.do("CLIENT", "TRACKING", "OFF")
+	client.do("GET", "k")
+	other.do("SET", "k", "v")
+	if reply := client.do("PING"); reply != "PONG" {
+		t.Fatalf("PING after tracking was turned off got %v", reply)
+	}
+}
+
+func TestTrackingRedirectsToAResp2Subscriber(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	receiver := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	id, ok := receiver.do("CLIENT", "ID").(int)
+	if !ok {
+		t.Fatal("CLIENT ID did not reply with an integer")
+	}
+	receiver.do("SUBSCRIBE", "__redis__:invalidate")
+	redirect := []string{"CLIENT", "TRACKING", "ON", "REDIRECT", ""}
+	redirect[4] = strconv.Itoa(id)
+	if reply := client.do(redirect...); reply != "OK" {
+		t.Fatalf("CLIENT TRACKING ON REDIRECT replied %v", reply)
+	}
+	if reply := client.do("CLIENT", "GETREDIR"); reply != id {
+		t.Fatalf("CLIENT GETREDIR replied %v, want %d", reply, id)
+	}
+	client.do("GET", "k")
+	other.do("SET", "k", "v")
+	if reply := receiver.read(); !reflect.DeepEqual(reply, []any{"message", "__redis__:invalidate", []any{"k"}}) {
+		t.Fatalf("redirected invalidation was %v", reply)
+	}
+
+	self, _ := client.do("CLIENT", "ID").(int)
+	redirect[4] = strconv.Itoa(self)
+	if reply := client.do(redirect...); reply != replyError("ERR A client can only redirect to a different client") {
+		t.Fatalf("redirecting to itself replied %v", reply)
+	}
+	redirect[4] = "999999"
+	if reply := client.do(redirect...); reply != replyError("ERR The client ID you want redirect to does not exist") {
+		t.Fatalf("redirecting to a missing client replied %v", reply)
+	}
+}
+
+func TestBroadcastTrackingFollowsPrefixes(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	client.do("HELLO", "3")
+	if reply := client.do("CLIENT", "TRACKING", "ON", "PREFIX", "user:"); reply != replyError("ERR PREFIX option requires BCAST mode to be enabled") {
+		t.Fatalf("PREFIX without BCAST replied %v", reply)
+	}
+	if reply := client.do("CLIENT", "TRACKING", "ON", "BCAST", "OPTIN"); reply != replyError("ERR OPTIN and OPTOUT are not compatible with BCAST") {
+		t.Fatalf("BCAST with OPTIN replied %v", reply)
+	}
+	if _, ok := client.do("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "PREFIX", "user:1").(replyError); !ok {
+		t.Fatal("overlapping prefixes were accepted")
+	}
+	if reply := client.do("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:", "PREFIX", "job:"); reply != "OK" {
+		t.Fatalf("CLIENT TRACKING ON BCAST replied %v", reply)
+	}
+
+	// Keys under a prefix are reported whether or not they were read.
+	other.do("SET", "user:1", "v")
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"user:1"}}) {
+		t.Fatalf("SET under a prefix pushed %v", reply)
+	}
+	other.do("SET", "other", "v")
+	other.do("SET", "job:1", "v")
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"job:1"}}) {
+		t.Fatalf("SET under the second prefix pushed %v", reply)
+	}
+
+	info, ok := client.do("CLIENT", "TRACKINGINFO").(map[string]any)
+	if !ok {
+		t.Fatal("CLIENT TRACKINGINFO did not reply with a map")
+	}
+	want := map[string]any{"flags": []any{"on", "bcast"}, "redirect": 0, "prefixes": []any{"user:", "job:"}}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("CLIENT TRACKINGINFO replied %v, want %v", info, want)
+	}
+	if _, ok := client.do("CLIENT", "TRACKING", "ON").(replyError); !ok {
+		t.Fatal("tracking switched out of BCAST without being turned off")
+	}
+}
+
+func TestOptinAndOptoutFollowClientCaching(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	client.do("HELLO", "3")
+	if _, ok := client.do("CLIENT", "CACHING", "YES").(replyError); !ok {
+		t.Fatal("CLIENT CACHING was accepted without tracking")
+	}
+	client.do("CLIENT", "TRACKING", "ON", "OPTIN")
+	if _, ok := client.do("CLIENT", "CACHING", "NO").(replyError); !ok {
+		t.Fatal("CLIENT CACHING NO was accepted in OPTIN mode")
+	}
+	client.do("GET", "skipped")
+	client.do("CLIENT", "CACHING", "YES")
+	client.do("GET", "cached")
+	// CACHING YES covers only the next command.
+	client.do("GET", "after")
+	other.do("SET", "skipped", "v")
+	other.do("SET", "after", "v")
+	other.do("SET", "cached", "v")
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"cached"}}) {
+		t.Fatalf("OPTIN client was pushed %v", reply)
+	}
+
+	client.do("CLIENT", "TRACKING", "OFF")
+	client.do("CLIENT", "TRACKING", "ON", "OPTOUT")
+	client.do("CLIENT", "CACHING", "NO")
+	client.do("GET", "skipped")
+	client.do("GET", "cached")
+	other.do("SET", "skipped", "v")
+	other.do("SET", "cached", "v")
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"cached"}}) {
+		t.Fatalf("OPTOUT client was pushed %v", reply)
+	}
+}
+
+func TestNoloopSkipsTheClientsOwnWrites(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	client.do("HELLO", "3")
+	client.do("CLIENT", "TRACKING", "ON", "NOLOOP")
+	client.do("GET", "k")
+	client.do("SET", "k", "mine")
+	client.do("GET", "k")
+	other.do("SET", "k", "theirs")
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"k"}}) {
+		t.Fatalf("NOLOOP client was pushed %v", reply)
+	}
+}
+
+func TestTrackingTableMaxKeysEvictsKeys(t *testing.T) {
+	server := startTestServer(t, "", func(config *config) { config.server.trackingTableMaxKeys = 1 })
+	client := dialTestClient(t, server.addr)
+
+	client.do("HELLO", "3")
+	client.do("CLIENT", "TRACKING", "ON")
+	client.do("GET", "a")
+	client.do("GET", "b")
+	// Reading b pushes the table over its bound, so one of the keys is
+	// given up.
+	reply := client.read()
+	if !reflect.DeepEqual(reply, []any{"invalidate", []any{"a"}}) && !reflect.DeepEqual(reply, []any{"invalidate", []any{"b"}}) {
+		t.Fatalf("going over tracking-table-max-keys pushed %v", reply)
+	}
+	server.store.tracking.mu.Lock()
+	tracked := len(server.store.tracking.keys)
+	server.store.tracking.mu.Unlock()
+	if tracked != 1 {
+		t.Fatalf("tracking table holds %d keys, want 1", tracked)
+	}
+}
+
+func TestExpiredKeysAreInvalidated(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	client.do("HELLO", "3")
+	client.do("CLIENT", "TRACKING", "ON")
+	other.do("SET", "k", "v", "PX", "1")
+	client.do("GET", "k")
+	waitFor(t, "the key to expire", func() bool { return other.do("GET", "k") == nil })
+	if reply := client.read(); !reflect.DeepEqual(reply, []any{"invalidate", []any{"k"}}) {
+		t.Fatalf("expired key pushed %v", reply)
+	}
+}
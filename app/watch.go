@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+)
+
+// keyWatch tracks a key that at least one client WATCHes. version goes up on
+// every change to the key, so a client can tell whether it moved on since
+// WATCH. Unwatched keys aren't tracked at all.
+type keyWatch struct {
+	clients int
+	version uint64
+}
+
+// watchedKey is what a client saw of a key when it WATCHed it.
+type watchedKey struct {
+	key     string
+	version uint64
+	// live records that the key existed then, so that it expiring before
+	// EXEC counts as a change.
+	live bool
+}
+
+// touch records a change to key. The caller holds r.mu for writing.
+func (r *redisStore) touch(key string) {
+	if watch, ok := r.watched[key]; ok {
+		watch.version++
+	}
+}
+
+func (r *redisStore) watch(key string) watchedKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	watch, ok := r.watched[key]
+	if !ok {
+		watch = &keyWatch{}
+		r.watched[key] = watch
+	}
+	watch.clients++
+	val, ok := r.store[key]
+	return watchedKey{key: key, version: watch.version, live: ok && (val.expiry == 0 || !expired(val.expiry))}
+}
+
+func (r *redisStore) unwatch(keys []watchedKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, watched := range keys {
+		watch, ok := r.watched[watched.key]
+		if !ok {
+			continue
+		}
+		if watch.clients--; watch.clients == 0 {
+			delete(r.watched, watched.key)
+		}
+	}
+}
+
+// changedSince reports whether any of keys was modified, or expired, after
+// it was watched.
+func (r *redisStore) changedSince(keys []watchedKey) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, watched := range keys {
+		if r.watched[watched.key].version != watched.version {
+			return true
+		}
+		if watched.live {
+			val, ok := r.store[watched.key]
+			if !ok || val.expiry != 0 && expired(val.expiry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// watchKeys implements WATCH key [key ...].
+func watchKeys(cl *client, args []string, store *redisStore) error {
+	if cl.inMulti {
+		return errors.New("ERR WATCH inside MULTI is not allowed")
+	}
+	for _, key := range args {
+		if !cl.watching(key) {
+			cl.watched = append(cl.watched, store.watch(key))
+		}
+	}
+	cl.out.simpleString("OK")
+	return nil
+}
+
+// unwatchKeys forgets every key the client watches. EXEC and DISCARD do so
+// too, whatever the outcome of the transaction.
+func unwatchKeys(cl *client, store *redisStore) {
+	if len(cl.watched) > 0 {
+		store.unwatch(cl.watched)
+		cl.watched = nil
+	}
+}
+
+func (cl *client) watching(key string) bool {
+	for _, watched := range cl.watched {
+		if watched.key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExecFailsAfterAWatchedKeyChanges(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	client.do("SET", "k", "1")
+	if reply := client.do("WATCH", "k", "k"); reply != "OK" {
+		t.Fatalf("WATCH replied %v", reply)
+	}
+	other.do("SET", "k", "2")
+	client.do("MULTI")
+	client.do("SET", "k", "3")
+	if reply := client.do("EXEC"); reply != nil {
+		t.Fatalf("EXEC after a watched key changed replied %v, want nil", reply)
+	}
+	if reply := client.do("GET", "k"); reply != "2" {
+		t.Fatalf("the discarded transaction ran: GET replied %v", reply)
+	}
+
+	// EXEC unwatched the key, so the next transaction goes through.
+	other.do("SET", "k", "4")
+	client.do("MULTI")
+	client.do("SET", "k", "5")
+	if reply := client.do("EXEC"); !reflect.DeepEqual(reply, []any{"OK"}) {
+		t.Fatalf("EXEC after the keys were unwatched replied %v", reply)
+	}
+	if n := watchedCount(server.store); n != 0 {
+		t.Fatalf("store still tracks %d watched keys", n)
+	}
+}
+
+func TestWatchedKeysThatStayPutLetExecRun(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+	other := dialTestClient(t, server.addr)
+
+	client.do("WATCH", "k")
+	other.do("SET", "unrelated", "v")
+	other.do("DEL", "missing")
+	client.do("MULTI")
+	client.do("SET", "k", "v")
+	if reply := client.do("EXEC"); !reflect.DeepEqual(reply, []any{"OK"}) {
+		t.Fatalf("EXEC replied %v", reply)
+	}
+
+	client.do("WATCH", "k")
+	other.do("DEL", "k")
+	if reply := client.do("UNWATCH"); reply != "OK" {
+		t.Fatalf("UNWATCH replied %v", reply)
+	}
+	client.do("MULTI")
+	client.do("SET", "k", "v")
+	if reply := client.do("EXEC"); !reflect.DeepEqual(reply, []any{"OK"}) {
+		t.Fatalf("EXEC after UNWATCH replied %v", reply)
+	}
+
+	client.do("MULTI")
+	if reply := client.do("WATCH", "k"); reply != replyError("ERR WATCH inside MULTI is not allowed") {
+		t.Fatalf("WATCH inside MULTI replied %v", reply)
+	}
+}
+
+func TestExecFailsAfterAWatchedKeyExpires(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	client.do("SET", "k", "v", "PX", "50")
+	client.do("WATCH", "k")
+	time.Sleep(100 * time.Millisecond)
+	client.do("MULTI")
+	client.do("SET", "other", "v")
+	if reply := client.do("EXEC"); reply != nil {
+		t.Fatalf("EXEC after a watched key expired replied %v, want nil", reply)
+	}
+}
+
+func TestClosingTheConnectionUnwatches(t *testing.T) {
+	server := startTestServer(t, "")
+	client := dialTestClient(t, server.addr)
+
+	client.do("WATCH", "a", "b")
+	if n := watchedCount(server.store); n != 2 {
+		t.Fatalf("store tracks %d watched keys, want 2", n)
+	}
+	client.conn.Close()
+	waitFor(t, "the watches to go", func() bool { return watchedCount(server.store) == 0 })
+}
+
+func watchedCount(store *redisStore) int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.watched)
+}